@@ -1,15 +1,24 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/davidbanham/human_duration"
@@ -50,7 +59,8 @@ func getApps(secCookie string, fs *torDropFileServer, assetsDir string, static b
 		static:    static,
 	}
 	funcs := map[string]interface{}{
-		"csrf": csrf.TemplateField,
+		"csrf":      csrf.TemplateField,
+		"csrfToken": csrf.Token,
 		"ints": func(u interface{}) string {
 			switch x := u.(type) {
 			case *int:
@@ -161,6 +171,12 @@ func getApps(secCookie string, fs *torDropFileServer, assetsDir string, static b
 	if err != nil {
 		return
 	}
+	// the templates are parsed on execution, the admin app gets its own functions.
+	adminFuncs := template.FuncMap{}
+	for k, v := range funcs {
+		adminFuncs[k] = v
+	}
+	funcs = adminFuncs
 	funcs["urlFor"] = func(s string, a ...string) string {
 		u, err := admin.GetRoute(s).URL(a...)
 		if err != nil {
@@ -199,6 +215,12 @@ type torDropTpl struct {
 	folderListing tplExecer
 	folderLogin   tplExecer
 	assetInfo     tplExecer
+	unlock        tplExecer
+	transfers     tplExecer
+	quarantine    tplExecer
+	trash         tplExecer
+	source        tplExecer
+	sources       tplExecer
 	// assetUpload   tplExecer
 }
 
@@ -218,6 +240,24 @@ func (t *torDropTpl) Build(funcs template.FuncMap) (err error) {
 	t.assetInfo, err = fileTemplate(funcs,
 		"templates/asset-info-custom.tpl", "templates/asset-info.tpl",
 		"templates/layout-custom.tpl", "templates/layout.tpl")
+	t.unlock, err = fileTemplate(funcs,
+		"templates/unlock-custom.tpl", "templates/unlock.tpl",
+		"templates/layout-custom.tpl", "templates/layout.tpl")
+	t.transfers, err = fileTemplate(funcs,
+		"templates/transfers-custom.tpl", "templates/transfers.tpl",
+		"templates/layout-custom.tpl", "templates/layout.tpl")
+	t.quarantine, err = fileTemplate(funcs,
+		"templates/quarantine-custom.tpl", "templates/quarantine.tpl",
+		"templates/layout-custom.tpl", "templates/layout.tpl")
+	t.trash, err = fileTemplate(funcs,
+		"templates/trash-custom.tpl", "templates/trash.tpl",
+		"templates/layout-custom.tpl", "templates/layout.tpl")
+	t.source, err = fileTemplate(funcs,
+		"templates/source-custom.tpl", "templates/source.tpl",
+		"templates/layout-custom.tpl", "templates/layout.tpl")
+	t.sources, err = fileTemplate(funcs,
+		"templates/sources-custom.tpl", "templates/sources.tpl",
+		"templates/layout-custom.tpl", "templates/layout.tpl")
 	// t.assetUpload, err = fileTemplate(funcs,
 	// 	"templates/asset-upload-custom.tpl", "templates/asset-upload.tpl",
 	// 	"templates/layout-custom.tpl", "templates/layout.tpl")
@@ -226,10 +266,15 @@ func (t *torDropTpl) Build(funcs template.FuncMap) (err error) {
 
 func (t *torDropApp) Index(w http.ResponseWriter, r *http.Request) {
 	folders := t.fs.Folders(t.isAdmin)
+	var locked bool
+	if t.isAdmin {
+		_, locked, _ = t.fs.CryptState()
+	}
 	data := map[string]interface{}{
 		"IsAdmin": t.isAdmin,
 		"Request": r,
 		"Folders": folders,
+		"Locked":  locked,
 		"Now":     time.Now(),
 	}
 	err := t.tpl.index.Execute(w, data)
@@ -357,6 +402,209 @@ func (t *torDropApp) EditFolder(w http.ResponseWriter, r *http.Request) {
 		log.Printf("failed to serve create-folder handler: %v\n", err)
 	}
 }
+
+// Unlock unlocks the encryption keys with the administrator passphrase,
+// or changes it.
+func (t *torDropApp) Unlock(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var success string
+	initialized, locked, err := t.fs.CryptState()
+	if err == nil && r.Method == http.MethodPost {
+		err = r.ParseForm()
+		passphrase := r.Form.Get("Passphrase")
+		if err == nil && (!initialized || !locked) && passphrase != r.Form.Get("Confirm") {
+			err = fmt.Errorf("the passphrases do not match")
+		}
+		if err == nil {
+			if locked {
+				err = t.fs.Unlock(passphrase)
+				success = "the encryption keys are unlocked"
+			} else {
+				err = t.fs.ChangePassphrase(passphrase)
+				success = "the passphrase was changed"
+			}
+		}
+		if err != nil {
+			success = ""
+		}
+		initialized, locked, _ = t.fs.CryptState()
+	}
+	data := map[string]interface{}{
+		"IsAdmin":     t.isAdmin,
+		"Request":     r,
+		"Initialized": initialized,
+		"Locked":      locked,
+		"Success":     success,
+		"Error":       err,
+		"Now":         time.Now(),
+	}
+	err = t.tpl.unlock.Execute(w, data)
+	if err != nil {
+		log.Printf("failed to serve unlock handler: %v\n", err)
+	}
+}
+
+// Transfers lists the uploads and downloads in flight, and cancels them.
+func (t *torDropApp) Transfers(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var success string
+	if r.Method == http.MethodPost {
+		err = r.ParseForm()
+		if err == nil && r.Form.Get("action") == "cancel" {
+			var id uint64
+			id, err = strconv.ParseUint(r.Form.Get("ID"), 10, 64)
+			if err == nil {
+				err = t.fs.CancelTransfer(id)
+			}
+			if err == nil {
+				success = "the transfer was cancelled"
+			}
+		} else if err == nil && r.Form.Get("action") == "cancel-folder" {
+			n := t.fs.CancelFolderTransfers(r.Form.Get("Folder"))
+			success = fmt.Sprintf("%v transfers were cancelled", n)
+		}
+	}
+	transfers := t.fs.Transfers()
+	var folders []string
+	seen := map[string]bool{}
+	for _, tr := range transfers {
+		if !seen[tr.Folder] {
+			seen[tr.Folder] = true
+			folders = append(folders, tr.Folder)
+		}
+	}
+	sort.Strings(folders)
+	data := map[string]interface{}{
+		"IsAdmin":   t.isAdmin,
+		"Request":   r,
+		"Transfers": transfers,
+		"Folders":   folders,
+		"Success":   success,
+		"Error":     err,
+		"Now":       time.Now(),
+	}
+	err = t.tpl.transfers.Execute(w, data)
+	if err != nil {
+		log.Printf("failed to serve transfers handler: %v\n", err)
+	}
+}
+
+// Quarantine lists the quarantined items of all the folders.
+func (t *torDropApp) Quarantine(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"IsAdmin": t.isAdmin,
+		"Request": r,
+		"Items":   t.fs.QuarantinedItems(),
+		"Now":     time.Now(),
+	}
+	err := t.tpl.quarantine.Execute(w, data)
+	if err != nil {
+		log.Printf("failed to serve quarantine handler: %v\n", err)
+	}
+}
+
+// itemContent serves an opened item with http.ServeContent, which handles
+// the range and the conditional requests. Reading from another offset than
+// the current one reopens the item at this offset.
+type itemContent struct {
+	size   int64
+	offset int64
+	src    io.ReadCloser
+	// srcOffset is the offset of src within the content.
+	srcOffset int64
+	open      func(offset int64) (io.ReadCloser, error)
+}
+
+func (c *itemContent) Read(p []byte) (int, error) {
+	if c.src != nil && c.srcOffset != c.offset {
+		c.src.Close()
+		c.src = nil
+	}
+	if c.src == nil {
+		src, err := c.open(c.offset)
+		if err != nil {
+			return 0, err
+		}
+		c.src, c.srcOffset = src, c.offset
+	}
+	n, err := c.src.Read(p)
+	c.offset += int64(n)
+	c.srcOffset += int64(n)
+	return n, err
+}
+
+func (c *itemContent) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += c.size
+	}
+	if offset < 0 {
+		return c.offset, fmt.Errorf("invalid offset %v", offset)
+	}
+	c.offset = offset
+	return offset, nil
+}
+
+func (c *itemContent) Close() error {
+	if c.src == nil {
+		return nil
+	}
+	return c.src.Close()
+}
+
+// countingWriter records the status and the count of bytes of a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Trash lists the deleted items and folders, the administrators restore or purge them.
+func (t *torDropApp) Trash(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err == nil && r.Method == http.MethodPost {
+		switch r.Form.Get("action") {
+		case "restore":
+			err = t.fs.RestoreTrash(r.Form.Get("Folder"), r.Form.Get("ID"))
+		case "purge":
+			err = t.fs.PurgeTrash(r.Form.Get("Folder"), r.Form.Get("ID"))
+		}
+		if err == nil {
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+			return
+		}
+	}
+	data := map[string]interface{}{
+		"IsAdmin": t.isAdmin,
+		"Request": r,
+		"Items":   t.fs.Trash(),
+		"Error":   err,
+		"Now":     time.Now(),
+	}
+	err = t.tpl.trash.Execute(w, data)
+	if err != nil {
+		log.Printf("failed to serve trash handler: %v\n", err)
+	}
+}
+
 func (t *torDropApp) RmFolder(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var fd folder
@@ -364,7 +612,7 @@ func (t *torDropApp) RmFolder(w http.ResponseWriter, r *http.Request) {
 		err = r.ParseForm()
 		if err == nil {
 			if err = t.decoder.Decode(&fd, r.Form); err == nil {
-				err = t.fs.RmFolder(fd.Name)
+				err = t.fs.TrashFolder(fd.Name)
 				if err == nil {
 					var url *url.URL
 					url, err = t.router.Get("index").URL()
@@ -502,12 +750,23 @@ func (t *torDropApp) hasAuthFolder(folderName string, w http.ResponseWriter, r *
 
 func (t *torDropApp) FolderListing(w http.ResponseWriter, r *http.Request) {
 
+	// the files of a multipart form are streamed once the fields preceding
+	// them were checked, so that nothing is received from unauthorized users.
+	var mr *multipart.Reader
+	var part *multipart.Part
+	var formErr error
 	if r.Method == http.MethodPost {
-		r.ParseMultipartForm(maxMemory)
+		if mr, formErr = r.MultipartReader(); formErr == nil {
+			part, formErr = multipartFields(r, mr)
+		} else {
+			mr = nil
+			formErr = r.ParseForm()
+		}
 	}
 
 	vars := mux.Vars(r)
 	folderName := vars["folder"]
+	dir := cleanDir(vars["path"])
 	fd := t.fs.Folder(folderName)
 
 	var isValidLogin bool
@@ -550,71 +809,90 @@ func (t *torDropApp) FolderListing(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var passCaptcha bool
-	if fd != nil {
-		if (fd.Password != nil && *fd.Password != "") || len(fd.Users) > 0 {
-			if !fd.CaptchaForLoggedUsers && isValidLogin {
-				passCaptcha = true
-			}
-		} else if !fd.CaptchaForAnonymous {
-			passCaptcha = true
-		}
-	}
+	passCaptcha := fd != nil && !t.captchaRequired(fd, isValidLogin)
 
-	if t.isAdmin {
-		passCaptcha = true
+	if err == nil {
+		err = formErr
 	}
+	if r.Method == http.MethodPost && err == nil {
+		if t.isAdmin && r.Form.Get("action") == "rma" && r.Form.Get("Release") != "" {
+			err = t.fs.QuarantineItem(fd.Name, r.Form.Get("Release"), "")
 
-	if r.Method == http.MethodPost {
-		if t.isAdmin && r.Form.Get("action") == "rma" {
-			err = t.fs.RmItem(fd.Name, r.Form.Get("Name"))
+		} else if t.isAdmin && r.Form.Get("action") == "rma" {
+			err = t.fs.TrashItem(fd.Name, r.Form.Get("Name"))
+
+		} else if t.isAdmin && r.Form.Get("action") == "mkdir" {
+			err = t.fs.CreateDir(fd.Name, path.Join(dir, r.Form.Get("Name")))
+
+		} else if t.isAdmin && r.Form.Get("action") == "rmdir" {
+			err = t.fs.TrashDir(fd.Name, path.Join(dir, r.Form.Get("Name")))
+
+		} else if t.isAdmin && r.Form.Get("action") == "mvdir" {
+			err = t.fs.RenameDir(fd.Name, path.Join(dir, r.Form.Get("Name")), r.Form.Get("NewName"))
 
 		} else if r.Form.Get("action") == "upload" {
 			if passCaptcha == false {
-				solution := r.Form.Get("Solution")
-				captchaID := r.Form.Get("CaptchaID")
-				if solution != "" && t.captchaSolution == solution {
-					//OK
-				} else if !captcha.VerifyString(captchaID, solution) {
-					err = fmt.Errorf("invalid captcha solution")
-				}
+				err = t.verifyCaptcha(r.Form.Get("CaptchaID"), r.Form.Get("Solution"))
+			}
+			message := strings.TrimSpace(r.Form.Get("Message"))
+			if err == nil && mr == nil && message == "" {
+				err = fmt.Errorf("the upload must be a multipart form")
 			}
+			if err == nil && len(message) > maxMessageLen {
+				err = fmt.Errorf("the message is too long, it must not exceed %v bytes", maxMessageLen)
+			}
+			opts := uploadOptions{Owner: t.uploaderID(w, r)}
+			var source string
 			if err == nil {
-				files := r.MultipartForm.File["files"]
-				for i := range files {
-					var src io.ReadCloser
-					src, err = files[i].Open()
-					if err == nil {
-						fn := filepath.Base(files[i].Filename)
-						if len(fn) > 220 {
-							fn = fn[:220]
-						}
-						item := fileItem{
-							CreateDate: time.Now(),
-							Name:       fn,
-							Path:       "/",
-							Size:       uint64(files[i].Size),
-						}
-						err = t.fs.UploadItem(folderName, item, src)
-					}
-					if err != nil {
-						break
+				source, err = t.uploadSource(fd, w, r)
+			}
+			// a message groups the files sent along with it into a submission.
+			var sub string
+			if err == nil && message != "" {
+				sub = newSubmissionID()
+				item := messageItem(sub, dir, source, len(message))
+				_, err = t.fs.UploadItem(folderName, item, ioutil.NopCloser(strings.NewReader(message)), opts)
+			}
+			for err == nil && part != nil {
+				if part.FormName() == "files" && part.FileName() != "" {
+					item := fileItem{
+						CreateDate: time.Now(),
+						Name:       uploadName(part.FileName()),
+						Path:       dir,
+						SHA256:     strings.TrimSpace(r.Form.Get("SHA256")),
+						BLAKE2b:    strings.TrimSpace(r.Form.Get("BLAKE2b")),
+						Source:     source,
+						Submission: sub,
 					}
+					_, err = t.fs.UploadItem(folderName, item, part, opts)
 				}
 				if err == nil {
-					var u *url.URL
-					u, err = t.router.Get("folder-listing").URL("folder", folderName)
-					if err == nil {
-						http.Redirect(w, r, u.String(), http.StatusSeeOther)
-						return
+					part, err = mr.NextPart()
+					if err == io.EOF {
+						part, err = nil, nil
 					}
 				}
 			}
+			if err == nil {
+				var u *url.URL
+				u, err = t.dirURL(folderName, dir)
+				if err == nil {
+					http.Redirect(w, r, u.String(), http.StatusSeeOther)
+					return
+				}
+			}
 		}
 	}
 
 	var items fileItems
+	var dirs []string
 	if fd != nil {
+		var e error
+		dirs, e = t.fs.Dirs(folderName, dir)
+		if e != nil {
+			http.NotFound(w, r)
+			return
+		}
 		if t.isAdmin && fd.IsAdminOnlyReadable {
 			x, e := t.fs.Items(folderName, true)
 			items = x
@@ -638,80 +916,324 @@ func (t *torDropApp) FolderListing(w http.ResponseWriter, r *http.Request) {
 		c = captcha.New()
 	}
 
+	// the quarantined items are only listed to the administrators,
+	// the messages are shown to them within their submissions.
+	var listed fileItems
+	for _, i := range items {
+		if !i.Message && (i.Quarantine == "" || t.isAdmin) && !fd.Exhausted(i) {
+			listed = append(listed, i)
+		}
+	}
+	var submissions []submission
+	if t.isAdmin {
+		submissions = t.fs.Submissions(folderName, items.In(dir))
+	}
+
+	type crumb struct {
+		Name string
+		Path string
+	}
+	var breadcrumbs []crumb
+	for d := dir; d != "/"; d = path.Dir(d) {
+		breadcrumbs = append([]crumb{{Name: path.Base(d), Path: strings.TrimPrefix(d, "/")}}, breadcrumbs...)
+	}
+	var subDirs []crumb
+	for _, d := range dirs {
+		subDirs = append(subDirs, crumb{Name: path.Base(d), Path: strings.TrimPrefix(d, "/")})
+	}
+
+	var codename string
+	if fd.Codenames && !t.isAdmin {
+		codename = t.newCodenameFlash(folderName, w, r)
+	}
+
 	data := map[string]interface{}{
-		"IsAdmin":   t.isAdmin,
-		"CaptchaID": c,
-		"Request":   r,
-		"Folder":    fd,
-		"Items":     items,
-		"Error":     err,
-		"Now":       time.Now(),
+		"IsAdmin":     t.isAdmin,
+		"Codename":    codename,
+		"CaptchaID":   c,
+		"Request":     r,
+		"Folder":      fd,
+		"Path":        dir,
+		"Breadcrumbs": breadcrumbs,
+		"Dirs":        subDirs,
+		"AllItems":    items,
+		"Items":       listed.In(dir),
+		"Submissions": submissions,
+		"Error":       err,
+		"Now":         time.Now(),
 	}
 	err = t.tpl.folderListing.Execute(w, data)
 	if err != nil {
 		log.Printf("failed to serve folder-listing handler: %v\n", err)
 	}
 }
-func (t *torDropApp) AssetDl(w http.ResponseWriter, r *http.Request) {
-	var err error
-	vars := mux.Vars(r)
-	folderName := vars["folder"]
-	fileName := vars["name"]
+
+// multipartFields reads the fields of mr into the form of r,
+// it stops at the first file which is returned.
+func multipartFields(r *http.Request, mr *multipart.Reader) (*multipart.Part, error) {
+	r.Form = r.URL.Query()
+	n := maxMemory
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(part, n+1))
+		if err != nil {
+			return nil, err
+		}
+		if n -= int64(len(b)); n < 0 {
+			return nil, fmt.Errorf("the form fields are too large")
+		}
+		r.Form.Add(part.FormName(), string(b))
+	}
+}
+
+// csrfQueryToken passes the csrf token found in the url of a form to the csrf header,
+// csrf.Protect would otherwise read the whole multipart body to find it.
+func csrfQueryToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tok := r.URL.Query().Get("gorilla.csrf.Token"); tok != "" && r.Header.Get("X-CSRF-Token") == "" {
+			r.Header.Set("X-CSRF-Token", tok)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// captchaRequired tells whether uploads to the folder fd must solve a captcha.
+func (t *torDropApp) captchaRequired(fd *folder, isValidLogin bool) bool {
+	if t.isAdmin {
+		return false
+	}
+	if (fd.Password != nil && *fd.Password != "") || len(fd.Users) > 0 {
+		return fd.CaptchaForLoggedUsers || !isValidLogin
+	}
+	return fd.CaptchaForAnonymous
+}
+
+// verifyCaptcha checks the solution of the captcha id.
+func (t *torDropApp) verifyCaptcha(id, solution string) error {
+	if solution != "" && t.captchaSolution == solution {
+		return nil
+	}
+	if !captcha.VerifyString(id, solution) {
+		return fmt.Errorf("invalid captcha solution")
+	}
+	return nil
+}
+
+// uploadName returns the name of an uploaded file from its client side name.
+func uploadName(fn string) string {
+	fn = filepath.Base(fn)
+	if len(fn) > 220 {
+		fn = fn[:220]
+	}
+	return fn
+}
+
+// uploaderID returns the id identifying the uploads of the session,
+// it is created on first use.
+func (t *torDropApp) uploaderID(w http.ResponseWriter, r *http.Request) string {
+	sess, err := t.session.Get(r, "uploader")
+	if id, ok := sess.Values["id"].(string); err == nil && ok && id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	sess.Values["id"] = id
+	if err := t.session.Save(r, w, sess); err != nil {
+		t.logger.Error("failed to save session store uploader: %v", err)
+	}
+	return id
+}
+
+// Progress streams the progress events of the uploads of a folder as
+// server-sent events, the public zone only receives the uploads of the session.
+func (t *torDropApp) Progress(w http.ResponseWriter, r *http.Request) {
+	folderName := mux.Vars(r)["folder"]
 	fd := t.fs.Folder(folderName)
 	if fd == nil {
-		err = fmt.Errorf("folder %q not found", folderName)
+		http.NotFound(w, r)
+		return
+	}
+	var owner string
+	if !t.isAdmin {
+		if err := t.hasAuthFolder(folderName, w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		owner = t.uploaderID(w, r)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
 	}
+	events, unsubscribe := t.fs.SubscribeProgress(folderName, owner)
+	defer unsubscribe()
 
-	if err == nil {
-		// var isValidPassword bool
-		// var isValidLogin bool
-		if !t.isAdmin && fd != nil {
-			if r.Method == http.MethodPost {
-				if r.Form.Get("action") == "login" {
-					err := t.authFolderWithPassword(folderName, r.Form.Get("Password"), w, r)
-					if err == nil {
-						// isValidPassword = true
-					}
-					t.logger.Error("folder %q auth with password failed: %v", folderName, err)
-				}
-				if r.Form.Get("action") == "userlogin" {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-					err := t.authFolderWithLogin(folderName, w, r)
-					if err != nil {
-						t.logger.Error("folder %q auth with password failed: %v", folderName, err)
-					} else {
-						// isValidPassword = true
-					}
-				}
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				t.logger.Error("failed to encode progress event: %v", err)
+				continue
 			}
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b)
+		}
+		flusher.Flush()
+	}
+}
 
-			err := t.hasAuthFolder(folderName, w, r)
+// dirURL returns the listing url of the directory dir.
+func (t *torDropApp) dirURL(folderName, dir string) (*url.URL, error) {
+	if dir = strings.TrimPrefix(cleanDir(dir), "/"); dir == "" {
+		return t.router.Get("folder-listing").URL("folder", folderName)
+	}
+	return t.router.Get("folder-dir").URL("folder", folderName, "path", dir)
+}
+
+// assetAuth serves the folder login page and returns false
+// when the request is not authorized to access the folder items.
+func (t *torDropApp) assetAuth(folderName string, fd *folder, w http.ResponseWriter, r *http.Request) bool {
+	if t.isAdmin || fd == nil {
+		return true
+	}
+	if r.Method == http.MethodPost {
+		if r.Form.Get("action") == "login" {
+			err := t.authFolderWithPassword(folderName, r.Form.Get("Password"), w, r)
 			if err != nil {
-				data := map[string]interface{}{
-					"IsAdmin": t.isAdmin,
-					"Request": r,
-					"Folder":  fd,
-					"Error":   err,
-					"Now":     time.Now(),
-				}
-				err = t.tpl.folderLogin.Execute(w, data)
-				if err != nil {
-					log.Printf("failed to serve folder-login handler: %v\n", err)
-				}
-				return
+				t.logger.Error("folder %q auth with password failed: %v", folderName, err)
 			}
 		}
+		if r.Form.Get("action") == "userlogin" {
+			err := t.authFolderWithLogin(folderName, w, r)
+			if err != nil {
+				t.logger.Error("folder %q auth with password failed: %v", folderName, err)
+			}
+		}
+	}
+
+	err := t.hasAuthFolder(folderName, w, r)
+	if err != nil {
+		data := map[string]interface{}{
+			"IsAdmin": t.isAdmin,
+			"Request": r,
+			"Folder":  fd,
+			"Error":   err,
+			"Now":     time.Now(),
+		}
+		err = t.tpl.folderLogin.Execute(w, data)
+		if err != nil {
+			log.Printf("failed to serve folder-login handler: %v\n", err)
+		}
+		return false
+	}
+	return true
+}
+
+func (t *torDropApp) AssetDl(w http.ResponseWriter, r *http.Request) {
+	var err error
+	vars := mux.Vars(r)
+	folderName := vars["folder"]
+	fileName := vars["name"]
+	fd := t.fs.Folder(folderName)
+	if fd == nil {
+		err = fmt.Errorf("folder %q not found", folderName)
+	}
+
+	if err == nil && !t.assetAuth(folderName, fd, w, r) {
+		return
 	}
 
 	if err == nil {
 		var src io.ReadCloser
-		src, err = t.fs.OpenItem(folderName, fileName)
-		if err == nil {
-			w.Header().Add("Content-Type", "application/octet-stream")
-			w.Header().Add("Content-Transfer-Encoding", "Binary")
-			w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
-			_, err = io.Copy(w, src)
+		var item fileItem
+		// only the administrators download the original contents of the sanitized items,
+		// and the older versions of the items. The downloads of the items with a download
+		// limit are counted, the item is removed once the download reaching it is done.
+		var opts openOptions
+		if t.isAdmin {
+			opts.Original = r.URL.Query().Get("original") != ""
+			opts.Version, _ = strconv.Atoi(r.URL.Query().Get("version"))
+		}
+		opts.Count = r.Method != http.MethodHead && !opts.Original && opts.Version == 0
+		item, src, err = t.fs.OpenContent(folderName, fileName, opts)
+		if err == nil && item.Quarantine != "" && !t.isAdmin {
+			err = fmt.Errorf("file %q is quarantined", fileName)
+		} else if err == nil && item.Message && !t.isAdmin {
+			err = fmt.Errorf("file %q not found", fileName)
+		}
+		if err != nil && src != nil {
 			src.Close()
+			if opts.Count && fd.DownloadLimit(item) > 0 {
+				t.fs.uncountDownload(folderName, item)
+			}
+		}
+		if err == nil {
+			content := &itemContent{
+				size: int64(item.ServedSize(opts.Original)),
+				src:  src,
+				open: func(offset int64) (io.ReadCloser, error) {
+					o := opts
+					o.Offset, o.Count = offset, false
+					x, src, err := t.fs.OpenContent(folderName, fileName, o)
+					if err == nil && !x.CreateDate.Equal(item.CreateDate) {
+						src.Close()
+						err = fmt.Errorf("file %q was modified", fileName)
+					}
+					return src, err
+				},
+			}
+			// the checksums of sealed items are those of the plaintext.
+			if d := digestHeader(item); d != "" && item.Sealed == "" && !opts.Original {
+				w.Header().Set("Digest", d)
+				w.Header().Set("Etag", fmt.Sprintf("%q", item.SHA256))
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Transfer-Encoding", "Binary")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", item.DownloadName()))
+			// the items with a download limit are served whole, the ranges
+			// would let them be downloaded again and again.
+			limited := opts.Count && fd.DownloadLimit(item) > 0
+			if limited {
+				r.Header.Del("Range")
+				r.Header.Del("If-Range")
+			}
+			cw := &countingWriter{ResponseWriter: w}
+			http.ServeContent(cw, r, "", item.CreateDate, content)
+			content.Close()
+			if !limited {
+				return
+			}
+			// only the complete downloads are counted, not the
+			// conditional requests and the aborted downloads.
+			if cw.status != http.StatusOK || cw.n != content.size {
+				t.fs.uncountDownload(folderName, item)
+			} else if fd.Exhausted(item) {
+				if err := t.fs.BurnItem(folderName, item); err != nil {
+					t.logger.Error("failed to remove %v/%v: %v", folderName, fileName, err)
+				}
+			}
+			return
 		}
 	}
 	if err != nil {
@@ -727,14 +1249,53 @@ func (t *torDropApp) AssetInfo(w http.ResponseWriter, r *http.Request) {
 	if fd == nil {
 		err = fmt.Errorf("folder %q not found", folderName)
 	}
+	if err == nil && fd.IsAdminOnlyReadable && !t.isAdmin {
+		err = fmt.Errorf("folder %q not found", folderName)
+	}
+	if err == nil && !t.assetAuth(folderName, fd, w, r) {
+		return
+	}
 	var fi fileItem
 	if err == nil {
 		fi, err = t.fs.Item(folderName, fileName)
 	}
+	var actionErr error
+	if err == nil && t.isAdmin && r.Method == http.MethodPost {
+		actionErr = r.ParseForm()
+		switch {
+		case actionErr != nil:
+		case r.Form.Get("action") == "restore":
+			version, _ := strconv.Atoi(r.Form.Get("Version"))
+			actionErr = t.fs.RestoreVersion(folderName, fileName, version)
+		case r.Form.Get("action") == "limit":
+			var max int
+			if v := strings.TrimSpace(r.Form.Get("MaxDownloads")); v != "" {
+				if max, actionErr = strconv.Atoi(v); actionErr != nil {
+					actionErr = fmt.Errorf("invalid download limit %q", v)
+				}
+			}
+			if actionErr == nil {
+				actionErr = t.fs.SetDownloadLimit(folderName, fileName, max)
+			}
+		}
+		if actionErr == nil {
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+			return
+		}
+	}
+	if err == nil && fi.Quarantine != "" && !t.isAdmin {
+		err = fmt.Errorf("file %q is quarantined", fileName)
+	} else if err == nil && (fi.Message || fd.Exhausted(fi)) && !t.isAdmin {
+		err = fmt.Errorf("file %q not found", fileName)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	data := map[string]interface{}{
 		"IsAdmin": t.isAdmin,
 		"Request": r,
-		"Error":   err,
+		"Error":   actionErr,
 		"Folder":  fd,
 		"File":    fi,
 		"Now":     time.Now(),
@@ -749,14 +1310,27 @@ func (t *torDropApp) Mount(r *mux.Router) *mux.Router {
 	t.router = r
 	r.HandleFunc("/", t.Index).Name("index")
 	r.HandleFunc("/list/{folder}", t.FolderListing).Name("folder-listing")
+	r.HandleFunc("/list/{folder}/{path:.+}", t.FolderListing).Name("folder-dir")
 	if t.isAdmin {
 		r.HandleFunc("/edit/{folder}", t.EditFolder).Name("folder-edit")
 		r.HandleFunc("/rm/{folder}", t.RmFolder).Name("folder-rm")
 		r.HandleFunc("/create", t.CreateFolder).Name("create-folder")
+		r.HandleFunc("/unlock", t.Unlock).Name("unlock")
+		r.HandleFunc("/transfers", t.Transfers).Name("transfers")
+		r.HandleFunc("/quarantine", t.Quarantine).Name("quarantine")
+		r.HandleFunc("/trash", t.Trash).Name("trash")
+		r.HandleFunc("/sources/{folder}", t.Sources).Name("sources")
+	} else {
+		r.HandleFunc("/source/{folder}", t.SourceLogin).Name("source")
 	}
-	r.HandleFunc("/dl/{folder}/{name}", t.AssetDl).Name("asset-dl")
+	r.HandleFunc("/dl/{folder}/{name:.+}", t.AssetDl).Name("asset-dl")
+	r.HandleFunc("/archive/{folder}", t.FolderArchive).Name("folder-archive")
+	r.HandleFunc("/tus/{folder}/", t.TusCreate).Name("tus-create")
+	r.HandleFunc("/tus/{folder}/{id}", t.TusUpload).Name("tus-upload")
+	r.HandleFunc("/progress/{folder}", t.Progress).Name("progress")
+	r.HandleFunc("/put/{folder}/{name:.+}", t.PutUpload).Methods(http.MethodPut).Name("put-upload")
 	r.Handle("/captcha/{id}.png", captcha.Server(150, 50)).Name("captcha")
-	// r.HandleFunc("/info/{folder}/{name}", t.AssetInfo).Name("asset-info")
+	r.HandleFunc("/info/{folder}/{name:.+}", t.AssetInfo).Name("asset-info")
 
 	if t.static {
 		r.PathPrefix(t.assetsDir).
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The formats of the folder archives.
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+// archiveWriter streams the items of a folder into an archive.
+type archiveWriter interface {
+	Add(name string, item fileItem, src io.Reader) error
+	Close() error
+}
+
+// newArchiveWriter returns an archive writer of the format and its content type.
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, string, error) {
+	switch format {
+	case "", archiveZip:
+		return zipArchive{zip.NewWriter(w)}, "application/zip", nil
+	case archiveTarGz:
+		gz := gzip.NewWriter(w)
+		return tarArchive{tw: tar.NewWriter(gz), gz: gz}, "application/gzip", nil
+	}
+	return nil, "", fmt.Errorf("invalid archive format %q, must be zip or tar.gz", format)
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) Add(name string, item fileItem, src io.Reader) error {
+	w, err := z.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: item.CreateDate,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t tarArchive) Add(name string, item fileItem, src io.Reader) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(item.ServedSize(false)),
+		ModTime:  item.CreateDate,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tw, src)
+	return err
+}
+
+func (t tarArchive) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// archiveItems returns the items of the directory dir and of its sub directories
+// to archive, only those of keys when some are selected.
+func archiveItems(fd *folder, items fileItems, dir string, keys []string, isAdmin bool) fileItems {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	selected := map[string]bool{}
+	for _, k := range keys {
+		selected[strings.TrimPrefix(cleanDir(k), "/")] = true
+	}
+	var res fileItems
+	for _, i := range items {
+		switch {
+		case i.Broken != "" || fd.Exhausted(i):
+		case (i.Quarantine != "" || i.Message) && !isAdmin:
+		case !strings.HasPrefix(cleanDir(i.Key()), prefix):
+		case len(selected) > 0 && !selected[i.Key()]:
+		default:
+			res = append(res, i)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key() < res[j].Key()
+	})
+	return res
+}
+
+// FolderArchive streams the completed items of a directory of a folder as a zip
+// or a tar.gz archive, or only the items selected with the name parameters.
+// The items are downloaded one after the other through the folder limits.
+func (t *torDropApp) FolderArchive(w http.ResponseWriter, r *http.Request) {
+	folderName := mux.Vars(r)["folder"]
+	fd := t.fs.Folder(folderName)
+	if fd == nil || (fd.IsAdminOnlyReadable && !t.isAdmin) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !t.assetAuth(folderName, fd, w, r) {
+		return
+	}
+	dir := cleanDir(r.Form.Get("path"))
+	aw, contentType, err := newArchiveWriter(w, r.Form.Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var items fileItems
+	items, err = t.fs.Items(folderName, false)
+	if err == nil {
+		items = archiveItems(fd, items, dir, r.Form["name"], t.isAdmin)
+		if len(items) == 0 {
+			err = fmt.Errorf("no files to download")
+		}
+	}
+	// the first item is opened before replying, to report the exceeded limits.
+	opts := openOptions{Count: r.Method != http.MethodHead}
+	var item fileItem
+	var src io.ReadCloser
+	if err == nil {
+		item, src, err = t.fs.OpenContent(folderName, items[0].Key(), opts)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	name := folderName
+	if dir != "/" {
+		name += "-" + path.Base(dir)
+	}
+	format := r.Form.Get("format")
+	if format == "" {
+		format = archiveZip
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	if r.Method == http.MethodHead {
+		src.Close()
+		return
+	}
+	// the counted downloads are given back when the archive is incomplete,
+	// the items reaching their limit are removed once it is complete.
+	var counted fileItems
+	defer func() {
+		for _, item := range counted {
+			switch {
+			case fd.DownloadLimit(item) == 0:
+			case err != nil:
+				t.fs.uncountDownload(folderName, item)
+			case fd.Exhausted(item):
+				if e := t.fs.BurnItem(folderName, item); e != nil {
+					t.logger.Error("failed to remove %v/%v: %v", folderName, item.Key(), e)
+				}
+			}
+		}
+	}()
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for i := range items {
+		if i > 0 {
+			item, src, err = t.fs.OpenContent(folderName, items[i].Key(), opts)
+		}
+		if err == nil {
+			counted = append(counted, item)
+			name := strings.TrimPrefix(cleanDir(path.Join(item.Path, item.DownloadName())), prefix)
+			err = aw.Add(name, item, src)
+			src.Close()
+		}
+		if err != nil {
+			// the archive is left unterminated, the client sees it is incomplete.
+			t.logger.Error("failed to archive %v/%v: %v", folderName, items[i].Key(), err)
+			return
+		}
+	}
+	if err = aw.Close(); err != nil {
+		t.logger.Error("failed to archive %v: %v", folderName, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import "fmt"
+
+// DownloadLimit returns the maximum count of downloads of the item, 0 means no limit.
+// The limit of the item supersedes the one of its folder.
+func (fd *folder) DownloadLimit(f fileItem) int {
+	switch {
+	case f.MaxDownloads > 0:
+		return f.MaxDownloads
+	case fd.BurnAfterRead:
+		return 1
+	case fd.MaxDownloads != nil && *fd.MaxDownloads > 0:
+		return *fd.MaxDownloads
+	}
+	return 0
+}
+
+// Exhausted reports whether the item reached its download limit,
+// it is hidden until removed.
+func (fd *folder) Exhausted(f fileItem) bool {
+	max := fd.DownloadLimit(f)
+	return max > 0 && f.Downloads >= max
+}
+
+// countDownload counts a new download of the item against its limit,
+// it runs within the ops routine so that the concurrent downloads cannot exceed it.
+func (t *torDropFileServer) countDownload(fd *folder, item *fileItem) error {
+	if fd.DownloadLimit(*item) == 0 {
+		return nil
+	}
+	if fd.Exhausted(*item) {
+		return fmt.Errorf("file %q not found", item.Key())
+	}
+	item.Downloads++
+	err := t.db.UpdateItem(fd.Name, *item)
+	if err == nil {
+		if err = t.store.PutItem(fd.Name, *item); err != nil {
+			item.Downloads--
+			t.db.UpdateItem(fd.Name, *item)
+		}
+	} else {
+		item.Downloads--
+	}
+	return err
+}
+
+// uncountDownload gives back the download counted for an item which could not be opened.
+func (t *torDropFileServer) uncountDownload(folderName string, item fileItem) {
+	t.ops <- func() {
+		cur, err := t.db.GetItem(folderName, item.Key())
+		if err != nil || !cur.CreateDate.Equal(item.CreateDate) || cur.Downloads == 0 {
+			return
+		}
+		cur.Downloads--
+		if err := t.store.PutItem(folderName, cur); err != nil {
+			t.logger.Error("failed to store the downloads of %v/%v: %v", folderName, item.Key(), err)
+			return
+		}
+		t.db.UpdateItem(folderName, cur)
+	}
+}
+
+// BurnItem removes the item once it reached its download limit,
+// it is called by the download which took its last slot once done.
+func (t *torDropFileServer) BurnItem(folderName string, item fileItem) error {
+	var burnt bool
+	ret := make(chan error)
+	t.ops <- func() {
+		fd := t.db.Folder(folderName)
+		cur, err := t.db.GetItem(folderName, item.Key())
+		if err != nil || fd == nil || !cur.CreateDate.Equal(item.CreateDate) || !fd.Exhausted(cur) {
+			ret <- nil
+			return
+		}
+		item = cur
+		err = t.db.RmItem(folderName, item.Key())
+		if err == nil {
+			err = t.store.DeleteItem(folderName, item.Key())
+		}
+		burnt = err == nil
+		ret <- err
+	}
+	if err := <-ret; err != nil || !burnt {
+		return err
+	}
+	t.logger.Info("removed %v/%v after %v downloads", folderName, item.Key(), item.Downloads)
+	return t.deleteObjects(folderName, item)
+}
+
+// SetDownloadLimit sets the maximum count of downloads of the item,
+// 0 applies the limit of its folder.
+func (t *torDropFileServer) SetDownloadLimit(folderName, key string, max int) error {
+	if max < 0 {
+		return fmt.Errorf("invalid download limit %v", max)
+	}
+	var item fileItem
+	var exhausted bool
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		item, err = t.db.GetItem(folderName, key)
+		if err != nil {
+			ret <- err
+			return
+		}
+		item.MaxDownloads = max
+		err = t.store.PutItem(folderName, item)
+		if err == nil {
+			err = t.db.UpdateItem(folderName, item)
+		}
+		if fd := t.db.Folder(folderName); fd != nil {
+			exhausted = fd.Exhausted(item)
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil || !exhausted {
+		return err
+	}
+	return t.BurnItem(folderName, item)
+}
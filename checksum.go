@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// checksums hashes the content written to it.
+type checksums struct {
+	sha256  hash.Hash
+	blake2b hash.Hash
+}
+
+func newChecksums(withBLAKE2b bool) *checksums {
+	c := &checksums{sha256: sha256.New()}
+	if withBLAKE2b {
+		c.blake2b, _ = blake2b.New256(nil)
+	}
+	return c
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	c.sha256.Write(p)
+	if c.blake2b != nil {
+		c.blake2b.Write(p)
+	}
+	return len(p), nil
+}
+
+// Sums returns the hex encoded checksums, BLAKE2b is empty when disabled.
+func (c *checksums) Sums() (sha256Sum, blake2bSum string) {
+	sha256Sum = hex.EncodeToString(c.sha256.Sum(nil))
+	if c.blake2b != nil {
+		blake2bSum = hex.EncodeToString(c.blake2b.Sum(nil))
+	}
+	return
+}
+
+// verifyChecksums compares the checksums expected by the uploader to those computed.
+func verifyChecksums(expected, computed fileItem) error {
+	if e := expected.SHA256; e != "" && !strings.EqualFold(e, computed.SHA256) {
+		return fmt.Errorf("sha256 checksum mismatch, expected %v, got %v", e, computed.SHA256)
+	}
+	if e := expected.BLAKE2b; e != "" && !strings.EqualFold(e, computed.BLAKE2b) {
+		return fmt.Errorf("blake2b checksum mismatch, expected %v, got %v", e, computed.BLAKE2b)
+	}
+	return nil
+}
+
+// digestHeader returns the value of the Digest header of item as defined by RFC 3230.
+func digestHeader(item fileItem) string {
+	b, err := hex.DecodeString(item.SHA256)
+	if err != nil || len(b) == 0 {
+		return ""
+	}
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(b)
+}
+
+// parseDigestHeader returns the hex encoded sha256 checksum of a Digest header.
+func parseDigestHeader(h string) (string, error) {
+	for _, d := range strings.Split(h, ",") {
+		parts := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "SHA-256") {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(b) != sha256.Size {
+			return "", fmt.Errorf("invalid SHA-256 digest %q", parts[1])
+		}
+		return hex.EncodeToString(b), nil
+	}
+	return "", fmt.Errorf("the Digest header has no SHA-256 digest")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// scanner checks the contents for malware.
+type scanner interface {
+	// Scan returns the verdict about the content read from r,
+	// infected tells whether it must be quarantined.
+	Scan(r io.Reader) (verdict string, infected bool, err error)
+}
+
+// clamdChunkSize is the size of the chunks streamed to clamd.
+const clamdChunkSize = 64 << 10
+
+// clamdScanner scans the contents with the INSTREAM command of a clamd daemon.
+type clamdScanner struct {
+	Network string
+	Address string
+	// Timeout bounds a whole scan.
+	Timeout time.Duration
+}
+
+// newClamdScanner returns the scanner of the clamd listening at addr,
+// either unix:/path, a socket path, tcp:host:port or host:port.
+func newClamdScanner(addr string) (*clamdScanner, error) {
+	c := &clamdScanner{Timeout: 10 * time.Minute}
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		c.Network, c.Address = "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "/"):
+		c.Network, c.Address = "unix", addr
+	case strings.HasPrefix(addr, "tcp:"):
+		c.Network, c.Address = "tcp", strings.TrimPrefix(addr, "tcp:")
+	default:
+		c.Network, c.Address = "tcp", addr
+	}
+	if c.Network == "tcp" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return nil, fmt.Errorf("invalid clamd address %q: %v", addr, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *clamdScanner) Scan(r io.Reader) (verdict string, infected bool, err error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, 10*time.Second)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err = io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", false, err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection once its stream limit is exceeded.
+				break
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return "", false, rerr
+		}
+	}
+	if err == nil {
+		_, err = conn.Write([]byte{0, 0, 0, 0})
+	}
+
+	reply, rerr := bufio.NewReader(conn).ReadString(0)
+	if rerr != nil && reply == "" {
+		if err != nil {
+			return "", false, err
+		}
+		return "", false, fmt.Errorf("failed to read the clamd reply: %v", rerr)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return reply, false, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), true, nil
+	}
+	return "", false, fmt.Errorf("clamd failed: %v", reply)
+}
+
+// scanUpload scans the content of a completed upload, the infected items
+// and those which could not be scanned are quarantined.
+// Sealed contents are not readable by the server and are not scanned.
+func (t *torDropFileServer) scanUpload(ev fileUpload, key []byte) fileItem {
+	item := ev.File
+	if item.Sealed != "" {
+		item.ScanVerdict = "not scanned, sealed"
+		return item
+	}
+	verdict, infected, err := t.scanFile(ev.TmpFile, item.Encrypted, key)
+	switch {
+	case err != nil:
+		t.logger.Error("failed to scan file %v/%v: %v", ev.Folder, item.Key(), err)
+		item.ScanVerdict = "error"
+		if item.Quarantine == "" {
+			item.Quarantine = fmt.Sprintf("the malware scan failed: %v", err)
+		}
+	case infected:
+		t.logger.Info("file %v/%v is infected: %v", ev.Folder, item.Key(), verdict)
+		item.ScanVerdict = verdict
+		item.Quarantine = fmt.Sprintf("infected: %v", verdict)
+	default:
+		item.ScanVerdict = verdict
+	}
+	return item
+}
+
+func (t *torDropFileServer) scanFile(fpath string, encrypted bool, key []byte) (string, bool, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if encrypted {
+		if key == nil {
+			return "", false, errCryptLocked
+		}
+		if r, err = newDecryptReader(f, key); err != nil {
+			return "", false, err
+		}
+	}
+	return t.conf.Scanner.Scan(r)
+}
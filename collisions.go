@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The policies applied when a new item takes the name of an existing one.
+const (
+	collisionReject    = "reject"
+	collisionRename    = "rename"
+	collisionOverwrite = "overwrite"
+	// collisionRandom names every new item with a random identifier.
+	collisionRandom = "random"
+)
+
+func validateCollisions(policy string) error {
+	switch policy {
+	case "", collisionReject, collisionRename, collisionOverwrite, collisionRandom:
+		return nil
+	}
+	return fmt.Errorf("invalid name collision policy %q, must be reject, rename, overwrite or random", policy)
+}
+
+// resolveName applies the collision policy of the folder to the name of a new item,
+// the versioned folders overwrite their items with a new version.
+// An overwritten item must not be being uploaded.
+func (t *torDropDB) resolveName(fd *folder, item fileItem) (fileItem, error) {
+	items, err := t.GetItems(fd.Name, true)
+	if err != nil {
+		return item, err
+	}
+	taken := func(item fileItem) bool {
+		return items.Has(item.Key()) || t.HasUpload(fd.Name, item.Key()) || t.HasDir(fd.Name, "/"+item.Key())
+	}
+	switch {
+	case fd.Collisions == collisionRandom:
+		item.OriginalName = item.Name
+		for item.Name = randomName(item.OriginalName); taken(item); {
+			item.Name = randomName(item.OriginalName)
+		}
+	case fd.Versioning || fd.Collisions == collisionOverwrite:
+		if t.HasUpload(fd.Name, item.Key()) {
+			return item, fmt.Errorf("file %q is being uploaded", item.Name)
+		}
+		if t.HasDir(fd.Name, "/"+item.Key()) {
+			return item, fmt.Errorf("%q is a directory", item.Name)
+		}
+	case fd.Collisions == collisionRename:
+		ext := path.Ext(item.Name)
+		base := strings.TrimSuffix(item.Name, ext)
+		for n := 1; taken(item); n++ {
+			item.Name = fmt.Sprintf("%v-%v%v", base, n, ext)
+		}
+	default:
+		if taken(item) {
+			return item, fmt.Errorf("file %q already exists or being uploaded", item.Name)
+		}
+	}
+	return item, nil
+}
+
+// Overwrites reports whether the new items of the folder replace the existing ones.
+func (t *torDropDB) Overwrites(folderName string) bool {
+	fd := t.Folder(folderName)
+	return fd != nil && (fd.Versioning || fd.Collisions == collisionOverwrite)
+}
+
+// randomName returns a random identifier with the extension of name.
+func randomName(name string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	ext := strings.ToLower(path.Ext(name))
+	if len(ext) > 10 {
+		ext = ""
+	}
+	return hex.EncodeToString(b) + ext
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The encrypted objects start with a header made of cryptMagic and a random salt,
+// the salt derives the payload key from the folder key.
+// The payload is split into chunks of cryptChunkSize bytes sealed
+// with ChaCha20-Poly1305, the nonce of a chunk is its counter
+// followed by a flag set on the last chunk, this prevents
+// reordering and truncation.
+const (
+	cryptMagic     = "tor-drop/v1\n"
+	cryptSaltSize  = 16
+	cryptChunkSize = 64 * 1024
+	cryptKeySize   = chacha20poly1305.KeySize
+)
+
+var errCryptLocked = errors.New("the encryption keys are locked, an administrator must unlock them")
+
+// encryptedSize returns the size of the encrypted form of n bytes.
+func encryptedSize(n uint64) uint64 {
+	chunks := (n + cryptChunkSize - 1) / cryptChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return uint64(len(cryptMagic)+cryptSaltSize) + n + chunks*chacha20poly1305.Overhead
+}
+
+func payloadAEAD(key, salt []byte) (cipher.AEAD, error) {
+	k := make([]byte, cryptKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("payload")), k); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(k)
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+// newEncryptWriter returns a writer encrypting to w with key,
+// it must be closed to write the last chunk.
+func newEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := payloadAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, cryptMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, cryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// a full chunk is written once more data is known to follow it.
+		if len(e.buf) == cryptChunkSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):cryptChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	out := e.aead.Seal(nil, chunkNonce(e.counter, last), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	in      []byte
+	out     []byte
+	counter uint64
+	done    bool
+}
+
+// newDecryptReader returns a reader decrypting r with key.
+func newDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, len(cryptMagic)+cryptSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read the encryption header: %v", err)
+	}
+	if !bytes.HasPrefix(header, []byte(cryptMagic)) {
+		return nil, fmt.Errorf("invalid encryption header")
+	}
+	aead, err := payloadAEAD(key, header[len(cryptMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:    bufio.NewReader(r),
+		aead: aead,
+		in:   make([]byte, cryptChunkSize+chacha20poly1305.Overhead),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.in)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.r.Peek(1); err == io.EOF {
+		d.done = true
+	}
+	out, err := d.aead.Open(d.in[:0], chunkNonce(d.counter, d.done), d.in[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %v, the content is corrupted or truncated", d.counter)
+	}
+	d.counter++
+	d.out = out
+	return nil
+}
+
+// cryptKEK holds the parameters of the key encrypting the folder keys,
+// it is derived from the administrator passphrase.
+type cryptKEK struct {
+	Salt []byte
+	// Check is an empty message wrapped with the key, it verifies the passphrase.
+	Check []byte
+}
+
+func deriveKEK(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, cryptKeySize)
+}
+
+// newKEK derives a new key from passphrase.
+func newKEK(passphrase string) (cryptKEK, []byte, error) {
+	var p cryptKEK
+	p.Salt = make([]byte, cryptSaltSize)
+	if _, err := rand.Read(p.Salt); err != nil {
+		return p, nil, err
+	}
+	kek, err := deriveKEK(passphrase, p.Salt)
+	if err != nil {
+		return p, nil, err
+	}
+	p.Check, err = wrapKey(kek, nil)
+	return p, kek, err
+}
+
+// wrapKey encrypts key with kek.
+func wrapKey(kek, key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	nonce := wrapped[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[aead.NonceSize():], nil)
+}
+
+// encryptBytes returns the encrypted form of content.
+func encryptBytes(content, key []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := newEncryptWriter(&b, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(content); err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	return b.Bytes(), err
+}
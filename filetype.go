@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen is the number of bytes read to detect the type of an upload.
+const sniffLen = 512
+
+// typePolicy restricts the types of the files accepted by a folder,
+// the lists hold MIME types such as image/png or image/*, and extensions such as .pdf.
+type typePolicy struct {
+	allow []string
+	deny  []string
+	// quarantine holds the files whose content does not match
+	// their extension instead of rejecting them.
+	quarantine bool
+}
+
+func newTypePolicy(fd *folder) (typePolicy, error) {
+	var p typePolicy
+	var err error
+	if p.allow, err = parseTypeList(fd.AllowTypes); err != nil {
+		return p, err
+	}
+	if p.deny, err = parseTypeList(fd.DenyTypes); err != nil {
+		return p, err
+	}
+	switch fd.TypeMismatch {
+	case "", "reject":
+	case "quarantine":
+		p.quarantine = true
+	default:
+		return p, fmt.Errorf("invalid type mismatch policy %q, must be reject or quarantine", fd.TypeMismatch)
+	}
+	return p, nil
+}
+
+// parseTypeList parses a list of MIME types and extensions separated by commas or spaces.
+func parseTypeList(s string) ([]string, error) {
+	var res []string
+	for _, t := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		if strings.HasPrefix(t, ".") {
+			if len(t) < 2 || strings.ContainsAny(t[1:], "./") {
+				return nil, fmt.Errorf("invalid extension %q", t)
+			}
+		} else if parts := strings.Split(t, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == "*" {
+			return nil, fmt.Errorf("invalid MIME type %q", t)
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+// sniffType returns the MIME type detected from the first bytes of a content.
+func sniffType(head []byte) string {
+	t, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return t
+}
+
+// readHead reads up to sniffLen bytes of r.
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// extType returns the MIME type registered for the extension of name.
+func extType(name string) string {
+	t, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(path.Ext(name))))
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+func matchTypes(list []string, ext string, mimeTypes ...string) bool {
+	for _, l := range list {
+		if l == ext {
+			return true
+		}
+		for _, t := range mimeTypes {
+			if t == "" {
+				continue
+			}
+			if l == t || (strings.HasSuffix(l, "/*") && strings.HasPrefix(t, strings.TrimSuffix(l, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compatibleTypes tells whether the detected type of a content can be
+// the type declared by its extension, the detection only knows a few formats.
+func compatibleTypes(detected, declared string) bool {
+	switch {
+	case declared == "" || detected == declared || detected == "application/octet-stream":
+		return true
+	case detected == "text/plain":
+		return strings.HasPrefix(declared, "text/") ||
+			strings.Contains(declared, "json") || strings.Contains(declared, "xml") ||
+			strings.Contains(declared, "javascript")
+	case detected == "text/xml":
+		return strings.Contains(declared, "xml")
+	case detected == "application/zip":
+		// office documents, epub and java archives are zip files.
+		return strings.Contains(declared, "openxmlformats") || strings.Contains(declared, "opendocument") ||
+			strings.Contains(declared, "epub") || strings.Contains(declared, "java-archive") ||
+			strings.Contains(declared, "zip")
+	}
+	return false
+}
+
+// check returns an error when the file name or its detected type are refused,
+// or the reason of its quarantine when its content does not match its extension.
+func (p typePolicy) check(name, detected string) (quarantine string, err error) {
+	ext := strings.ToLower(path.Ext(name))
+	declared := extType(name)
+	if matchTypes(p.deny, ext, detected, declared) {
+		return "", fmt.Errorf("the files of type %v are refused in this folder", detected)
+	}
+	compatible := compatibleTypes(detected, declared)
+	if len(p.allow) > 0 && !matchTypes(p.allow, "", detected) &&
+		!(compatible && matchTypes(p.allow, ext, declared)) {
+		return "", fmt.Errorf("the files of type %v are not accepted in this folder", detected)
+	}
+	if !compatible {
+		reason := fmt.Sprintf("the content of type %v does not match the extension %v", detected, ext)
+		if !p.quarantine {
+			return "", fmt.Errorf("%v", reason)
+		}
+		return reason, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fsckOptions tells how the inconsistencies found by Fsck are repaired,
+// empty values only report them.
+type fsckOptions struct {
+	// Orphans repairs the stored objects without item, adopt or delete.
+	Orphans string
+	// Broken repairs the items whose object is missing or has a wrong size, mark or delete.
+	// Either way the mark of the items found sound again is cleared.
+	Broken string
+	// TmpFiles deletes the temporary files left by interrupted uploads.
+	TmpFiles bool
+}
+
+func (o fsckOptions) validate() error {
+	switch o.Orphans {
+	case "", "adopt", "delete":
+	default:
+		return fmt.Errorf("invalid orphans repair %q, must be adopt or delete", o.Orphans)
+	}
+	switch o.Broken {
+	case "", "mark", "delete":
+	default:
+		return fmt.Errorf("invalid broken items repair %q, must be mark or delete", o.Broken)
+	}
+	return nil
+}
+
+type fsckItem struct {
+	Folder string
+	Item   fileItem
+	// Size is the size of the stored object.
+	Size int64
+}
+
+// fsckReport lists the inconsistencies between the database and the storage.
+type fsckReport struct {
+	Orphans      []storageObject
+	Missing      []fsckItem
+	SizeMismatch []fsckItem
+	TmpFiles     []string
+	// Repaired counts the entries successfully repaired.
+	Repaired int
+	Errors   []error
+}
+
+func (r fsckReport) Write(w io.Writer) {
+	for _, o := range r.Orphans {
+		fmt.Fprintf(w, "orphan object %v (%v bytes)\n", o.Key, o.Size)
+	}
+	for _, i := range r.Missing {
+		fmt.Fprintf(w, "missing object of item %v\n", storageKey(i.Folder, i.Item.Key()))
+	}
+	for _, i := range r.SizeMismatch {
+		fmt.Fprintf(w, "size mismatch of item %v, expected %v bytes, stored %v bytes\n",
+			storageKey(i.Folder, i.Item.Key()), i.Item.StoredSize(), i.Size)
+	}
+	for _, f := range r.TmpFiles {
+		fmt.Fprintf(w, "stale temporary file %v\n", f)
+	}
+	for _, err := range r.Errors {
+		fmt.Fprintf(w, "repair failed: %v\n", err)
+	}
+	fmt.Fprintf(w, "%v orphans, %v missing, %v size mismatches, %v temporary files, %v repaired\n",
+		len(r.Orphans), len(r.Missing), len(r.SizeMismatch), len(r.TmpFiles), r.Repaired)
+}
+
+// fsckTmpFileAge is the age after which an unknown temporary file is considered stale.
+var fsckTmpFileAge = time.Hour
+
+type fsckSnapshot struct {
+	items   map[string]fileItem
+	folders map[string]bool
+	tmp     map[string]bool
+	// originals are the keys of the original contents of the sanitized items.
+	originals map[string]bool
+	// versions are the keys of the older versions of the items.
+	versions map[string]bool
+	// trash are the keys of the trashed items, trashed the trashed folders.
+	trash   map[string]bool
+	trashed map[string]bool
+}
+
+// snapshot returns the items and the uploads of db indexed by storage key.
+func (t *torDropFileServer) snapshot() fsckSnapshot {
+	var s fsckSnapshot
+	done := make(chan bool)
+	t.ops <- func() {
+		s = fsckSnapshot{
+			items:     map[string]fileItem{},
+			folders:   map[string]bool{},
+			tmp:       map[string]bool{},
+			originals: map[string]bool{},
+			versions:  map[string]bool{},
+			trash:     map[string]bool{},
+			trashed:   map[string]bool{},
+		}
+		for _, fd := range t.db.Folders {
+			s.folders[fd.Name] = true
+		}
+		for folderName, items := range t.db.Items {
+			for _, i := range items {
+				s.items[storageKey(folderName, i.Key())] = i
+				if i.OriginalSize > 0 {
+					s.originals[originalKey(folderName, i.Key())] = true
+				}
+				for _, v := range i.Versions {
+					s.versions[itemVersionKey(folderName, i.Key(), v.Version)] = true
+				}
+			}
+		}
+		for folderName, entries := range t.db.Trash {
+			for _, e := range entries {
+				if e.Contents != nil {
+					s.trashed[folderName] = true
+					continue
+				}
+				for _, k := range trashKeys(folderName, e) {
+					s.trash[k[1]] = true
+				}
+			}
+		}
+		for _, up := range t.db.Uploads {
+			s.items[storageKey(up.Folder, up.File.Key())] = up.File
+			if up.TmpFile != "" {
+				s.tmp[filepath.Base(up.TmpFile)] = true
+			}
+		}
+		done <- true
+	}
+	<-done
+	return s
+}
+
+// Fsck reconciles the items of the database with the objects of the storage
+// and the temporary directory, then repairs them according to opts.
+func (t *torDropFileServer) Fsck(opts fsckOptions) (fsckReport, error) {
+	var report fsckReport
+	if err := opts.validate(); err != nil {
+		return report, err
+	}
+	// items added while listing would be reported missing,
+	// objects of items removed while listing would be reported orphans,
+	// so only those found in both snapshots are checked.
+	before := t.snapshot()
+	objects, err := t.storage.List("")
+	if err != nil {
+		return report, fmt.Errorf("failed to list the storage: %v", err)
+	}
+	after := t.snapshot()
+
+	stored := map[string]storageObject{}
+	for _, o := range objects {
+		stored[o.Key] = o
+		_, known := before.items[o.Key]
+		known = known || before.originals[o.Key] || after.originals[o.Key]
+		known = known || before.versions[o.Key] || after.versions[o.Key]
+		known = known || before.trash[o.Key] || after.trash[o.Key]
+		known = known || after.trashed[strings.SplitN(o.Key, "/", 2)[0]]
+		if _, ok := after.items[o.Key]; !ok && !known {
+			report.Orphans = append(report.Orphans, o)
+		}
+	}
+	for key, item := range before.items {
+		if x, ok := after.items[key]; !ok || !x.IsComplete() || !item.IsComplete() {
+			continue
+		}
+		folderName := strings.SplitN(key, "/", 2)[0]
+		o, ok := stored[key]
+		if !ok {
+			report.Missing = append(report.Missing, fsckItem{Folder: folderName, Item: item, Size: -1})
+		} else if uint64(o.Size) != item.StoredSize() {
+			report.SizeMismatch = append(report.SizeMismatch, fsckItem{Folder: folderName, Item: item, Size: o.Size})
+		} else if item.Broken != "" && opts.Broken != "" {
+			report.addRepair(t.markBroken(folderName, item.Key(), ""))
+		}
+	}
+
+	if t.conf.TmpDir != "" {
+		files, err := ioutil.ReadDir(t.conf.TmpDir)
+		if err != nil {
+			return report, fmt.Errorf("failed to list the temporary directory: %v", err)
+		}
+		for _, f := range files {
+			if f.IsDir() || !isUploadTmpFile(f.Name()) || after.tmp[f.Name()] ||
+				time.Since(f.ModTime()) < fsckTmpFileAge {
+				continue
+			}
+			report.TmpFiles = append(report.TmpFiles, filepath.Join(t.conf.TmpDir, f.Name()))
+		}
+	}
+
+	for _, o := range report.Orphans {
+		switch opts.Orphans {
+		case "adopt":
+			report.addRepair(t.adoptObject(o, after.folders))
+		case "delete":
+			report.addRepair(t.storage.Delete(o.Key))
+		}
+	}
+	for _, i := range append(report.Missing, report.SizeMismatch...) {
+		switch opts.Broken {
+		case "mark":
+			reason := "missing content"
+			if i.Size > -1 {
+				reason = fmt.Sprintf("stored size is %v bytes", i.Size)
+			}
+			report.addRepair(t.markBroken(i.Folder, i.Item.Key(), reason))
+		case "delete":
+			report.addRepair(t.RmItem(i.Folder, i.Item.Key()))
+		}
+	}
+	if opts.TmpFiles {
+		for _, f := range report.TmpFiles {
+			report.addRepair(os.Remove(f))
+		}
+	}
+	return report, nil
+}
+
+func (r *fsckReport) addRepair(err error) {
+	if err != nil && !os.IsNotExist(err) {
+		r.Errors = append(r.Errors, err)
+		return
+	}
+	r.Repaired++
+}
+
+// isUploadTmpFile reports whether name was created by ioutil.TempFile for an upload.
+func isUploadTmpFile(name string) bool {
+	if !strings.HasPrefix(name, "tor-drop") {
+		return false
+	}
+	suffix := strings.TrimPrefix(name, "tor-drop")
+	return suffix != "" && strings.Trim(suffix, "0123456789") == ""
+}
+
+// markBroken sets the reason why the item content is unusable, an empty reason clears it.
+func (t *torDropFileServer) markBroken(folderName, key, reason string) error {
+	ret := make(chan error)
+	t.ops <- func() {
+		item, err := t.db.GetItem(folderName, key)
+		if err != nil {
+			ret <- err
+			return
+		}
+		item.Broken = reason
+		err = t.store.PutItem(folderName, item)
+		if err == nil {
+			err = t.db.UpdateItem(folderName, item)
+		}
+		ret <- err
+	}
+	return <-ret
+}
+
+// adoptObject creates the item of an orphan object, its checksums are computed.
+// The orphans of the reserved directories are not adopted.
+// Encrypted objects are decrypted with the folder key.
+func (t *torDropFileServer) adoptObject(o storageObject, folders map[string]bool) error {
+	parts := strings.SplitN(o.Key, "/", 2)
+	if len(parts) < 2 || !folders[parts[0]] {
+		return fmt.Errorf("cannot adopt %v, folder not found", o.Key)
+	}
+	// the originals, the versions and the trash cannot become items.
+	if isReservedKey(parts[1]) {
+		return fmt.Errorf("cannot adopt %v, it is within a reserved directory, delete it", o.Key)
+	}
+	folderName := parts[0]
+	obj, err := t.storage.Open(o.Key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	br := bufio.NewReader(obj)
+	var src io.Reader = br
+	magic, _ := br.Peek(len(cryptMagic))
+	encrypted := string(magic) == cryptMagic
+	if encrypted {
+		var key []byte
+		ret := make(chan error)
+		t.ops <- func() {
+			var err error
+			key, err = t.folderKey(folderName)
+			ret <- err
+		}
+		if err := <-ret; err != nil {
+			return fmt.Errorf("cannot adopt %v: %v", o.Key, err)
+		}
+		if src, err = newDecryptReader(br, key); err != nil {
+			return err
+		}
+	}
+	sums := newChecksums(t.conf.BLAKE2b)
+	n, err := io.Copy(sums, src)
+	if err != nil {
+		return err
+	}
+	item := fileItem{
+		Name:       path.Base(parts[1]),
+		Path:       cleanDir(path.Dir(parts[1])),
+		CreateDate: o.ModTime,
+		Size:       uint64(n),
+		Uploaded:   uint64(n),
+		Encrypted:  encrypted,
+	}
+	item.SHA256, item.BLAKE2b = sums.Sums()
+
+	ret := make(chan error)
+	t.ops <- func() {
+		items, _ := t.db.GetItems(folderName, true)
+		if items.Has(item.Key()) {
+			ret <- fmt.Errorf("cannot adopt %v, item already exists", o.Key)
+			return
+		}
+		var dirs []string
+		for d := item.Path; !t.db.HasDir(folderName, d); d = path.Dir(d) {
+			dirs = append([]string{d}, dirs...)
+		}
+		for i, d := range dirs {
+			if err := t.db.AddDir(folderName, d); err != nil {
+				if i > 0 {
+					t.db.RmDir(folderName, dirs[0])
+				}
+				ret <- err
+				return
+			}
+		}
+		err := t.store.Batch(func(b storeTx) error {
+			for _, d := range dirs {
+				if err := b.PutDir(folderName, d); err != nil {
+					return err
+				}
+			}
+			return b.PutItem(folderName, item)
+		})
+		if err == nil {
+			err = t.db.AddItem(folderName, item)
+		} else if len(dirs) > 0 {
+			t.db.RmDir(folderName, dirs[0])
+		}
+		ret <- err
+	}
+	return <-ret
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// CryptState tells whether the administrator passphrase was set
+// and whether the folder keys are locked.
+func (t *torDropFileServer) CryptState() (initialized, locked bool, err error) {
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		_, initialized, err = t.store.KEK()
+		locked = t.kek == nil
+		ret <- err
+	}
+	return initialized, locked, <-ret
+}
+
+// Unlock decrypts the folder keys with the administrator passphrase,
+// the first passphrase ever given becomes the administrator passphrase.
+func (t *torDropFileServer) Unlock(passphrase string) error {
+	if passphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+	var p cryptKEK
+	var ok bool
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		p, ok, err = t.store.KEK()
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	if !ok {
+		return t.setPassphrase(passphrase, false)
+	}
+
+	// the key derivation is slow, it must not block the file server.
+	kek, err := deriveKEK(passphrase, p.Salt)
+	if err != nil {
+		return err
+	}
+	if _, err := unwrapKey(kek, p.Check); err != nil {
+		return fmt.Errorf("invalid passphrase")
+	}
+	t.ops <- func() {
+		wrapped, err := t.store.Keys()
+		if err != nil {
+			ret <- err
+			return
+		}
+		keys := map[string][]byte{}
+		for folderName, w := range wrapped {
+			key, err := unwrapKey(kek, w)
+			if err != nil {
+				ret <- fmt.Errorf("failed to unwrap the key of folder %q: %v", folderName, err)
+				return
+			}
+			keys[folderName] = key
+		}
+		t.kek = kek
+		t.keys = keys
+		ret <- nil
+	}
+	return <-ret
+}
+
+// ChangePassphrase wraps the folder keys with a new passphrase,
+// the keys must be unlocked.
+func (t *torDropFileServer) ChangePassphrase(passphrase string) error {
+	if passphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+	return t.setPassphrase(passphrase, true)
+}
+
+func (t *torDropFileServer) setPassphrase(passphrase string, change bool) error {
+	p, kek, err := newKEK(passphrase)
+	if err != nil {
+		return err
+	}
+	ret := make(chan error)
+	t.ops <- func() {
+		_, ok, err := t.store.KEK()
+		if err != nil {
+			ret <- err
+			return
+		}
+		if ok && (!change || t.kek == nil) {
+			ret <- errCryptLocked
+			return
+		}
+		wrapped := map[string][]byte{}
+		for folderName, key := range t.keys {
+			if wrapped[folderName], err = wrapKey(kek, key); err != nil {
+				ret <- err
+				return
+			}
+		}
+		if err = t.store.PutKEK(p, wrapped); err != nil {
+			ret <- err
+			return
+		}
+		t.kek = kek
+		if t.keys == nil {
+			t.keys = map[string][]byte{}
+		}
+		ret <- nil
+	}
+	return <-ret
+}
+
+// folderKey returns the key of an encrypted folder.
+func (t *torDropFileServer) folderKey(folderName string) ([]byte, error) {
+	key, ok := t.keys[folderName]
+	if !ok {
+		return nil, errCryptLocked
+	}
+	return key, nil
+}
+
+// ensureFolderKey creates the key of a folder being encrypted.
+func (t *torDropFileServer) ensureFolderKey(folderName string) error {
+	if t.db.Folder(folderName) == nil {
+		return fmt.Errorf("folder %q does not exist", folderName)
+	}
+	if _, ok := t.keys[folderName]; ok {
+		return nil
+	}
+	wrapped, err := t.store.Keys()
+	if err != nil {
+		return err
+	}
+	if _, ok := wrapped[folderName]; ok {
+		// the folder is already encrypted while the keys are locked.
+		return nil
+	}
+	if t.kek == nil {
+		return errCryptLocked
+	}
+	key := make([]byte, cryptKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	w, err := wrapKey(t.kek, key)
+	if err != nil {
+		return err
+	}
+	if err := t.store.PutKey(folderName, w); err != nil {
+		return err
+	}
+	t.keys[folderName] = key
+	return nil
+}
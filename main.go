@@ -26,12 +26,26 @@ import (
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/securecookie"
+	"golang.org/x/term"
 )
 
 type torDropConfig struct {
 	TmpDir           string
 	MaxActiveUploads int
 	StorageDir       string
+	// Storage defaults to a local storage within StorageDir.
+	Storage storage
+	// BLAKE2b enables the BLAKE2b-256 checksum of the uploads, in addition to SHA-256.
+	BLAKE2b bool
+	// Scanner checks the completed uploads for malware, it is optional.
+	Scanner scanner
+	// ProcessorsDir holds the executables the folders can run on their uploads,
+	// the processors are disabled when empty.
+	ProcessorsDir    string
+	ProcessorTimeout time.Duration
+	// TrashRetention is how long the deleted items and folders are kept
+	// in the trash before being purged, they are deleted at once when zero.
+	TrashRetention time.Duration
 }
 
 type logWriter struct {
@@ -60,6 +74,19 @@ func main() {
 	var assetsDir string
 	var storageDir string
 	var qps float64
+	var migrateDryRun bool
+	var storageBackend string
+	var s3 s3Storage
+	var tmpDir string
+	var scrubInterval time.Duration
+	var repair fsckOptions
+	var passphraseFile string
+	var clamd string
+	// fsck checks the database and the storage then exits.
+	fsck := len(os.Args) > 1 && os.Args[1] == "fsck"
+	if fsck {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	if build == "dev" {
 		secCookie = "static"
 		secCsrf = "static"
@@ -71,9 +98,27 @@ func main() {
 	flag.StringVar(&secCookie, "cookie", secCookie, "secure cookie hashing secret")
 	flag.StringVar(&secCsrf, "csrf", secCsrf, "secure csrf hashing secret")
 	flag.StringVar(&storageDir, "storage", "data", "path to the storage directory")
+	flag.StringVar(&tmpDir, "tmp", "", "path to the temporary directory of the uploads, defaults to a new directory")
+	flag.StringVar(&storageBackend, "storage-backend", "local", "storage backend of the files, local or s3")
+	flag.StringVar(&s3.Endpoint, "s3-endpoint", "", "s3 service url, such as https://s3.amazonaws.com")
+	flag.StringVar(&s3.Bucket, "s3-bucket", "tor-drop", "s3 bucket name")
+	flag.StringVar(&s3.Region, "s3-region", "us-east-1", "s3 bucket region")
+	flag.StringVar(&s3.AccessKey, "s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "s3 access key, defaults to $AWS_ACCESS_KEY_ID")
+	flag.StringVar(&s3.SecretKey, "s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "s3 secret key, defaults to $AWS_SECRET_ACCESS_KEY")
 	flag.StringVar(&assetsDir, "assets", "/assets/", "assets directory")
 	flag.Float64Var(&qps, "qps", 30, "maximum http query per second")
 	flag.BoolVar(&static, "static", true, "use embedded static assets")
+	flag.BoolVar(&conf.BLAKE2b, "blake2b", false, "compute the blake2b checksum of the uploads")
+	flag.BoolVar(&migrateDryRun, "migrate-dry-run", false, "print the pending database migrations and exit")
+	flag.StringVar(&passphraseFile, "passphrase-file", "", "file of the passphrase unlocking the encryption keys, - prompts for it")
+	flag.DurationVar(&scrubInterval, "scrub-interval", time.Hour, "interval between two consistency checks of the storage, 0 to disable")
+	flag.StringVar(&repair.Orphans, "repair-orphans", "", "repair of the stored files without item, adopt or delete")
+	flag.StringVar(&repair.Broken, "repair-broken", "", "repair of the items with a missing or truncated file, mark or delete")
+	flag.BoolVar(&repair.TmpFiles, "repair-tmp", false, "delete the temporary files of interrupted uploads")
+	flag.StringVar(&clamd, "clamd", "", "address of the clamd daemon scanning the uploads, unix:/path or tcp:host:port")
+	flag.StringVar(&conf.ProcessorsDir, "processors-dir", "", "directory of the executables processing the uploads, empty disables them")
+	flag.DurationVar(&conf.ProcessorTimeout, "processor-timeout", defaultProcessorTimeout, "maximum duration of a processor run")
+	flag.DurationVar(&conf.TrashRetention, "trash-retention", defaultTrashRetention, "duration the deleted items and folders are kept in the trash, 0 deletes them at once")
 	flag.Parse()
 
 	if storageDir == "" {
@@ -86,8 +131,54 @@ func main() {
 		secCsrf = string(securecookie.GenerateRandomKey(32))
 	}
 	conf.StorageDir = storageDir
+	if tmpDir != "" {
+		if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+			log.Fatal(err)
+		}
+		conf.TmpDir = tmpDir
+	}
+	switch storageBackend {
+	case "local":
+	case "s3":
+		if s3.Endpoint == "" {
+			log.Fatal("s3 endpoint must not be empty")
+		}
+		conf.Storage = &s3
+	default:
+		log.Fatalf("unknown storage backend %q", storageBackend)
+	}
+
+	if clamd != "" {
+		s, err := newClamdScanner(clamd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf.Scanner = s
+	}
 
 	fs := newFileServer(conf)
+	fs.ScrubInterval = scrubInterval
+	fs.ScrubOptions = repair
+	if migrateDryRun {
+		if err := fs.MigrateDryRun(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var passphrase string
+	if passphraseFile != "" {
+		var err error
+		if passphrase, err = readPassphrase(passphraseFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fsck {
+		fs.ScrubInterval = 0
+		if !runFsck(fs, repair, passphrase) {
+			os.Exit(1)
+		}
+		return
+	}
 	admin, public, err := getApps(secCookie, fs, assetsDir, static, "")
 	if err != nil {
 		log.Fatal(err)
@@ -101,6 +192,12 @@ func main() {
 		}
 	}()
 
+	if passphrase != "" {
+		if err := fs.Unlock(passphrase); err != nil {
+			log.Fatalf("failed to unlock the encryption keys: %v", err)
+		}
+	}
+
 	lmt := tollbooth.NewLimiter(qps, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Second})
 	lmt.SetIPLookups([]string{"RemoteAddr", "X-Forwarded-For", "X-Real-IP"})
 
@@ -110,6 +207,9 @@ func main() {
 		h := tollbooth.LimitHandler(lmt, public)
 		h = handlers.LoggingHandler(os.Stdout, h)
 		h = csrf.Protect([]byte(secCsrf))(h)
+		h = csrfExempt(h)
+		h = csrfHeaderAuth(fs, h)
+		h = csrfQueryToken(h)
 		server = &http.Server{
 			Addr:    ":9090",
 			Handler: h,
@@ -117,6 +217,8 @@ func main() {
 		var hh http.Handler = admin
 		hh = handlers.LoggingHandler(os.Stdout, hh)
 		hh = csrf.Protect([]byte(secCsrf))(hh)
+		hh = csrfExempt(hh)
+		hh = csrfQueryToken(hh)
 		adminServer = &http.Server{
 			Addr:    ":9091",
 			Handler: hh,
@@ -127,6 +229,9 @@ func main() {
 		h := tollbooth.LimitHandler(lmt, public)
 		h = handlers.LoggingHandler(os.Stdout, h)
 		h = csrf.Protect([]byte(secCsrf))(h)
+		h = csrfExempt(h)
+		h = csrfHeaderAuth(fs, h)
+		h = csrfQueryToken(h)
 		server = &torServer{
 			PrivateKey:   pkpath,
 			Handler:      h,
@@ -136,6 +241,8 @@ func main() {
 		var hh http.Handler = admin
 		hh = handlers.LoggingHandler(os.Stdout, hh)
 		hh = csrf.Protect([]byte(secCsrf))(hh)
+		hh = csrfExempt(hh)
+		hh = csrfQueryToken(hh)
 		adminServer = &http.Server{
 			Addr:         ":9091",
 			Handler:      hh,
@@ -255,3 +362,58 @@ func (ts *torServer) ListenAndServe() error {
 	}
 	return srv.Serve(onion)
 }
+
+// readPassphrase reads the first line of fpath, - prompts for it on the terminal.
+func readPassphrase(fpath string) (string, error) {
+	if fpath == "-" {
+		fmt.Fprint(os.Stderr, "passphrase: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(strings.SplitN(string(b), "\n", 2)[0], "\r"), nil
+}
+
+// runFsck checks the database and the storage, it returns
+// false when inconsistencies remain. The passphrase unlocks
+// the encryption keys to adopt encrypted files.
+func runFsck(fs *torDropFileServer, opts fsckOptions, passphrase string) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		errC <- fs.Listen(ctx)
+	}()
+	type result struct {
+		report fsckReport
+		err    error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		if passphrase != "" {
+			if err := fs.Unlock(passphrase); err != nil {
+				resC <- result{err: err}
+				return
+			}
+		}
+		report, err := fs.Fsck(opts)
+		resC <- result{report, err}
+	}()
+	select {
+	case err := <-errC:
+		log.Fatalf("file server ended: %v", err)
+	case res := <-resC:
+		if res.err != nil {
+			log.Fatal(res.err)
+		}
+		res.report.Write(os.Stdout)
+		r := res.report
+		found := len(r.Orphans) + len(r.Missing) + len(r.SizeMismatch) + len(r.TmpFiles)
+		return r.Repaired >= found && len(r.Errors) == 0
+	}
+	return false
+}
@@ -1,22 +1,45 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/andrewstuart/limio"
 
 	"github.com/gavv/httpexpect"
+	"github.com/gorilla/csrf"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestBasics(t *testing.T) {
@@ -452,7 +475,7 @@ func TestMaxTotalSize(t *testing.T) {
 		Status(http.StatusOK).
 		Body().
 		Contains("Welcome to the administrator zone").
-		Contains("<b style=\"color:red\">file is too large, demands 50 B, only 20 B available</b>")
+		Contains("<b style=\"color:red\">file is too large, only 20 B available</b>")
 
 	eAdmin.POST("/list/test").
 		WithMultipart().WithFormField("action", "upload").
@@ -482,7 +505,7 @@ func TestMaxTotalSize(t *testing.T) {
 		Body().
 		Contains("Welcome to the administrator zone").
 		NotContains("<td><a href=\"/dl/test/file4.txt\" target=\"_blank\">file4.txt</a></td>").
-		Contains("<b style=\"color:red\">file is too large, demands 10 B, only 0 B available</b>")
+		Contains("<b style=\"color:red\">file is too large, only 0 B available</b>")
 
 	ePublic.POST("/list/test").
 		WithMultipart().WithFormField("action", "upload").
@@ -492,7 +515,7 @@ func TestMaxTotalSize(t *testing.T) {
 		Body().
 		Contains("Welcome to the public zone").
 		NotContains("<td><a href=\"/dl/test/file4.txt\" target=\"_blank\">file4.txt</a></td>").
-		Contains("<b style=\"color:red\">file is too large, demands 10 B, only 0 B available</b>")
+		Contains("<b style=\"color:red\">file is too large, only 0 B available</b>")
 
 }
 
@@ -1620,3 +1643,3412 @@ func TestCaptchaLoggedUser(t *testing.T) {
 		Contains("<td><a href=\"/dl/withcaptcha/testpublic.txt\" target=\"_blank\">testpublic.txt</a></td>")
 
 }
+
+func TestStoreImport(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	dataFile := filepath.Join(conf.TmpDir, "db.json")
+	legacy := `{"Folders":[{"Name":"legacy","CreateDate":"2020-04-25T00:31:42Z"}],
+"Items":{"legacy":[{"Name":"old.txt","Path":"/","CreateDate":"2020-04-25T00:31:42Z","Size":3,"Uploaded":3}]}}`
+	if err := ioutil.WriteFile(dataFile, []byte(legacy), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(conf.StorageDir, "legacy"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(conf.StorageDir, "legacy", "old.txt"), []byte("old"), os.ModePerm)
+
+	start := func() (*httpexpect.Expect, func()) {
+		fs := newFileServer(conf)
+		fs.DataFile = dataFile
+		admin, _, err := getApps(secCookie, fs, "", false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- fs.Listen(ctx)
+		}()
+		serverAdmin := httptest.NewServer(admin)
+		return httpexpect.New(t, serverAdmin.URL), func() {
+			serverAdmin.Close()
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("file server ended: %v", err)
+			}
+		}
+	}
+
+	eAdmin, stop := start()
+
+	eAdmin.GET("/list/legacy").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td><a href=\"/dl/legacy/old.txt\" target=\"_blank\">old.txt</a></td>")
+	eAdmin.GET("/dl/legacy/old.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal("old")
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("Edit folder test")
+	eAdmin.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "new.txt", []byte("new")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td><a href=\"/dl/test/new.txt\" target=\"_blank\">new.txt</a></td>")
+	stop()
+
+	if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+		t.Fatalf("legacy database was not moved away: %v", err)
+	}
+	if _, err := os.Stat(dataFile + ".imported"); err != nil {
+		t.Fatal(err)
+	}
+
+	eAdmin, stop = start()
+	defer stop()
+
+	eAdmin.GET("/").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td><a href=\"/list/legacy\">legacy</a></td>").
+		Contains("<td><a href=\"/list/test\">test</a></td>")
+	eAdmin.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td><a href=\"/dl/test/new.txt\" target=\"_blank\">new.txt</a></td>")
+}
+
+func TestMigrations(t *testing.T) {
+
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	legacy := `{"Folders":[{"Name":"legacy","CreateDate":"2020-04-25T00:31:42Z"}],
+"Items":{"legacy":[{"Name":"old.txt","CreateDate":"2020-04-25T00:31:42Z","Size":3,"Uploaded":3}]}}`
+	if err := ioutil.WriteFile(fs.DataFile, []byte(legacy), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := fs.MigrateDryRun(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{
+		"import 1 folders from the legacy database",
+		"migration 1: default item path to /",
+		`item legacy/old.txt: {`,
+		`"Path":"/"`,
+	} {
+		if !strings.Contains(out.String(), k) {
+			t.Fatalf("dry run output does not contain %q\n%v", k, out.String())
+		}
+	}
+	if _, err := os.Stat(fs.DataFile); err != nil {
+		t.Fatalf("dry run must not import the legacy database: %v", err)
+	}
+	if _, err := os.Stat(fs.storeFile()); !os.IsNotExist(err) {
+		t.Fatalf("dry run must not create the database, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	item, err := fs.Item("legacy", "old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Path != "/" {
+		t.Fatalf("item path was not migrated, got %q", item.Path)
+	}
+	if _, err := os.Stat(fs.storeFile() + ".v0.bak"); err != nil {
+		t.Fatalf("database was not backed up: %v", err)
+	}
+
+	out.Reset()
+	fs2 := newFileServer(conf)
+	fs2.StoreFile = filepath.Join(conf.TmpDir, "other.db")
+	if err := fs2.MigrateDryRun(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "is up to date") {
+		t.Fatalf("unexpected dry run output %v", out.String())
+	}
+	if _, err := os.Stat(fs2.StoreFile); !os.IsNotExist(err) {
+		t.Fatalf("dry run must not create the database, got %v", err)
+	}
+
+	// the dry run of an existing database reads a copy of it.
+	out.Reset()
+	before, _ := ioutil.ReadFile(fs.storeFile())
+	cancel()
+	<-time.After(100 * time.Millisecond)
+	if err := fs.MigrateDryRun(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "is up to date") {
+		t.Fatalf("unexpected dry run output %v", out.String())
+	}
+	if after, _ := ioutil.ReadFile(fs.storeFile()); !bytes.Equal(before, after) {
+		t.Fatal("dry run must not write the database")
+	}
+}
+
+// fakeS3 is a minimal s3 compatible service storing the objects in memory.
+type fakeS3 struct {
+	sync.Mutex
+	bucket    string
+	accessKey string
+	secretKey string
+	objects   map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	sig, _ := s3Signature(r, f.secretKey, "us-east-1", r.Header.Get("X-Amz-Date"))
+	auth := r.Header.Get("Authorization")
+	if !strings.Contains(auth, "Credential="+f.accessKey+"/") || !strings.HasSuffix(auth, "Signature="+sig) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>invalid signature</Message></Error>")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/") && r.URL.Path != "/"+f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) && k > r.URL.Query().Get("continuation-token") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var res s3ListResult
+		// list two keys per page to exercise the pagination
+		if len(keys) > 2 {
+			keys = keys[:2]
+			res.IsTruncated = true
+			res.NextContinuationToken = keys[1]
+		}
+		for _, k := range keys {
+			res.Contents = append(res.Contents, struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}{Key: k, Size: int64(len(f.objects[k]))})
+		}
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		if int64(len(b)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = b
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Write(b)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) keys() []string {
+	f.Lock()
+	defer f.Unlock()
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestLocalStorageList(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	s := localStorage{Dir: dir}
+	for _, k := range []string{"a/x.txt", "a/d/y.txt", "ab/z.txt", "b/w.txt"} {
+		if err := s.Put(k, strings.NewReader(k), int64(len(k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for prefix, want := range map[string]int{"": 4, "a/": 2, "a": 3, "a/d/": 1, "c/": 0, "a/x": 1} {
+		objects, err := s.List(prefix)
+		if err != nil || len(objects) != want {
+			t.Fatalf("listing %q: expected %v objects, got %v %v", prefix, want, objects, err)
+		}
+	}
+}
+
+func TestUnwritableTmpDir(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	fs.conf.TmpDir = filepath.Join(conf.TmpDir, "missing")
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", []byte("content")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the upload could not be stored, try again later")
+	if _, err := fs.Item("test", "a.txt"); err == nil {
+		t.Fatal("the upload must be rejected")
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+
+	s3 := &fakeS3{
+		bucket:    "drops",
+		accessKey: "access",
+		secretKey: "secret",
+		objects:   map[string][]byte{},
+	}
+	serverS3 := httptest.NewServer(s3)
+	defer serverS3.Close()
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+	conf.Storage = &s3Storage{
+		Endpoint:  serverS3.URL,
+		Bucket:    "drops",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("Edit folder test")
+
+	for _, n := range []string{"a.txt", "b c.txt", "c@d.txt"} {
+		ePublic.POST("/list/test").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", n, []byte("content of "+n)).
+			Expect().
+			Status(http.StatusOK).
+			Body().
+			Contains(">" + n + "</a></td>")
+	}
+	if k := strings.Join(s3.keys(), ","); k != "test/a.txt,test/b c.txt,test/c@d.txt" {
+		t.Fatalf("unexpected objects %v", k)
+	}
+	if files, _ := ioutil.ReadDir(conf.StorageDir); len(files) > 0 {
+		t.Fatalf("local storage must not be used, found %v files", len(files))
+	}
+
+	ePublic.GET("/dl/test/b c.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal("content of b c.txt")
+
+	eAdmin.POST("/list/test").
+		WithFormField("action", "rma").
+		WithFormField("Name", "a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">a.txt</a></td>")
+	if k := strings.Join(s3.keys(), ","); k != "test/b c.txt,test/c@d.txt" {
+		t.Fatalf("unexpected objects %v", k)
+	}
+
+	s3.Lock()
+	s3.objects["test/e.txt"] = []byte("e")
+	s3.objects["testing/f.txt"] = []byte("f")
+	s3.Unlock()
+
+	eAdmin.POST("/rm/test").WithFormField("Name", "test").
+		Expect().
+		Status(http.StatusOK)
+	if k := strings.Join(s3.keys(), ","); k != "testing/f.txt" {
+		t.Fatalf("unexpected objects %v", k)
+	}
+
+	bad := &s3Storage{Endpoint: serverS3.URL, Bucket: "drops", AccessKey: "access", SecretKey: "wrong"}
+	if _, err := bad.Open("testing/f.txt"); err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("invalid signature must be rejected, got %v", err)
+	}
+	if _, err := conf.Storage.Stat("testing/nop.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
+
+func TestSubdirectories(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	ePublic.GET("/list/test/docs").
+		Expect().
+		Status(http.StatusNotFound)
+
+	eAdmin.POST("/list/test").
+		WithFormField("action", "mkdir").
+		WithFormField("Name", "docs").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">docs/</a></td>")
+	eAdmin.POST("/list/test/docs").
+		WithFormField("action", "mkdir").
+		WithFormField("Name", "2020").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">2020/</a></td>")
+	eAdmin.POST("/list/test").
+		WithFormField("action", "mkdir").
+		WithFormField("Name", "docs").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("already exists")
+
+	ePublic.POST("/list/test/docs/2020").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", []byte("nested")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a></td>")
+	ePublic.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">a.txt</a></td>")
+	ePublic.GET("/dl/test/docs/2020/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal("nested")
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, "test", "docs", "2020", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	ePublic.POST("/list/test/docs").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "2020\\a.txt", []byte("nested")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("invalid file name &#34;2020\\\\a.txt&#34;")
+
+	eAdmin.POST("/list/test").
+		WithFormField("action", "mvdir").
+		WithFormField("Name", "docs").
+		WithFormField("NewName", "papers").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">papers/</a></td>")
+	ePublic.GET("/dl/test/papers/2020/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal("nested")
+	ePublic.GET("/list/test/docs").
+		Expect().
+		Status(http.StatusNotFound)
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, "test", "docs")); !os.IsNotExist(err) {
+		t.Fatalf("previous directory must be removed, got %v", err)
+	}
+
+	eAdmin.POST("/list/test").
+		WithFormField("action", "rmdir").
+		WithFormField("Name", "papers").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("This folder is currently empty!")
+	ePublic.GET("/dl/test/papers/2020/a.txt").
+		Expect().
+		Status(http.StatusNotFound)
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, "test", "papers")); !os.IsNotExist(err) {
+		t.Fatalf("directory must be removed from the storage, got %v", err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+	conf.BLAKE2b = true
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	content := []byte("hello world")
+	sha := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	blake := "256c83b297114d201b30179f3f0ef0cace9783622da5974326b436178aeef610"
+
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFormField("SHA256", strings.Repeat("0", 64)).
+		WithFileBytes("files", "bad.txt", content).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("sha256 checksum mismatch").
+		NotContains(">bad.txt</a></td>")
+	if files, _ := ioutil.ReadDir(conf.TmpDir); len(files) > 1 {
+		t.Fatalf("rejected upload must be removed, found %v files", len(files))
+	}
+
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFormField("SHA256", strings.ToUpper(sha)).
+		WithFileBytes("files", "a.txt", content).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a></td>").
+		Contains(sha[:12])
+
+	ePublic.GET("/info/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(sha).
+		Contains(blake)
+
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Header("Digest").Equal("SHA-256=uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=")
+}
+
+func TestFsck(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	for _, n := range []string{"a.txt", "b.txt", "c.txt"} {
+		ePublic.POST("/list/test").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", n, []byte("content of "+n)).
+			Expect().
+			Status(http.StatusOK)
+	}
+
+	storageDir := filepath.Join(conf.StorageDir, "test")
+	os.Remove(filepath.Join(storageDir, "b.txt"))
+	ioutil.WriteFile(filepath.Join(storageDir, "c.txt"), []byte("trunc"), os.ModePerm)
+	os.MkdirAll(filepath.Join(storageDir, "sub"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(storageDir, "sub", "orphan.txt"), []byte("orphan"), os.ModePerm)
+	os.MkdirAll(filepath.Join(storageDir, originalsDir), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(storageDir, originalsDir, "a.txt"), []byte("old"), os.ModePerm)
+	os.MkdirAll(filepath.Join(conf.StorageDir, "unknown"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(conf.StorageDir, "unknown", "x.txt"), []byte("x"), os.ModePerm)
+	stale := filepath.Join(conf.TmpDir, "tor-drop123")
+	ioutil.WriteFile(stale, []byte("stale"), os.ModePerm)
+	old := time.Now().Add(-2 * fsckTmpFileAge)
+	os.Chtimes(stale, old, old)
+	ioutil.WriteFile(filepath.Join(conf.TmpDir, "tor-drop456"), []byte("recent"), os.ModePerm)
+
+	report, err := fs.Fsck(fsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	report.Write(&b)
+	want := "3 orphans, 1 missing, 1 size mismatches, 1 temporary files, 0 repaired"
+	if !strings.Contains(b.String(), want) {
+		t.Fatalf("unexpected report %q", b.String())
+	}
+
+	report, err = fs.Fsck(fsckOptions{Orphans: "adopt", Broken: "mark", TmpFiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 4 || len(report.Errors) != 2 || !strings.Contains(fmt.Sprint(report.Errors), "reserved directory") {
+		t.Fatalf("unexpected repairs %v, errors %v", report.Repaired, report.Errors)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temporary file must be removed, got %v", err)
+	}
+
+	ePublic.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("broken: missing content").
+		Contains("broken: stored size is 5 bytes").
+		Contains(">sub/</a></td>")
+	ePublic.GET("/dl/test/sub/orphan.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal("orphan")
+	ePublic.GET("/dl/test/b.txt").
+		Expect().
+		Status(http.StatusNotFound).
+		Body().Contains("is broken")
+
+	ioutil.WriteFile(filepath.Join(storageDir, "c.txt"), []byte("content of c.txt"), os.ModePerm)
+	report, err = fs.Fsck(fsckOptions{Orphans: "delete", Broken: "delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 2 || len(report.Missing) != 1 || len(report.SizeMismatch) != 0 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, "unknown", "x.txt")); !os.IsNotExist(err) {
+		t.Fatalf("orphan must be deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, originalsDir, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("orphan original must be deleted, got %v", err)
+	}
+	ePublic.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">b.txt</a>")
+	ePublic.GET("/dl/test/c.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal("content of c.txt")
+}
+
+func TestEncryption(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	start := func() (*httpexpect.Expect, func()) {
+		fs := newFileServer(conf)
+		fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+		admin, _, err := getApps(secCookie, fs, "", false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- fs.Listen(ctx)
+		}()
+		serverAdmin := httptest.NewServer(admin)
+		return httpexpect.New(t, serverAdmin.URL), func() {
+			serverAdmin.Close()
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("file server ended: %v", err)
+			}
+		}
+	}
+
+	eAdmin, stop := start()
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.Encrypted = true
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("encryption keys are locked")
+
+	eAdmin.POST("/unlock").
+		WithFormField("Passphrase", "secret").
+		WithFormField("Confirm", "secret").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the encryption keys are unlocked")
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("Edit folder test")
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), cryptChunkSize/8+10)
+	eAdmin.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", content).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a>")
+
+	stored, err := ioutil.ReadFile(filepath.Join(conf.StorageDir, "test", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, content[:64]) {
+		t.Fatal("the content must be encrypted at rest")
+	}
+	if uint64(len(stored)) != encryptedSize(uint64(len(content))) {
+		t.Fatalf("unexpected encrypted size %v", len(stored))
+	}
+	eAdmin.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal(string(content))
+	stop()
+
+	eAdmin, stop = start()
+	defer stop()
+
+	eAdmin.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusNotFound).
+		Body().Contains("encryption keys are locked")
+	eAdmin.POST("/unlock").
+		WithFormField("Passphrase", "wrong").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("invalid passphrase")
+	eAdmin.POST("/unlock").
+		WithFormField("Passphrase", "secret").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the encryption keys are unlocked")
+	eAdmin.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().Equal(string(content))
+
+	eAdmin.POST("/unlock").
+		WithFormField("Passphrase", "other").
+		WithFormField("Confirm", "other").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the passphrase was changed")
+
+	key := make([]byte, cryptKeySize)
+	for _, n := range []int{0, 10, cryptChunkSize, 2 * cryptChunkSize} {
+		plain := bytes.Repeat([]byte("x"), n)
+		enc, err := encryptBytes(plain, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := newDecryptReader(bytes.NewReader(enc), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("failed to decrypt %v bytes: %v", n, err)
+		}
+		if n < cryptChunkSize {
+			continue
+		}
+		// the stream must not be truncated at a chunk boundary.
+		truncated := enc[:len(enc)-cryptChunkSize-chacha20poly1305.Overhead]
+		r, _ = newDecryptReader(bytes.NewReader(truncated), key)
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatalf("truncated content of %v bytes must fail to decrypt", n)
+		}
+	}
+}
+
+func TestSealedUploads(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, _, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity, err := openpgp.NewEntity("drop", "", "drop@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pgpKey bytes.Buffer
+	w, _ := armor.Encode(&pgpKey, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	w.Close()
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.Recipients = "not a key"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("invalid age recipients")
+
+	fd.Folder.Recipients = identity.Recipient().String()
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("Edit folder test")
+
+	content := []byte("whistle")
+	eAdmin.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", content).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt.age</a>")
+
+	stored, _ := ioutil.ReadFile(filepath.Join(conf.StorageDir, "test", "a.txt"))
+	if bytes.Contains(stored, content) {
+		t.Fatal("the content must be sealed")
+	}
+	res := eAdmin.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK)
+	res.Header("Content-Disposition").Contains(`filename="a.txt.age"`)
+	res.Header("Digest").Empty()
+	r, err := age.Decrypt(strings.NewReader(res.Body().Raw()), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(r); !bytes.Equal(got, content) {
+		t.Fatalf("unexpected content %q", got)
+	}
+
+	fd.Folder.Recipients = pgpKey.String()
+	eAdmin.POST("/edit/test").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	eAdmin.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "b.txt", content).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">b.txt.gpg</a>")
+	res = eAdmin.GET("/dl/test/b.txt").
+		Expect().
+		Status(http.StatusOK)
+	res.Header("Content-Disposition").Contains(`filename="b.txt.gpg"`)
+	md, err := openpgp.ReadMessage(strings.NewReader(res.Body().Raw()), openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(md.UnverifiedBody); !bytes.Equal(got, content) {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestResumableUploads(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	type folderInput struct {
+		Name        string
+		MaxFileSize string
+	}
+	type folderCreateInput struct {
+		Folder folderInput
+	}
+	var fd folderCreateInput
+	fd.Folder.Name = "test"
+	fd.Folder.MaxFileSize = "250 b"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	ePublic.OPTIONS("/tus/test/").
+		Expect().
+		Status(http.StatusNoContent).
+		Header("Tus-Max-Size").Equal("250")
+
+	ePublic.POST("/tus/test/").
+		WithHeader("Upload-Length", "10").
+		Expect().
+		Status(http.StatusPreconditionFailed)
+
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+	ePublic.POST("/tus/test/").
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Upload-Length", "1000").
+		WithHeader("Upload-Metadata", meta).
+		Expect().
+		Status(http.StatusBadRequest).
+		Body().
+		Contains("the file too large, must not exceed 250 B")
+
+	loc := ePublic.POST("/tus/test/").
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Upload-Length", "10").
+		WithHeader("Upload-Metadata", meta).
+		Expect().
+		Status(http.StatusCreated).
+		Header("Location").Raw()
+
+	ePublic.PATCH(loc).
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Content-Type", "application/offset+octet-stream").
+		WithHeader("Upload-Offset", "0").
+		WithBytes([]byte("hello")).
+		Expect().
+		Status(http.StatusNoContent).
+		Header("Upload-Offset").Equal("5")
+
+	ePublic.HEAD(loc).
+		WithHeader("Tus-Resumable", "1.0.0").
+		Expect().
+		Status(http.StatusOK).
+		Header("Upload-Offset").Equal("5")
+
+	ePublic.PATCH(loc).
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Content-Type", "application/offset+octet-stream").
+		WithHeader("Upload-Offset", "2").
+		WithBytes([]byte("world")).
+		Expect().
+		Status(http.StatusConflict)
+
+	ePublic.PATCH(loc).
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Content-Type", "application/offset+octet-stream").
+		WithHeader("Upload-Offset", "5").
+		WithBytes([]byte("world")).
+		Expect().
+		Status(http.StatusNoContent).
+		Header("Upload-Offset").Equal("10")
+
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("helloworld")
+
+	loc = ePublic.POST("/tus/test/").
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Upload-Length", "10").
+		WithHeader("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("b.txt"))).
+		Expect().
+		Status(http.StatusCreated).
+		Header("Location").Raw()
+
+	ePublic.DELETE(loc).
+		WithHeader("Tus-Resumable", "1.0.0").
+		Expect().
+		Status(http.StatusNoContent)
+
+	ePublic.HEAD(loc).
+		WithHeader("Tus-Resumable", "1.0.0").
+		Expect().
+		Status(http.StatusNotFound)
+
+	eAdmin.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a>").
+		NotContains(">b.txt</a>")
+}
+
+func TestStreamedUploads(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, _, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+
+	type folderInput struct {
+		Name        string
+		MaxFileSize string
+	}
+	type folderCreateInput struct {
+		Folder folderInput
+	}
+	var fd folderCreateInput
+	fd.Folder.Name = "test"
+	fd.Folder.MaxFileSize = "250 b"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	eAdmin.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", bytes.Repeat([]byte("a"), 42)).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a>")
+
+	items, err := fs.Items("test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Size != 42 {
+		t.Fatalf("unexpected items %#v", items)
+	}
+
+	// the upload is aborted once the limit is exceeded, without reading the whole body.
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		mw.WriteField("action", "upload")
+		w, _ := mw.CreateFormFile("files", "endless.txt")
+		for {
+			if _, err := w.Write(bytes.Repeat([]byte("endless"), 100)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	req, _ := http.NewRequest(http.MethodPost, serverAdmin.URL+"/list/test", pr)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	pr.CloseWithError(io.EOF)
+	if !strings.Contains(string(body), "the file too large, must not exceed 250 B") {
+		t.Fatalf("unexpected response %s", body)
+	}
+	if _, err := fs.Item("test", "endless.txt"); err == nil {
+		t.Fatal("the file must not be stored")
+	}
+}
+
+func TestPutUpload(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	pwd := "secret"
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.Password = &pwd
+	fd.Folder.Token = "tok"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	content := []byte("hello")
+	ePublic.PUT("/put/test/a.txt").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusUnauthorized).
+		JSON().Object().Value("error").Equal("invalid password")
+
+	ePublic.PUT("/put/test/a.txt").
+		WithBasicAuth("", "nope").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	res := ePublic.PUT("/put/test/a.txt").
+		WithBasicAuth("", pwd).
+		WithBytes(content).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	res.Value("name").Equal("a.txt")
+	res.Value("size").Equal(len(content))
+	res.Value("sha256").Equal("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+
+	ePublic.PUT("/put/test/a.txt").
+		WithBasicAuth("", pwd).
+		WithBytes(content).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().Value("error").Equal(`file "a.txt" already exists or being uploaded`)
+
+	ePublic.PUT("/put/test/b.txt").
+		WithHeader("Authorization", "Bearer nope").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	ePublic.PUT("/put/test/b.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithHeader("Digest", "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().Value("name").Equal("b.txt")
+
+	ePublic.PUT("/put/test/c.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithHeader("Digest", "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=").
+		WithBytes([]byte("other")).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	ePublic.PUT("/put/test/missing/d.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	eAdmin.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a>").
+		Contains(">b.txt</a>").
+		NotContains(">c.txt</a>")
+
+	// only the valid credentials skip the csrf check, on the public interface only.
+	serverCsrf := httptest.NewServer(csrfHeaderAuth(fs, csrf.Protect([]byte("csrf-secret-csrf-secret-csrf-sec"), csrf.Secure(false))(public)))
+	defer serverCsrf.Close()
+	eCsrf := httpexpect.New(t, serverCsrf.URL)
+	eCsrf.PUT("/put/test/e.txt").
+		WithHeader("Authorization", "Bearer junk").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusForbidden)
+	eCsrf.PUT("/put/test/e.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusCreated)
+	serverAdminCsrf := httptest.NewServer(csrf.Protect([]byte("csrf-secret-csrf-secret-csrf-sec"), csrf.Secure(false))(admin))
+	defer serverAdminCsrf.Close()
+	httpexpect.New(t, serverAdminCsrf.URL).PUT("/put/test/f.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithBytes(content).
+		Expect().
+		Status(http.StatusForbidden)
+}
+
+func TestUploadProgress(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	others, unsubscribe := fs.SubscribeProgress("test", "someone else")
+	defer unsubscribe()
+	all, unsubscribeAll := fs.SubscribeProgress("test", "")
+	defer unsubscribeAll()
+
+	res, err := http.Get(serverPublic.URL + "/progress/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	cookies := res.Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("the uploader cookie is missing")
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, serverPublic.URL+"/put/test/a.txt", strings.NewReader("hello"))
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	up, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.Body.Close()
+	if up.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %v", up.StatusCode)
+	}
+
+	var ev progressEvent
+	lines := bufio.NewScanner(res.Body)
+	for lines.Scan() {
+		if d := strings.TrimPrefix(lines.Text(), "data: "); d != lines.Text() {
+			if err := json.Unmarshal([]byte(d), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.State != progressUploading {
+				break
+			}
+		}
+	}
+	if ev.Name != "a.txt" || ev.State != progressStored || ev.Uploaded != 5 {
+		t.Fatalf("unexpected event %#v", ev)
+	}
+
+	select {
+	case ev := <-all:
+		if ev.Name != "a.txt" {
+			t.Fatalf("unexpected event %#v", ev)
+		}
+	default:
+		t.Fatal("the admin subscriber must receive all the events")
+	}
+	select {
+	case ev := <-others:
+		t.Fatalf("unexpected event %#v", ev)
+	default:
+	}
+}
+
+func TestTransfers(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	eAdmin.GET("/transfers").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("No transfer in flight.")
+
+	eAdmin.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", []byte("hello")).
+		Expect().
+		Status(http.StatusOK)
+
+	_, src, err := fs.OpenItem("test", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := ePublic.POST("/tus/test/").
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Upload-Length", "10").
+		WithHeader("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("b.txt"))).
+		Expect().
+		Status(http.StatusCreated).
+		Header("Location").Raw()
+
+	transfers := fs.Transfers()
+	if len(transfers) != 2 || transfers[0].Kind != transferDownload || transfers[1].Kind != transferUpload {
+		t.Fatalf("unexpected transfers %#v", transfers)
+	}
+	eAdmin.GET("/transfers").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td>b.txt</td>").
+		Contains("<td>a.txt</td>")
+
+	eAdmin.POST("/transfers").
+		WithFormField("action", "cancel").
+		WithFormField("ID", fmt.Sprint(transfers[0].ID)).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the transfer was cancelled")
+	if _, err := ioutil.ReadAll(src); err != errTransferCancelled {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	src.Close()
+
+	eAdmin.POST("/transfers").
+		WithFormField("action", "cancel-folder").
+		WithFormField("Folder", "test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("1 transfers were cancelled")
+
+	ePublic.PATCH(loc).
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Content-Type", "application/offset+octet-stream").
+		WithHeader("Upload-Offset", "0").
+		WithBytes([]byte("hello")).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	for i := 0; i < 10 && len(fs.Transfers()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if transfers := fs.Transfers(); len(transfers) != 0 {
+		t.Fatalf("unexpected transfers %#v", transfers)
+	}
+}
+
+func TestFileTypes(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.AllowTypes = "image/*"
+	fd.Folder.DenyTypes = "nope"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("invalid MIME type &#34;nope&#34;")
+
+	fd.Folder.AllowTypes = "image/*, .txt"
+	fd.Folder.DenyTypes = "image/gif"
+	fd.Folder.TypeMismatch = "quarantine"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("Edit folder test")
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 32)...)
+	upload := func(name string, content []byte) *httpexpect.String {
+		return ePublic.POST("/list/test").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, content).
+			Expect().
+			Status(http.StatusOK).
+			Body()
+	}
+	upload("a.png", png).
+		Contains(">a.png</a>").
+		Contains("<td>image/png</td>")
+	upload("b.txt", []byte("hello")).
+		Contains(">b.txt</a>")
+	upload("c.pdf", []byte("%PDF-1.4\n")).
+		Contains("the files of type application/pdf are not accepted in this folder")
+	upload("d.gif", []byte("GIF89a")).
+		Contains("the files of type image/gif are refused in this folder")
+	upload("e.txt", png).
+		NotContains(">e.txt</a>")
+
+	eAdmin.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">e.txt</a> <b style=\"color:red\">quarantined: the content of type image/png does not match the extension .txt</b>")
+	ePublic.GET("/dl/test/e.txt").
+		Expect().
+		Status(http.StatusNotFound)
+
+	eAdmin.POST("/list/test").
+		WithFormField("action", "rma").
+		WithFormField("Release", "e.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains("quarantined:")
+	ePublic.GET("/dl/test/e.txt").
+		Expect().
+		Status(http.StatusOK)
+
+	fd.Folder.TypeMismatch = "reject"
+	eAdmin.POST("/edit/test").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	upload("f.txt", png).
+		Contains("the content of type image/png does not match the extension .txt")
+}
+
+// fakeClamd answers the INSTREAM commands like clamd,
+// the contents holding EICAR are infected.
+func fakeClamd(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			cmd := make([]byte, len("zINSTREAM\x00"))
+			if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+				t.Errorf("unexpected command %q: %v", cmd, err)
+				return
+			}
+			var content []byte
+			for {
+				var size uint32
+				if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+					t.Errorf("failed to read chunk size: %v", err)
+					return
+				}
+				if size == 0 {
+					break
+				}
+				chunk := make([]byte, size)
+				if _, err := io.ReadFull(conn, chunk); err != nil {
+					t.Errorf("failed to read chunk: %v", err)
+					return
+				}
+				content = append(content, chunk...)
+			}
+			if bytes.Contains(content, []byte("EICAR")) {
+				io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				return
+			}
+			io.WriteString(conn, "stream: OK\x00")
+		}()
+	}
+}
+
+func TestMalwareScan(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "")
+	l, err := net.Listen("unix", filepath.Join(dir, "clamd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeClamd(t, l)
+
+	s, err := newClamdScanner("unix:" + filepath.Join(dir, "clamd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+	conf.Scanner = s
+	conf.ProcessorsDir, _ = ioutil.TempDir("", "")
+	err = ioutil.WriteFile(filepath.Join(conf.ProcessorsDir, "infect"), []byte("#!/bin/sh\necho EICAR > \"$TOR_DROP_OUTPUT\"\nexit 2\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "clean.txt", bytes.Repeat([]byte("clean"), 20000)).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">clean.txt</a>")
+
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "eicar.txt", []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">eicar.txt</a>")
+
+	ePublic.GET("/info/test/clean.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td>OK</td>")
+	ePublic.GET("/dl/test/eicar.txt").
+		Expect().
+		Status(http.StatusNotFound)
+
+	eAdmin.GET("/quarantine").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">eicar.txt</a>").
+		Contains("infected: Eicar-Test-Signature").
+		NotContains(">clean.txt</a>")
+
+	// the contents replaced by the processors are scanned too.
+	fd.Folder.Name = "processed"
+	fd.Folder.Processors = "infect"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	ePublic.POST("/list/processed").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "harmless.txt", []byte("hello")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">harmless.txt</a>")
+	eAdmin.GET("/quarantine").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">harmless.txt</a>")
+
+	l.Close()
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "unscanned.txt", []byte("hello")).
+		Expect().
+		Status(http.StatusOK)
+	eAdmin.GET("/quarantine").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">unscanned.txt</a>").
+		Contains("the malware scan failed")
+}
+
+func TestSanitize(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.Sanitize = true
+	fd.Folder.KeepOriginal = true
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	var img bytes.Buffer
+	jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	exif := append([]byte("Exif\x00\x00"), "secret author"...)
+	app1 := []byte{0xff, 0xe1, 0, byte(len(exif) + 2)}
+	jpg := append(append(append([]byte{}, img.Bytes()[:2]...), app1...), exif...)
+	jpg = append(jpg, img.Bytes()[2:]...)
+	jpg = append(jpg, "trailing secret"...)
+
+	text := []byte("Author\x00secret author")
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(append(chunk, text...), 0, 0, 0, 0)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), []byte{0, 0, 0, 0, 'I', 'E', 'N', 'D', 0xae, 0x42, 0x60, 0x82}...)
+	png = append(append(append([]byte{}, png[:8]...), chunk...), png[8:]...)
+
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"EXIF\x0d\x00\x00\x00secret author\x00")
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(webp)-8))
+
+	pdf := []byte("%PDF-1.4\n1 0 obj\n<< /Author (secret \\) author) /Producer <736563726574> /Title (secret (title))" +
+		" /CreationDate (D:20200101secret) /Company (secret) /Trapped /False >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Metadata /Length 52 >>\nstream\n<rdf:RDF><dc:creator>secret author</dc:creator></rdf:RDF>\nendstream\nendobj\n" +
+		"3 0 obj\n<< /Title (kept) /Metadata 2 0 R >>\nendobj\n" +
+		"trailer\n<< /Root 3 0 R /Info 1 0 R >>\n%%EOF\n")
+	// the compressed metadata cannot be stripped, the documents are quarantined.
+	compressed := map[string]string{
+		"b.pdf": "%PDF-1.5\n1 0 obj\n<< /Type /Metadata /Subtype /XML /Filter /FlateDecode /Length 3 >>\nstream\nxyz\nendstream\nendobj\n%%EOF\n",
+		"c.pdf": "%PDF-1.5\n1 0 obj\n<< /Type /ObjStm /N 1 /Filter /FlateDecode /Length 3 >>\nstream\nxyz\nendstream\nendobj\n" +
+			"trailer\n<< /Info 5 0 R >>\n%%EOF\n",
+	}
+
+	for name, content := range map[string][]byte{"a.jpg": jpg, "a.png": png, "a.webp": webp, "a.pdf": pdf, "a.txt": []byte("secret author")} {
+		ePublic.POST("/list/test").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, content).
+			Expect().
+			Status(http.StatusOK).
+			Body().
+			Contains(">" + name + "</a>")
+	}
+
+	got := ePublic.GET("/dl/test/a.jpg").Expect().Status(http.StatusOK).Body().NotContains("secret").Raw()
+	if _, err := jpeg.Decode(strings.NewReader(got)); err != nil {
+		t.Fatalf("the stripped jpeg is not valid: %v", err)
+	}
+	ePublic.GET("/dl/test/a.png").Expect().Status(http.StatusOK).Body().
+		Equal(string(append([]byte("\x89PNG\r\n\x1a\n"), []byte{0, 0, 0, 0, 'I', 'E', 'N', 'D', 0xae, 0x42, 0x60, 0x82}...)))
+	got = ePublic.GET("/dl/test/a.webp").Expect().Status(http.StatusOK).Body().NotContains("secret").Raw()
+	if len(got) != 30 || got[20] != 0 || binary.LittleEndian.Uint32([]byte(got[4:])) != 22 {
+		t.Fatalf("unexpected stripped webp %q", got)
+	}
+	got = ePublic.GET("/dl/test/a.pdf").Expect().Status(http.StatusOK).Body().
+		NotContains("secret").Contains("/Author (" + strings.Repeat(" ", 16) + ")").Contains("/Producer <000000000000>").
+		Contains("/Trapped /False").Contains("(kept)").Raw()
+	if len(got) != len(pdf) {
+		t.Fatalf("the stripped pdf size changed from %v to %v bytes", len(pdf), len(got))
+	}
+	ePublic.GET("/dl/test/a.txt").Expect().Status(http.StatusOK).Body().Equal("secret author")
+	for name, reason := range map[string]string{"b.pdf": "the XMP metadata is compressed", "c.pdf": "the document information is compressed"} {
+		ePublic.POST("/list/test").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, []byte(compressed[name])).
+			Expect().
+			Status(http.StatusOK)
+		ePublic.GET("/info/test/" + name).Expect().Status(http.StatusNotFound).Body().Contains("quarantined")
+		eAdmin.GET("/info/test/" + name).Expect().Status(http.StatusOK).Body().
+			Contains("the metadata stripping failed: " + reason).
+			NotContains("<td>pdf</td>")
+	}
+
+	ePublic.GET("/info/test/a.pdf").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td>pdf</td>").
+		NotContains("download the original")
+	ePublic.GET("/dl/test/a.pdf").WithQuery("original", "1").
+		Expect().Status(http.StatusOK).Body().NotContains("secret")
+
+	eAdmin.GET("/info/test/a.pdf").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("download the original")
+	eAdmin.GET("/dl/test/a.pdf").WithQuery("original", "1").
+		Expect().Status(http.StatusOK).Body().Equal(string(pdf))
+	eAdmin.GET("/dl/test/a.txt").WithQuery("original", "1").
+		Expect().Status(http.StatusNotFound)
+
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", ".originals", []byte("hello")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("file name &#34;.originals&#34; is reserved")
+
+	report, err := fs.Fsck(fsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) > 0 {
+		t.Fatalf("the originals are reported orphans: %v", report.Orphans)
+	}
+	if err := fs.RmItem("test", "a.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, "test", originalsDir, "a.pdf")); !os.IsNotExist(err) {
+		t.Fatalf("the original was not removed: %v", err)
+	}
+}
+
+func TestProcessors(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+	conf.ProcessorsDir, _ = ioutil.TempDir("", "")
+	conf.ProcessorTimeout = 500 * time.Millisecond
+
+	processors := map[string]string{
+		"accept":  "exit 0",
+		"reject":  "grep -q spicy \"$1\" && echo 'too spicy' >&2 && exit 1\nexit 0",
+		"replace": "tr a-z A-Z < \"$1\" > \"$TOR_DROP_OUTPUT\"\necho \" $TOR_DROP_FOLDER $TOR_DROP_NAME $TOR_DROP_MIME\" >> \"$TOR_DROP_OUTPUT\"\nexit 2",
+		"slow":    "sleep 5",
+		"broken":  "exit 7",
+	}
+	for name, script := range processors {
+		err := ioutil.WriteFile(filepath.Join(conf.ProcessorsDir, name), []byte("#!/bin/sh\n"+script+"\n"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.Processors = "accept, ../accept"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("invalid processor name &#34;../accept&#34;")
+	fd.Folder.Processors = "accept, missing"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("processor &#34;missing&#34; is not an executable")
+
+	fd.Folder.Processors = "accept reject replace"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("Edit folder test")
+
+	upload := func(name, content string) *httpexpect.String {
+		return ePublic.POST("/list/test").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, []byte(content)).
+			Expect().
+			Status(http.StatusOK).
+			Body()
+	}
+
+	upload("a.txt", "hello").Contains(">a.txt</a>")
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("HELLO test a.txt text/plain\n")
+	ePublic.GET("/info/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td>accept, reject, replace</td>").
+		Contains(fmt.Sprintf("%x", sha256.Sum256([]byte("HELLO test a.txt text/plain\n"))))
+
+	upload("b.txt", "a spicy content").
+		Contains("processor &#34;reject&#34; rejected the file: too spicy").
+		NotContains(">b.txt</a>")
+
+	fd.Folder.Processors = "broken"
+	eAdmin.POST("/edit/test").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	upload("c.txt", "hello").
+		Contains("processor &#34;broken&#34; failed with exit code 7")
+
+	fd.Folder.Processors = "slow"
+	eAdmin.POST("/edit/test").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	upload("d.txt", "hello").
+		Contains("processor &#34;slow&#34; timed out after 500ms")
+
+	files, _ := ioutil.ReadDir(conf.TmpDir)
+	for _, f := range files {
+		if isUploadTmpFile(f.Name()) {
+			t.Fatalf("temporary file %v was left", f.Name())
+		}
+	}
+}
+
+func TestCodenames(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "plain"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/source/plain").
+		Expect().
+		Status(http.StatusNotFound)
+
+	fd.Folder.Name = "test"
+	fd.Folder.Codenames = true
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	upload := func(e *httpexpect.Expect, name string) string {
+		return e.POST("/list/test").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, []byte("hello")).
+			Expect().
+			Status(http.StatusOK).
+			Body().
+			Contains(">" + name + "</a>").
+			Raw()
+	}
+
+	body := upload(ePublic, "a.txt")
+	m := regexp.MustCompile(`Your codename is <b><code>([a-z ]+)</code></b>`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("the codename is not shown:\n%v", body)
+	}
+	codename := m[1]
+	if n := len(strings.Fields(codename)); n != codenameWords {
+		t.Fatalf("the codename has %v words, wanted %v", n, codenameWords)
+	}
+	ePublic.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains("Your codename is")
+	if body := upload(ePublic, "b.txt"); strings.Contains(body, "Your codename is") {
+		t.Fatal("a second codename was created")
+	}
+
+	sources := fs.Sources("test")
+	if len(sources) != 1 || sources[0].ID != sourceID("test", codename) {
+		t.Fatalf("unexpected sources %v", sources)
+	}
+	items, _ := fs.Items("test", false)
+	for _, i := range items {
+		if i.Source != sources[0].ID {
+			t.Fatalf("item %v is not tied to the source", i.Name)
+		}
+	}
+
+	eAdmin.GET("/sources/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a>").
+		Contains(">b.txt</a>")
+	eAdmin.POST("/sources/test").
+		WithFormField("action", "reply").
+		WithFormField("Source", sources[0].ID).
+		WithFormField("Text", " ").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the reply must not be empty")
+	eAdmin.POST("/sources/test").
+		WithFormField("action", "reply").
+		WithFormField("Source", sources[0].ID).
+		WithFormField("Text", "we received your files, where do they come from?").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("we received your files")
+
+	other := httpexpect.New(t, serverPublic.URL)
+	other.GET("/source/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(`name="Codename"`).
+		NotContains("we received your files")
+	other.POST("/source/test").
+		WithFormField("action", "codename").
+		WithFormField("Codename", "not my codename").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("unknown codename")
+	other.POST("/source/test").
+		WithFormField("action", "codename").
+		WithFormField("Codename", "  "+strings.ToUpper(codename)+" ").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("we received your files").
+		Contains("<td>a.txt</td>").
+		Contains("<td>b.txt</td>")
+
+	upload(other, "c.txt")
+	items, _ = fs.Items("test", false)
+	if c := items.Get("c.txt"); c.Source != sources[0].ID {
+		t.Fatalf("the upload of the logged in source is not tied to it")
+	}
+
+	// the tus and the PUT uploads cannot show a codename, they need a logged in source.
+	anonymous := httpexpect.New(t, serverPublic.URL)
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("e.txt"))
+	anonymous.POST("/tus/test/").
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Upload-Length", "5").
+		WithHeader("Upload-Metadata", meta).
+		Expect().
+		Status(http.StatusForbidden).
+		Body().
+		Contains("log in with your codename first")
+	anonymous.PUT("/put/test/d.txt").
+		WithBytes([]byte("hello")).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().Value("error").String().Contains("log in with your codename first")
+	other.PUT("/put/test/d.txt").
+		WithBytes([]byte("hello")).
+		Expect().
+		Status(http.StatusCreated)
+	other.POST("/tus/test/").
+		WithHeader("Tus-Resumable", "1.0.0").
+		WithHeader("Upload-Length", "5").
+		WithHeader("Upload-Metadata", meta).
+		Expect().
+		Status(http.StatusCreated)
+	items, _ = fs.Items("test", false)
+	if d := items.Get("d.txt"); d.Source != sources[0].ID {
+		t.Fatalf("the PUT upload of the logged in source is not tied to it")
+	}
+
+	other.POST("/source/test").
+		WithFormField("action", "logout").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(`name="Codename"`)
+}
+
+func TestMessages(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.AllowTypes = "image/*"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 32)...)
+	ePublic.POST("/list/test").
+		WithMultipart().
+		WithFormField("action", "upload").
+		WithFormField("Message", "here are the pictures").
+		WithFileBytes("files", "a.png", png).
+		WithFileBytes("files", "b.png", png).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.png</a>").
+		Contains(">b.png</a>").
+		NotContains("here are the pictures").
+		NotContains("message-")
+
+	ePublic.POST("/list/test").
+		WithFormField("action", "upload").
+		WithFormField("Message", "only a message").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains("only a message")
+
+	ePublic.POST("/list/test").
+		WithFormField("action", "upload").
+		WithFormField("Message", strings.Repeat("x", maxMessageLen+1)).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the message is too long")
+
+	items, _ := fs.Items("test", false)
+	var messages fileItems
+	for _, i := range items {
+		if i.Message {
+			messages = append(messages, i)
+		}
+	}
+	if len(messages) != 2 {
+		t.Fatalf("unexpected messages %v", messages)
+	}
+	if a := items.Get("a.png"); a.Submission == "" || a.Submission != items.Get("b.png").Submission {
+		t.Fatalf("the files are not grouped into a submission")
+	}
+
+	ePublic.GET("/dl/test/" + messages[0].Key()).
+		Expect().
+		Status(http.StatusNotFound)
+	ePublic.GET("/info/test/" + messages[0].Key()).
+		Expect().
+		Status(http.StatusNotFound)
+
+	body := eAdmin.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<pre>here are the pictures</pre>").
+		Contains("<pre>only a message</pre>").
+		Raw()
+	if strings.Index(body, "only a message") > strings.Index(body, "here are the pictures") {
+		t.Fatal("the newest messages are not shown first")
+	}
+	i := strings.Index(body, "here are the pictures")
+	if j := strings.Index(body[i:], "remove the message"); !strings.Contains(body[i:i+j], ">a.png</a>") {
+		t.Fatal("the attached files are not shown with their message")
+	}
+	eAdmin.GET("/dl/test/" + messages[0].Key()).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("here are the pictures")
+}
+
+func TestCollisions(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	fd.Folder.Collisions = "nope"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("invalid name collision policy")
+
+	fd.Folder.Token = "tok"
+	for _, policy := range []string{"reject", "rename", "overwrite", "random"} {
+		fd.Folder.Name = policy
+		fd.Folder.Collisions = policy
+		eAdmin.POST("/create").WithForm(fd).
+			Expect().
+			Status(http.StatusOK)
+		ePublic.PUT("/put/"+policy+"/a.txt").
+			WithHeader("Authorization", "Bearer tok").
+			WithBytes([]byte("first")).
+			Expect().
+			Status(http.StatusCreated)
+	}
+
+	ePublic.PUT("/put/reject/a.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithBytes([]byte("second")).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().Value("error").Equal(`file "a.txt" already exists or being uploaded`)
+
+	ePublic.PUT("/put/rename/a.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithBytes([]byte("second")).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().Value("name").Equal("a-1.txt")
+	ePublic.POST("/list/rename").
+		WithMultipart().
+		WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", []byte("third")).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a-2.txt</a>")
+	ePublic.GET("/dl/rename/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("first")
+
+	ePublic.PUT("/put/overwrite/a.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithBytes([]byte("second")).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().Value("name").Equal("a.txt")
+	ePublic.GET("/dl/overwrite/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("second")
+	items, _ := fs.Items("overwrite", false)
+	if len(items) != 1 || items[0].Size != 6 {
+		t.Fatalf("unexpected items %v", items)
+	}
+
+	items, _ = fs.Items("random", false)
+	if len(items) != 1 || items[0].OriginalName != "a.txt" || !regexp.MustCompile(`^[0-9a-f]{16}\.txt$`).MatchString(items[0].Name) {
+		t.Fatalf("unexpected items %v", items)
+	}
+	name := ePublic.PUT("/put/random/a.txt").
+		WithHeader("Authorization", "Bearer tok").
+		WithBytes([]byte("second")).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().Value("name").String().Raw()
+	if name == items[0].Name || name == "a.txt" {
+		t.Fatalf("unexpected name %q", name)
+	}
+	ePublic.GET("/info/random/" + name).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains("<td>a.txt</td>")
+	eAdmin.GET("/info/random/" + name).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td>a.txt</td>")
+}
+
+func TestVersioning(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.UpdateInterval = time.Millisecond * 500
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	type folderInput struct {
+		Name          string
+		Token         string
+		Versioning    bool
+		MaxVersions   string
+		MaxVersionAge string
+	}
+	type folderCreateInput struct {
+		Folder folderInput
+	}
+	var fd folderCreateInput
+	fd.Folder.Name = "test"
+	fd.Folder.Token = "tok"
+	fd.Folder.Versioning = true
+	fd.Folder.MaxVersions = "2"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+
+	put := func(folderName, content string) {
+		ePublic.PUT("/put/"+folderName+"/a.txt").
+			WithHeader("Authorization", "Bearer tok").
+			WithBytes([]byte(content)).
+			Expect().
+			Status(http.StatusCreated).
+			JSON().Object().Value("name").Equal("a.txt")
+	}
+	put("test", "one")
+	put("test", "two")
+	put("test", "three")
+
+	item, _ := fs.Item("test", "a.txt")
+	if item.Version != 3 || len(item.Versions) != 2 || item.Versions[0].Version != 1 {
+		t.Fatalf("unexpected versions %v %v", item.Version, item.Versions)
+	}
+	ePublic.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a>")
+	ePublic.GET("/dl/test/a.txt").
+		WithQuery("version", "1").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("three")
+	eAdmin.GET("/dl/test/a.txt").
+		WithQuery("version", "1").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("one")
+	ePublic.GET("/info/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("Version history").
+		Contains("<td>3 (current)</td>").
+		NotContains("restore")
+
+	eAdmin.POST("/info/test/a.txt").
+		WithFormField("action", "restore").
+		WithFormField("Version", "1").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("<td>1 (current)</td>")
+	if _, err := fs.storage.Stat(itemVersionKey("test", "a.txt", 1)); err == nil {
+		t.Fatal("the restored version was not deleted")
+	}
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("one")
+	eAdmin.GET("/dl/test/a.txt").
+		WithQuery("version", "3").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("three")
+
+	// the retention prunes the oldest archived version.
+	put("test", "four")
+	item, _ = fs.Item("test", "a.txt")
+	if item.Version != 4 || len(item.Versions) != 2 || item.Versions[0].Version != 3 || item.Versions[1].Version != 1 {
+		t.Fatalf("unexpected versions %v %v", item.Version, item.Versions)
+	}
+	<-time.After(time.Millisecond * 100)
+	if _, err := fs.storage.Stat(itemVersionKey("test", "a.txt", 2)); err == nil {
+		t.Fatal("the pruned version was not deleted")
+	}
+	eAdmin.GET("/dl/test/a.txt").
+		WithQuery("version", "2").
+		Expect().
+		Status(http.StatusNotFound)
+
+	// the written contents are versioned too, the item is released once written.
+	if err := fs.WriteItem("test", "a.txt", []byte("five")); err != nil {
+		t.Fatal(err)
+	}
+	item, _ = fs.Item("test", "a.txt")
+	if item.Version != 5 || len(item.Versions) != 2 || item.Versions[1].Version != 4 {
+		t.Fatalf("unexpected versions %v %v", item.Version, item.Versions)
+	}
+	eAdmin.GET("/dl/test/a.txt").
+		WithQuery("version", "4").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("four")
+	put("test", "six")
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("six")
+
+	fd.Folder.Name = "aged"
+	fd.Folder.MaxVersions = "5"
+	fd.Folder.MaxVersionAge = "1 second"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	put("aged", "one")
+	put("aged", "two")
+	// the versions of an item being restored are not pruned meanwhile.
+	fs.ops <- func() { fs.db.reserve("aged", "a.txt") }
+	<-time.After(time.Second * 2)
+	item, _ = fs.Item("aged", "a.txt")
+	if len(item.Versions) != 1 {
+		t.Fatalf("unexpected versions %v", item.Versions)
+	}
+	if _, err := fs.storage.Stat(itemVersionKey("aged", "a.txt", 1)); err != nil {
+		t.Fatalf("the version of the reserved item was deleted: %v", err)
+	}
+	fs.ops <- func() { fs.db.release("aged", "a.txt") }
+	<-time.After(time.Second)
+	item, _ = fs.Item("aged", "a.txt")
+	if len(item.Versions) != 0 {
+		t.Fatalf("unexpected versions %v", item.Versions)
+	}
+	if _, err := fs.storage.Stat(itemVersionKey("aged", "a.txt", 1)); err == nil {
+		t.Fatal("the expired version was not deleted")
+	}
+
+	if err := fs.RmItem("test", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.storage.Stat(itemVersionKey("test", "a.txt", 5)); err == nil {
+		t.Fatal("the versions of the removed item were not deleted")
+	}
+}
+
+func TestTrash(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+	conf.TrashRetention = time.Hour
+
+	fs := newFileServer(conf)
+	fs.UpdateInterval = time.Millisecond * 500
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	upload := func(dir, name, content string) {
+		ePublic.POST("/list/test"+dir).
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, []byte(content)).
+			Expect().
+			Status(http.StatusOK)
+	}
+	upload("", "a.txt", "first")
+	eAdmin.POST("/list/test").
+		WithFormField("action", "mkdir").
+		WithFormField("Name", "docs").
+		Expect().
+		Status(http.StatusOK)
+	upload("/docs", "b.txt", "nested")
+
+	// the file is kept when its content cannot be moved into the trash.
+	blocker := filepath.Join(conf.StorageDir, "test", trashDir)
+	ioutil.WriteFile(blocker, nil, os.ModePerm)
+	eAdmin.POST("/list/test").
+		WithFormField("action", "rma").
+		WithFormField("Name", "a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">a.txt</a></td>")
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("first")
+	if trash := fs.Trash(); len(trash) != 0 {
+		t.Fatalf("unexpected trash %v", trash)
+	}
+	os.Remove(blocker)
+
+	eAdmin.POST("/list/test").
+		WithFormField("action", "rma").
+		WithFormField("Name", "a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">a.txt</a></td>")
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, "test", "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("the trashed file must be moved, got %v", err)
+	}
+	trash := fs.Trash()
+	if len(trash) != 1 || trash[0].Folder != "test" || trash[0].Item.Name != "a.txt" {
+		t.Fatalf("unexpected trash %v", trash)
+	}
+	first := trash[0].ID
+
+	upload("", "a.txt", "second")
+	eAdmin.POST("/trash").
+		WithFormField("action", "restore").
+		WithFormField("Folder", "test").
+		WithFormField("ID", first).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("file &#34;a.txt&#34; already exists")
+	eAdmin.POST("/list/test").
+		WithFormField("action", "rma").
+		WithFormField("Name", "a.txt").
+		Expect().
+		Status(http.StatusOK)
+	trash = fs.Trash()
+	if len(trash) != 2 || trash[0].ID == first {
+		t.Fatalf("unexpected trash %v", trash)
+	}
+	eAdmin.POST("/trash").
+		WithFormField("action", "purge").
+		WithFormField("Folder", "test").
+		WithFormField("ID", trash[0].ID).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(trash[0].ID).
+		Contains(first)
+	eAdmin.POST("/trash").
+		WithFormField("action", "restore").
+		WithFormField("Folder", "test").
+		WithFormField("ID", first).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("The trash is empty.")
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("first")
+	if files, _ := ioutil.ReadDir(filepath.Join(conf.StorageDir, "test", trashDir)); len(files) > 0 {
+		t.Fatalf("the purged files must be deleted, found %v files", len(files))
+	}
+
+	eAdmin.POST("/list/test").
+		WithFormField("action", "rmdir").
+		WithFormField("Name", "docs").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">docs/</a></td>")
+	trash = fs.Trash()
+	if len(trash) != 1 {
+		t.Fatalf("unexpected trash %v", trash)
+	}
+	eAdmin.POST("/trash").
+		WithFormField("action", "restore").
+		WithFormField("Folder", "test").
+		WithFormField("ID", trash[0].ID).
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(">docs/</a></td>")
+	ePublic.GET("/dl/test/docs/b.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("nested")
+
+	eAdmin.POST("/rm/test").
+		WithFormField("Name", "test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("No folder configured yet!")
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusNotFound)
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("folder &#34;test&#34; is in the trash")
+	eAdmin.GET("/trash").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the whole folder, 2 files")
+	trash = fs.Trash()
+	eAdmin.POST("/trash").
+		WithFormField("action", "restore").
+		WithFormField("Folder", "test").
+		WithFormField("ID", trash[0].ID).
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/dl/test/docs/b.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("nested")
+
+	// the trash older than the retention is purged.
+	eAdmin.POST("/rm/test").
+		WithFormField("Name", "test").
+		Expect().
+		Status(http.StatusOK)
+	fs.ops <- func() {
+		fs.db.Trash["test"][0].DeleteDate = time.Now().Add(-2 * time.Hour)
+	}
+	<-time.After(time.Second)
+	if trash = fs.Trash(); len(trash) != 0 {
+		t.Fatalf("unexpected trash %v", trash)
+	}
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, "test")); !os.IsNotExist(err) {
+		t.Fatalf("the purged folder must be deleted, got %v", err)
+	}
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains("is in the trash")
+}
+
+func TestRanges(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	eAdmin.POST("/unlock").
+		WithFormField("Passphrase", "secret").
+		WithFormField("Confirm", "secret").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("the encryption keys are unlocked")
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), cryptChunkSize/8+10)
+	for _, encrypted := range []bool{false, true} {
+		var fd folderCreate
+		fd.Folder.Name = "test"
+		if encrypted {
+			fd.Folder.Name = "crypt"
+		}
+		fd.Folder.Encrypted = encrypted
+		eAdmin.POST("/create").WithForm(fd).
+			Expect().
+			Status(http.StatusOK)
+		eAdmin.POST("/list/"+fd.Folder.Name).
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", "a.txt", content).
+			Expect().
+			Status(http.StatusOK).
+			Body().
+			Contains(">a.txt</a>")
+
+		u := "/dl/" + fd.Folder.Name + "/a.txt"
+		etag := ePublic.GET(u).
+			Expect().
+			Status(http.StatusOK).
+			Header("Etag").NotEmpty().Raw()
+		ePublic.HEAD(u).
+			Expect().
+			Status(http.StatusOK).
+			Header("Content-Length").Equal(fmt.Sprint(len(content)))
+
+		// a range across the chunks of the encrypted contents.
+		start := cryptChunkSize - 5
+		ePublic.GET(u).
+			WithHeader("Range", fmt.Sprintf("bytes=%v-%v", start, start+9)).
+			Expect().
+			Status(http.StatusPartialContent).
+			Body().
+			Equal(string(content[start : start+10]))
+		ePublic.GET(u).
+			WithHeader("Range", "bytes=-7").
+			Expect().
+			Status(http.StatusPartialContent).
+			Body().
+			Equal(string(content[len(content)-7:]))
+		ePublic.GET(u).
+			WithHeader("Range", "bytes=0-1,10-11").
+			Expect().
+			Status(http.StatusPartialContent).
+			Body().
+			Contains("ab")
+		ePublic.GET(u).
+			WithHeader("Range", fmt.Sprintf("bytes=%v-", len(content)+1)).
+			Expect().
+			Status(http.StatusRequestedRangeNotSatisfiable)
+
+		ePublic.GET(u).
+			WithHeader("If-None-Match", etag).
+			Expect().
+			Status(http.StatusNotModified)
+		ePublic.GET(u).
+			WithHeader("Range", "bytes=0-3").
+			WithHeader("If-Range", etag).
+			Expect().
+			Status(http.StatusPartialContent).
+			Body().
+			Equal("0123")
+		ePublic.GET(u).
+			WithHeader("Range", "bytes=0-3").
+			WithHeader("If-Range", `"stale"`).
+			Expect().
+			Status(http.StatusOK).
+			Body().
+			Equal(string(content))
+	}
+
+	// the etag changes with the content.
+	var fd folderCreate
+	fd.Folder.Name = "versioned"
+	fd.Folder.Versioning = true
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	for _, c := range []string{"one", "two"} {
+		eAdmin.POST("/list/versioned").
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", "a.txt", []byte(c)).
+			Expect().
+			Status(http.StatusOK)
+	}
+	etag := eAdmin.GET("/dl/versioned/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Header("Etag").Raw()
+	eAdmin.GET("/dl/versioned/a.txt").
+		WithQuery("version", "1").
+		WithHeader("Range", "bytes=1-").
+		Expect().
+		Status(http.StatusPartialContent).
+		Body().
+		Equal("ne")
+	eAdmin.GET("/dl/versioned/a.txt").
+		WithQuery("version", "1").
+		WithHeader("If-None-Match", etag).
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("one")
+}
+
+func TestArchive(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	var fd folderCreate
+	fd.Folder.Name = "test"
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/archive/test").
+		Expect().
+		Status(http.StatusNotFound).
+		Body().
+		Contains("no files to download")
+	eAdmin.POST("/list/test").
+		WithFormField("action", "mkdir").
+		WithFormField("Name", "docs").
+		Expect().
+		Status(http.StatusOK)
+	files := map[string]string{
+		"a.txt":      "first",
+		"b.txt":      "second",
+		"docs/c.txt": "nested",
+	}
+	for k, v := range files {
+		dir, name := path.Split(k)
+		ePublic.POST(path.Join("/list/test", dir)).
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, []byte(v)).
+			Expect().
+			Status(http.StatusOK)
+	}
+	ePublic.POST("/list/test").
+		WithMultipart().WithFormField("action", "upload").
+		WithFormField("Message", "hidden").
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/list/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains(`action="/archive/test"`).
+		Contains(`<input type="checkbox" name="name" value="a.txt" form="archive" />`)
+
+	readZip := func(b string) map[string]string {
+		zr, err := zip.NewReader(strings.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := map[string]string{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			res[f.Name] = string(c)
+		}
+		return res
+	}
+	readTar := func(b string) map[string]string {
+		gz, err := gzip.NewReader(strings.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		res := map[string]string{}
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			c, _ := ioutil.ReadAll(tr)
+			res[h.Name] = string(c)
+		}
+		return res
+	}
+	expect := func(got map[string]string, want ...string) {
+		if len(got) != len(want) {
+			t.Fatalf("unexpected archive content %v", got)
+		}
+		for _, k := range want {
+			if got[k] != files[k] {
+				t.Fatalf("unexpected archive content %v", got)
+			}
+		}
+	}
+
+	res := ePublic.GET("/archive/test").
+		Expect().
+		Status(http.StatusOK)
+	res.Header("Content-Type").Equal("application/zip")
+	res.Header("Content-Disposition").Contains(`filename="test.zip"`)
+	expect(readZip(res.Body().Raw()), "a.txt", "b.txt", "docs/c.txt")
+
+	res = ePublic.GET("/archive/test").
+		WithQuery("format", "tar.gz").
+		WithQuery("name", "a.txt").
+		WithQuery("name", "docs/c.txt").
+		Expect().
+		Status(http.StatusOK)
+	res.Header("Content-Type").Equal("application/gzip")
+	expect(readTar(res.Body().Raw()), "a.txt", "docs/c.txt")
+
+	res = ePublic.GET("/archive/test").
+		WithQuery("path", "docs").
+		Expect().
+		Status(http.StatusOK)
+	res.Header("Content-Disposition").Contains(`filename="test-docs.zip"`)
+	got := readZip(res.Body().Raw())
+	if len(got) != 1 || got["c.txt"] != "nested" {
+		t.Fatalf("unexpected archive content %v", got)
+	}
+
+	ePublic.GET("/archive/test").
+		WithQuery("format", "rar").
+		Expect().
+		Status(http.StatusBadRequest)
+
+	// the administrators also get the messages.
+	got = readZip(eAdmin.GET("/archive/test").
+		Expect().
+		Status(http.StatusOK).
+		Body().Raw())
+	if len(got) != 4 {
+		t.Fatalf("unexpected archive content %v", got)
+	}
+
+	fd.Folder.Name = "private"
+	fd.Folder.IsAdminOnlyReadable = true
+	eAdmin.POST("/create").WithForm(fd).
+		Expect().
+		Status(http.StatusOK)
+	ePublic.POST("/list/private").
+		WithMultipart().WithFormField("action", "upload").
+		WithFileBytes("files", "a.txt", []byte(files["a.txt"])).
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/archive/private").
+		Expect().
+		Status(http.StatusNotFound)
+	expect(readZip(eAdmin.GET("/archive/private").
+		Expect().
+		Status(http.StatusOK).
+		Body().Raw()), "a.txt")
+}
+
+func TestDownloadLimits(t *testing.T) {
+
+	secCookie := "sss"
+	var conf torDropConfig
+	conf.StorageDir, _ = ioutil.TempDir("", "")
+	conf.TmpDir, _ = ioutil.TempDir("", "")
+
+	fs := newFileServer(conf)
+	fs.DataFile = filepath.Join(conf.TmpDir, "db.json")
+	admin, public, err := getApps(secCookie, fs, "", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := fs.Listen(ctx)
+		if err != nil {
+			t.Fatalf("file server ended: %v", err)
+		}
+	}()
+
+	serverAdmin := httptest.NewServer(admin)
+	defer serverAdmin.Close()
+	serverPublic := httptest.NewServer(public)
+	defer serverPublic.Close()
+
+	eAdmin := httpexpect.New(t, serverAdmin.URL)
+	ePublic := httpexpect.New(t, serverPublic.URL)
+
+	type folderInput struct {
+		Name          string
+		MaxDownloads  string
+		BurnAfterRead bool
+	}
+	type folderCreateInput struct {
+		Folder folderInput
+	}
+	create := func(name, max string, burn bool) {
+		var fd folderCreateInput
+		fd.Folder.Name = name
+		fd.Folder.MaxDownloads = max
+		fd.Folder.BurnAfterRead = burn
+		eAdmin.POST("/create").WithForm(fd).
+			Expect().
+			Status(http.StatusOK)
+	}
+	upload := func(folderName, name string) {
+		ePublic.POST("/list/"+folderName).
+			WithMultipart().WithFormField("action", "upload").
+			WithFileBytes("files", name, []byte("content")).
+			Expect().
+			Status(http.StatusOK).
+			Body().
+			Contains(">" + name + "</a>")
+	}
+	removed := func(folderName, name string) {
+		for i := 0; i < 50; i++ {
+			if _, err := os.Stat(filepath.Join(conf.StorageDir, folderName, name)); os.IsNotExist(err) {
+				return
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+		t.Fatalf("%v/%v was not removed", folderName, name)
+	}
+
+	create("burn", "", true)
+	upload("burn", "a.txt")
+	ePublic.HEAD("/dl/burn/a.txt").
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/dl/burn/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("content")
+	ePublic.GET("/dl/burn/a.txt").
+		Expect().
+		Status(http.StatusNotFound)
+	removed("burn", "a.txt")
+	ePublic.GET("/list/burn").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		NotContains(">a.txt</a>")
+
+	upload("burn", "b.txt")
+	got := ePublic.GET("/archive/burn").
+		Expect().
+		Status(http.StatusOK).
+		Body().Raw()
+	zr, err := zip.NewReader(strings.NewReader(got), int64(len(got)))
+	if err != nil || len(zr.File) != 1 || zr.File[0].Name != "b.txt" {
+		t.Fatalf("unexpected archive %v", err)
+	}
+	removed("burn", "b.txt")
+
+	// the conditional requests and the heads are not counted.
+	upload("burn", "c.txt")
+	ePublic.HEAD("/archive/burn").
+		Expect().
+		Status(http.StatusOK)
+	etag := ePublic.HEAD("/dl/burn/c.txt").
+		Expect().
+		Status(http.StatusOK).
+		Header("Etag").NotEmpty().Raw()
+	ePublic.GET("/dl/burn/c.txt").
+		WithHeader("If-None-Match", etag).
+		Expect().
+		Status(http.StatusNotModified)
+	// the aborted downloads are not counted either.
+	w := &abortedWriter{ResponseRecorder: httptest.NewRecorder(), n: 3}
+	public.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dl/burn/c.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "con" {
+		t.Fatalf("unexpected aborted download %v %q", w.Code, w.Body.String())
+	}
+	// the ranges are ignored, the whole file is served and counted.
+	ePublic.GET("/dl/burn/c.txt").
+		WithHeader("Range", "bytes=0-2").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Equal("content")
+	ePublic.GET("/dl/burn/c.txt").
+		WithHeader("Range", "bytes=3-").
+		Expect().
+		Status(http.StatusNotFound)
+	removed("burn", "c.txt")
+
+	// the concurrent downloads cannot exceed the limit.
+	create("limited", "3", false)
+	upload("limited", "a.txt")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var ok int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Get(serverPublic.URL + "/dl/limited/a.txt")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			if res.StatusCode == http.StatusOK {
+				ok++
+			}
+		}()
+	}
+	wg.Wait()
+	if ok != 3 {
+		t.Fatalf("expected 3 downloads, got %v", ok)
+	}
+	removed("limited", "a.txt")
+
+	create("test", "", false)
+	upload("test", "a.txt")
+	eAdmin.GET("/info/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("no limit")
+	eAdmin.POST("/info/test/a.txt").
+		WithFormField("action", "limit").
+		WithFormField("MaxDownloads", "nope").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("invalid download limit")
+	eAdmin.POST("/info/test/a.txt").
+		WithFormField("action", "limit").
+		WithFormField("MaxDownloads", "2").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("0 of 2, removed once reached")
+	ePublic.GET("/dl/test/a.txt").
+		Expect().
+		Status(http.StatusOK)
+	ePublic.GET("/info/test/a.txt").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Contains("1 of 2, removed once reached")
+	eAdmin.POST("/info/test/a.txt").
+		WithFormField("action", "limit").
+		WithFormField("MaxDownloads", "1").
+		Expect().
+		Status(http.StatusNotFound)
+	removed("test", "a.txt")
+}
+
+// abortedWriter fails the writes after the first n bytes, like an aborted download.
+type abortedWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *abortedWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.n {
+		w.n -= len(p)
+		return w.ResponseRecorder.Write(p)
+	}
+	n, _ := w.ResponseRecorder.Write(p[:w.n])
+	w.n = 0
+	return n, io.ErrClosedPipe
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// maxMessageLen bounds the length of the text of a message.
+const maxMessageLen = 64 << 10
+
+// newSubmissionID returns a random id grouping the items of a submission.
+func newSubmissionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// messageItem returns the item storing the text of a submission.
+func messageItem(submission, dir, source string, size int) fileItem {
+	return fileItem{
+		CreateDate: time.Now(),
+		Name:       fmt.Sprintf("message-%v.txt", submission),
+		Path:       dir,
+		Size:       uint64(size),
+		Message:    true,
+		Submission: submission,
+		Source:     source,
+	}
+}
+
+// ReadMessage returns the text of a message item.
+func (t *torDropFileServer) ReadMessage(folderName, key string) (string, error) {
+	var item fileItem
+	var cryptKey []byte
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		item, err = t.db.GetItem(folderName, key)
+		switch {
+		case err != nil:
+		case !item.Message:
+			err = fmt.Errorf("file %q is not a message", key)
+		case item.Broken != "":
+			err = fmt.Errorf("file %q is broken: %v", key, item.Broken)
+		case item.Sealed != "":
+			err = fmt.Errorf("the message is sealed, download it to read it")
+		case item.Encrypted:
+			cryptKey, err = t.folderKey(folderName)
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return "", err
+	}
+	src, err := t.storage.Open(storageKey(folderName, key))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	var r io.Reader = src
+	if cryptKey != nil {
+		if r, err = newDecryptReader(src, cryptKey); err != nil {
+			return "", err
+		}
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxMessageLen))
+	return string(b), err
+}
+
+// submission is a message with its attached files.
+type submission struct {
+	ID      string
+	Message fileItem
+	// Text is the text of the message, or why it could not be read.
+	Text  string
+	Files fileItems
+}
+
+// Submissions groups the messages of items with their attached files, the newest first.
+func (t *torDropFileServer) Submissions(folderName string, items fileItems) []submission {
+	var res []submission
+	for _, i := range items {
+		if !i.Message {
+			continue
+		}
+		s := submission{ID: i.Submission, Message: i}
+		text, err := t.ReadMessage(folderName, i.Key())
+		if err != nil {
+			text = err.Error()
+		}
+		s.Text = text
+		for _, f := range items {
+			if !f.Message && f.Submission != "" && f.Submission == i.Submission {
+				s.Files = append(s.Files, f)
+			}
+		}
+		res = append(res, s)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Message.CreateDate.After(res[j].Message.CreateDate)
+	})
+	return res
+}
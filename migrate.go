@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var versionKey = []byte("version")
+
+// migration upgrades the records of the store by one schema version.
+type migration struct {
+	Description string
+	Apply       func(m *migrator) error
+}
+
+// migrations is the ordered registry of the schema migrations,
+// the schema version of a store is the number of migrations applied to it.
+// Never reorder nor remove an entry, append new ones.
+var migrations = []migration{
+	{
+		Description: "default item path to /",
+		Apply: func(m *migrator) error {
+			return m.Items(func(folderName string, doc map[string]interface{}) error {
+				if p, _ := doc["Path"].(string); p == "" {
+					doc["Path"] = "/"
+				}
+				return nil
+			})
+		},
+	},
+}
+
+// dbVersion is the schema version written by this build.
+var dbVersion = len(migrations)
+
+var errDryRun = errors.New("dry run")
+
+// migrator gives the migrations a generic access to the records,
+// every modified record is reported.
+type migrator struct {
+	tx     *bolt.Tx
+	report func(string, ...interface{})
+}
+
+// Folders calls fn for each folder record, changes made to doc are saved.
+func (m *migrator) Folders(fn func(doc map[string]interface{}) error) error {
+	return m.update(m.tx.Bucket(foldersBucket), "folder", fn)
+}
+
+// Items calls fn for each item record, changes made to doc are saved.
+func (m *migrator) Items(fn func(folderName string, doc map[string]interface{}) error) error {
+	b := m.tx.Bucket(itemsBucket)
+	return b.ForEachBucket(func(k []byte) error {
+		folderName := string(k)
+		return m.update(b.Bucket(k), "item "+folderName+"/", func(doc map[string]interface{}) error {
+			return fn(folderName, doc)
+		})
+	})
+}
+
+func (m *migrator) update(b *bolt.Bucket, kind string, fn func(map[string]interface{}) error) error {
+	type change struct {
+		k []byte
+		v []byte
+	}
+	var changes []change
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		var doc map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(v))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return fmt.Errorf("failed to decode %v%q: %v", kind, k, err)
+		}
+		before, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err = fn(doc); err != nil {
+			return err
+		}
+		after, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(before, after) {
+			m.report("  %v%s: %s => %s", kind, k, before, after)
+			changes = append(changes, change{k: append([]byte{}, k...), v: after})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if err := b.Put(c.k, c.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getVersion(tx *bolt.Tx) int {
+	v, _ := strconv.Atoi(string(tx.Bucket(metaBucket).Get(versionKey)))
+	return v
+}
+
+func setVersion(tx *bolt.Tx, v int) error {
+	return tx.Bucket(metaBucket).Put(versionKey, []byte(strconv.Itoa(v)))
+}
+
+func applyMigration(tx *bolt.Tx, v int, report func(string, ...interface{})) error {
+	m := migrations[v]
+	report("migration %d: %v", v+1, m.Description)
+	if err := m.Apply(&migrator{tx: tx, report: report}); err != nil {
+		return fmt.Errorf("migration %d failed: %v", v+1, err)
+	}
+	return setVersion(tx, v+1)
+}
+
+// Version returns the schema version of the store.
+func (s *torDropStore) Version() int {
+	var v int
+	s.db.View(func(tx *bolt.Tx) error {
+		v = getVersion(tx)
+		return nil
+	})
+	return v
+}
+
+// Migrate applies the pending migrations, each within its own transaction.
+// The store file is copied to a backup file before the first one is applied.
+func (s *torDropStore) Migrate(report func(string, ...interface{})) (from int, err error) {
+	from = s.Version()
+	if from > dbVersion {
+		return from, fmt.Errorf("database version %v is newer than the supported version %v", from, dbVersion)
+	}
+	if from == dbVersion {
+		return from, nil
+	}
+	backup := fmt.Sprintf("%v.v%d.bak", s.db.Path(), from)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backup, 0600)
+	})
+	if err != nil {
+		return from, fmt.Errorf("failed to backup the database to %q: %v", backup, err)
+	}
+	report("database backed up to %v", backup)
+	for v := from; v < dbVersion; v++ {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return applyMigration(tx, v, report)
+		})
+		if err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
+
+// DryRun reports the changes the pending migrations would make,
+// including the import of legacy when it is not nil, then rolls them back.
+func (s *torDropStore) DryRun(legacy *torDropDB, report func(string, ...interface{})) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if legacy != nil {
+			report("import %v folders from the legacy database", len(legacy.Folders))
+			if err := importTx(tx, legacy); err != nil {
+				return err
+			}
+		}
+		v := getVersion(tx)
+		if v > dbVersion {
+			return fmt.Errorf("database version %v is newer than the supported version %v", v, dbVersion)
+		}
+		if v == dbVersion {
+			report("database version %v is up to date", v)
+		}
+		for ; v < dbVersion; v++ {
+			if err := applyMigration(tx, v, report); err != nil {
+				return err
+			}
+		}
+		return errDryRun
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return err
+}
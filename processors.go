@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The exit codes of the processors.
+const (
+	processorAccept  = 0
+	processorReject  = 1
+	processorReplace = 2
+)
+
+// defaultProcessorTimeout bounds the run of a processor when the configuration does not.
+const defaultProcessorTimeout = time.Minute
+
+// parseProcessors parses a list of processor names separated by commas or spaces,
+// each is an executable of the processors directory.
+func (t *torDropFileServer) parseProcessors(s string) ([]string, error) {
+	names := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	if len(names) > 0 && t.conf.ProcessorsDir == "" {
+		return nil, fmt.Errorf("the processors are disabled, see -processors-dir")
+	}
+	for _, n := range names {
+		if strings.ContainsAny(n, "/\\") || n == "." || n == ".." {
+			return nil, fmt.Errorf("invalid processor name %q", n)
+		}
+		fi, err := os.Stat(filepath.Join(t.conf.ProcessorsDir, n))
+		if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+			return nil, fmt.Errorf("processor %q is not an executable of %v", n, t.conf.ProcessorsDir)
+		}
+	}
+	return names, nil
+}
+
+// processUpload runs the processors of a completed upload in order.
+// Each one is run with the path of the content as argument, its exit code accepts
+// the content, rejects it with the first line of its error output as reason,
+// or replaces it with the file it wrote at $TOR_DROP_OUTPUT.
+// The contents of the encrypted folders are processed from a decrypted temporary copy,
+// the sealed contents cannot be processed.
+func (t *torDropFileServer) processUpload(ev fileUpload, key []byte, names []string) (fileUpload, error) {
+	if len(names) == 0 || ev.File.Sealed != "" {
+		return ev, nil
+	}
+	var err error
+	fpath := ev.TmpFile
+	if ev.File.Encrypted {
+		if fpath, err = t.decryptTmpFile(ev.TmpFile, key); err != nil {
+			return ev, fmt.Errorf("failed to decrypt the file to process: %v", err)
+		}
+	}
+	defer func() {
+		if fpath != ev.TmpFile {
+			os.Remove(fpath)
+		}
+	}()
+	replaced := false
+	for _, name := range names {
+		var out string
+		if out, err = t.runProcessor(name, fpath, ev); err != nil {
+			return ev, err
+		}
+		ev.File.Processors = append(ev.File.Processors, name)
+		if out != "" {
+			if fpath != ev.TmpFile {
+				os.Remove(fpath)
+			}
+			fpath = out
+			replaced = true
+		}
+	}
+	if !replaced {
+		return ev, nil
+	}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		return ev, err
+	}
+	defer f.Close()
+	head, err := readHead(f)
+	if err != nil {
+		return ev, err
+	}
+	sums := newChecksums(ev.File.BLAKE2b != "")
+	c := &countWriter{Writer: sums}
+	in := io.TeeReader(io.MultiReader(bytes.NewReader(head), f), c)
+	tmpFile := fpath
+	if ev.File.Encrypted {
+		tmpFile, err = t.encryptTmpFile(in, key)
+	} else {
+		_, err = io.Copy(ioutil.Discard, in)
+	}
+	if err != nil {
+		return ev, err
+	}
+	os.Remove(ev.TmpFile)
+	ev.TmpFile = tmpFile
+	ev.File.Size = c.n
+	ev.File.Uploaded = c.n
+	ev.File.SHA256, ev.File.BLAKE2b = sums.Sums()
+	ev.File.MIME = sniffType(head)
+	return ev, nil
+}
+
+// runProcessor runs the processor name on the content at fpath,
+// it returns the path of the content replacing it, if any.
+func (t *torDropFileServer) runProcessor(name, fpath string, ev fileUpload) (string, error) {
+	out, err := ioutil.TempFile(t.conf.TmpDir, "tor-drop")
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+	timeout := t.conf.ProcessorTimeout
+	if timeout <= 0 {
+		timeout = defaultProcessorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stderr := &capWriter{max: 4096}
+	cmd := exec.CommandContext(ctx, filepath.Join(t.conf.ProcessorsDir, name), fpath)
+	cmd.Dir = t.conf.TmpDir
+	cmd.Env = []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"TOR_DROP_FOLDER=" + ev.Folder,
+		"TOR_DROP_NAME=" + ev.File.Key(),
+		"TOR_DROP_MIME=" + ev.File.MIME,
+		"TOR_DROP_OUTPUT=" + out.Name(),
+	}
+	cmd.Stderr = stderr
+	// the children keeping the error output open do not hold the upload.
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+
+	code := processorAccept
+	if x, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		code = x.ExitCode()
+		err = nil
+	}
+	switch {
+	case ctx.Err() != nil:
+		err = fmt.Errorf("processor %q timed out after %v", name, timeout)
+	case err != nil:
+		err = fmt.Errorf("processor %q failed: %v", name, err)
+	case code == processorAccept:
+	case code == processorReject:
+		reason := stderr.FirstLine()
+		if reason == "" {
+			reason = "no reason given"
+		}
+		err = fmt.Errorf("processor %q rejected the file: %v", name, reason)
+	case code == processorReplace:
+		if fi, e := os.Stat(out.Name()); e != nil || fi.Size() == 0 {
+			err = fmt.Errorf("processor %q replaced the file with an empty content", name)
+			break
+		}
+		t.logger.Info("file %v/%v replaced by processor %v", ev.Folder, ev.File.Key(), name)
+		return out.Name(), nil
+	default:
+		err = fmt.Errorf("processor %q failed with exit code %v", name, code)
+	}
+	os.Remove(out.Name())
+	return "", err
+}
+
+// decryptTmpFile decrypts the temporary file fpath into a new temporary file.
+func (t *torDropFileServer) decryptTmpFile(fpath string, key []byte) (string, error) {
+	if key == nil {
+		return "", errCryptLocked
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := newDecryptReader(f, key)
+	if err != nil {
+		return "", err
+	}
+	out, err := ioutil.TempFile(t.conf.TmpDir, "tor-drop")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, r)
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// encryptTmpFile encrypts r into a new temporary file.
+func (t *torDropFileServer) encryptTmpFile(r io.Reader, key []byte) (string, error) {
+	out, err := ioutil.TempFile(t.conf.TmpDir, "tor-drop")
+	if err != nil {
+		return "", err
+	}
+	w, err := newEncryptWriter(out, key)
+	if err == nil {
+		if _, err = io.Copy(w, r); err == nil {
+			err = w.Close()
+		}
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// capWriter keeps the first max bytes written to it.
+type capWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if n := c.max - c.Len(); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		c.Buffer.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// FirstLine returns the first non empty line written.
+func (c *capWriter) FirstLine() string {
+	s := bufio.NewScanner(bytes.NewReader(c.Bytes()))
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" {
+			return l
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import "time"
+
+// progressEvent reports the state of an upload to the progress subscribers.
+type progressEvent struct {
+	Folder   string `json:"folder"`
+	Name     string `json:"name"`
+	Size     uint64 `json:"size"`
+	Uploaded uint64 `json:"uploaded"`
+	// Rate is the average throughput in bytes per second,
+	// ETA the estimated remaining seconds, when the size is known.
+	Rate  uint64 `json:"rate"`
+	ETA   uint64 `json:"eta,omitempty"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	progressUploading = "uploading"
+	progressStored    = "stored"
+	progressFailed    = "failed"
+)
+
+// progressSub receives the events of the uploads of a folder,
+// limited to the uploads of owner unless it is empty.
+type progressSub struct {
+	folder string
+	owner  string
+	c      chan progressEvent
+}
+
+// SubscribeProgress returns the progress events of the uploads of the folder,
+// an empty owner receives the events of all uploads.
+// The returned func must be called to unsubscribe, it closes the channel.
+func (t *torDropFileServer) SubscribeProgress(folderName, owner string) (<-chan progressEvent, func()) {
+	sub := &progressSub{
+		folder: folderName,
+		owner:  owner,
+		c:      make(chan progressEvent, 32),
+	}
+	t.ops <- func() {
+		if t.progressSubs == nil {
+			t.progressSubs = map[*progressSub]bool{}
+		}
+		t.progressSubs[sub] = true
+	}
+	return sub.c, func() {
+		t.ops <- func() {
+			delete(t.progressSubs, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// publishProgress sends the state of up to its subscribers,
+// the events are dropped for the subscribers too slow to receive them.
+func (t *torDropFileServer) publishProgress(up fileUpload, state string, err error) {
+	if len(t.progressSubs) == 0 {
+		return
+	}
+	ev := progressEvent{
+		Folder:   up.Folder,
+		Name:     up.File.Key(),
+		Size:     up.File.Size,
+		Uploaded: up.File.Uploaded,
+		State:    state,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if elapsed := up.LastActive.Sub(up.StartDate); elapsed > time.Second {
+		ev.Rate = uint64(float64(up.File.Uploaded) / elapsed.Seconds())
+	}
+	if ev.Rate > 0 && state == progressUploading && ev.Size > ev.Uploaded {
+		ev.ETA = (ev.Size - ev.Uploaded) / ev.Rate
+	}
+	for sub := range t.progressSubs {
+		if sub.folder != up.Folder || (sub.owner != "" && sub.owner != up.Owner) {
+			continue
+		}
+		select {
+		case sub.c <- ev:
+		default:
+		}
+	}
+}
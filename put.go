@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+)
+
+// putResult is the response of a raw upload.
+type putResult struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    uint64 `json:"size"`
+	SHA256  string `json:"sha256"`
+	BLAKE2b string `json:"blake2b,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// PutUpload stores the raw body of the request as the file name of the folder,
+// the name may start with the path of an existing directory.
+func (t *torDropApp) PutUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	folderName := vars["folder"]
+	fd := t.fs.Folder(folderName)
+	if fd == nil {
+		writeJSON(w, http.StatusNotFound, putResult{Error: fmt.Sprintf("folder %q not found", folderName)})
+		return
+	}
+
+	// once authorized the uploader is a logged user of a protected folder,
+	// the token also counts as a login on a public folder.
+	needCaptcha := t.captchaRequired(fd, true)
+	if !t.isAdmin {
+		var err error
+		if r.Header.Get("Authorization") != "" {
+			if err = authHeader(fd, r); err == nil {
+				needCaptcha = fd.CaptchaForLoggedUsers
+			}
+		} else {
+			err = t.hasAuthFolder(folderName, w, r)
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", folderName))
+			writeJSON(w, http.StatusUnauthorized, putResult{Error: err.Error()})
+			return
+		}
+	}
+	if needCaptcha {
+		writeJSON(w, http.StatusForbidden, putResult{Error: "this folder requires a captcha, use the upload form"})
+		return
+	}
+
+	source, err := t.loggedSource(fd, r)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, putResult{Error: err.Error()})
+		return
+	}
+
+	dir, name := path.Split(cleanDir(vars["name"]))
+	item := fileItem{
+		CreateDate: time.Now(),
+		Name:       uploadName(name),
+		Path:       dir,
+		Source:     source,
+	}
+	if r.ContentLength > 0 {
+		item.Size = uint64(r.ContentLength)
+	}
+	if d := r.Header.Get("Digest"); d != "" {
+		if item.SHA256, err = parseDigestHeader(d); err != nil {
+			writeJSON(w, http.StatusBadRequest, putResult{Error: err.Error()})
+			return
+		}
+	}
+	item, err = t.fs.UploadItem(folderName, item, r.Body, uploadOptions{Owner: t.uploaderID(w, r)})
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, putResult{Error: err.Error()})
+		return
+	}
+	item, err = t.fs.Item(folderName, item.Key())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, putResult{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, putResult{
+		Name:    item.Name,
+		Path:    item.Path,
+		Size:    item.Size,
+		SHA256:  item.SHA256,
+		BLAKE2b: item.BLAKE2b,
+	})
+}
+
+// authHeader checks the Authorization header of r against the folder fd,
+// HTTP Basic with its password or one of its users, or a bearer token with its token.
+func authHeader(fd *folder, r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		if fd.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(fd.Token)) == 1 {
+			return nil
+		}
+		return fmt.Errorf("invalid token")
+	}
+	login, pwd, ok := r.BasicAuth()
+	if !ok {
+		return fmt.Errorf("invalid authorization")
+	}
+	if fd.Password != nil && *fd.Password != "" {
+		if subtle.ConstantTimeCompare([]byte(pwd), []byte(*fd.Password)) == 1 {
+			return nil
+		}
+		return fmt.Errorf("invalid password")
+	}
+	if len(fd.Users) > 0 {
+		for _, p := range fd.Users[login] {
+			if subtle.ConstantTimeCompare([]byte(pwd), []byte(p)) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid login")
+	}
+	return fmt.Errorf("this folder has no password nor users")
+}
+
+// csrfHeaderAuth skips the csrf check of the raw uploads authenticated
+// by a valid Authorization header, they do not rely on the session cookies.
+// It only wraps the public interface, the administrators uploads are not authenticated.
+func csrfHeaderAuth(fs *torDropFileServer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := strings.TrimPrefix(r.URL.Path, "/put/"); p != r.URL.Path && r.Header.Get("Authorization") != "" {
+			fd := fs.Folder(strings.SplitN(p, "/", 2)[0])
+			if fd != nil && authHeader(fd, r) == nil {
+				r = csrf.UnsafeSkipCheck(r)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	errResumableBusy   = errors.New("the upload is already being written")
+	errResumableOffset = errors.New("the upload offset does not match")
+)
+
+// tusUpload is a resumable upload, the content of its successive
+// requests is written through a pipe into the upload started on creation.
+type tusUpload struct {
+	ID         string
+	Folder     string
+	Length     uint64
+	Offset     uint64
+	LastActive time.Time
+
+	writing bool
+	pw      *io.PipeWriter
+	done    <-chan error
+}
+
+// CreateResumable starts the resumable upload of item and returns its id,
+// the content is written by WriteResumable.
+func (t *torDropFileServer) CreateResumable(folderName string, item fileItem, owner string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	pr, pw := io.Pipe()
+	_, done, err := t.startUpload(folderName, item, pr, uploadOptions{Owner: owner, Resumable: true})
+	if err != nil {
+		pw.Close()
+		return "", err
+	}
+	u := &tusUpload{
+		ID:         hex.EncodeToString(b),
+		Folder:     folderName,
+		Length:     item.Size,
+		LastActive: time.Now(),
+		pw:         pw,
+		done:       done,
+	}
+	ret := make(chan error)
+	t.ops <- func() {
+		if t.tusUploads == nil {
+			t.tusUploads = map[string]*tusUpload{}
+		}
+		t.tusUploads[u.ID] = u
+		ret <- nil
+	}
+	return u.ID, <-ret
+}
+
+func (t *torDropFileServer) resumable(folderName, id string) (*tusUpload, error) {
+	u, ok := t.tusUploads[id]
+	if !ok || u.Folder != folderName {
+		return nil, fmt.Errorf("upload %q not found in folder %q", id, folderName)
+	}
+	return u, nil
+}
+
+// Resumable returns the offset and the length of an upload.
+func (t *torDropFileServer) Resumable(folderName, id string) (offset, length uint64, err error) {
+	ret := make(chan error)
+	t.ops <- func() {
+		u, err := t.resumable(folderName, id)
+		if err == nil {
+			offset, length = u.Offset, u.Length
+		}
+		ret <- err
+	}
+	return offset, length, <-ret
+}
+
+// WriteResumable appends the content of src to the upload at offset,
+// it returns the new offset. The upload is committed once complete.
+func (t *torDropFileServer) WriteResumable(folderName, id string, offset uint64, src io.Reader) (uint64, error) {
+	var u *tusUpload
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		u, err = t.resumable(folderName, id)
+		if err == nil && u.writing {
+			err = errResumableBusy
+		} else if err == nil && u.Offset != offset {
+			err = errResumableOffset
+		}
+		if err == nil {
+			u.writing = true
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return offset, err
+	}
+
+	n, err := io.Copy(u.pw, io.LimitReader(src, int64(u.Length-offset)))
+	// the upload already failed when its pipe is closed.
+	failed := errors.Is(err, io.ErrClosedPipe)
+
+	var complete bool
+	t.ops <- func() {
+		u.writing = false
+		u.Offset += uint64(n)
+		u.LastActive = time.Now()
+		complete = u.Offset == u.Length
+		if complete || failed {
+			delete(t.tusUploads, u.ID)
+		}
+		ret <- nil
+	}
+	<-ret
+	if complete && !failed {
+		u.pw.Close()
+	}
+	if complete || failed {
+		err = <-u.done
+	}
+	return offset + uint64(n), err
+}
+
+// TerminateResumable cancels an upload.
+func (t *torDropFileServer) TerminateResumable(folderName, id string) error {
+	var u *tusUpload
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		u, err = t.resumable(folderName, id)
+		if err == nil {
+			delete(t.tusUploads, id)
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	u.pw.CloseWithError(fmt.Errorf("upload terminated"))
+	<-u.done
+	return nil
+}
+
+// expireResumables cancels the uploads not written since lifetime.
+func (t *torDropFileServer) expireResumables(lifetime time.Duration) {
+	for id, u := range t.tusUploads {
+		if u.writing || u.LastActive.Add(lifetime).After(time.Now()) {
+			continue
+		}
+		t.logger.Info("detected inactive resumable upload %v/%v", u.Folder, id)
+		delete(t.tusUploads, id)
+		go u.pw.CloseWithError(fmt.Errorf("cancelled because inactive"))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Storage stores the objects within a bucket of an s3 compatible service,
+// it uses path style requests signed with AWS signature version 4.
+type s3Storage struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func (e s3Error) Error() string {
+	return fmt.Sprintf("s3: %v: %v", e.Code, e.Message)
+}
+
+func (s *s3Storage) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+func (s *s3Storage) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s3Sign(req, s.AccessKey, s.SecretKey, s.region(), time.Now())
+	res, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	var e s3Error
+	if xml.NewDecoder(res.Body).Decode(&e) != nil || e.Code == "" {
+		e.Code = res.Status
+	}
+	return nil, e
+}
+
+func (s *s3Storage) Put(key string, src io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("s3: object size must be known")
+	}
+	res, err := s.do(http.MethodPut, key, nil, nil, ioutil.NopCloser(src), size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *s3Storage) Open(key string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// OpenAt opens the object from offset with a range request.
+func (s *s3Storage) OpenAt(key string, offset int64) (io.ReadCloser, error) {
+	h := http.Header{}
+	h.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	res, err := s.do(http.MethodGet, key, nil, h, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		// the range was ignored.
+		if _, err := io.CopyN(ioutil.Discard, res.Body, offset); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+	}
+	return res.Body, nil
+}
+
+func (s *s3Storage) Stat(key string) (storageObject, error) {
+	res, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return storageObject{}, err
+	}
+	res.Body.Close()
+	o := storageObject{Key: key, Size: res.ContentLength}
+	o.ModTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return o, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+func (s *s3Storage) List(prefix string) ([]storageObject, error) {
+	var ret []storageObject
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("prefix", prefix)
+	for {
+		res, err := s.do(http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return ret, err
+		}
+		var l s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&l)
+		res.Body.Close()
+		if err != nil {
+			return ret, err
+		}
+		for _, c := range l.Contents {
+			ret = append(ret, storageObject{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !l.IsTruncated || l.NextContinuationToken == "" {
+			return ret, nil
+		}
+		q.Set("continuation-token", l.NextContinuationToken)
+	}
+}
+
+// s3Sign adds the AWS signature version 4 headers to req,
+// the payload is not signed so that it can be streamed.
+func s3Sign(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	signature, signedHeaders := s3Signature(req, secretKey, region, amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func s3Signature(req *http.Request, secretKey, region, amzDate string) (signature, signedHeaders string) {
+	headers := map[string]string{
+		"host":                 req.Host,
+		"x-amz-content-sha256": req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+	}
+	if headers["host"] == "" {
+		headers["host"] = req.URL.Host
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders = strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, k := range keys {
+		vs := query[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			canonicalQuery = append(canonicalQuery, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	h := sha256.Sum256([]byte(canonicalRequest))
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, p := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, p)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), signedHeaders
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent encodes s as required by the canonical request,
+// slashes are kept unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// originalsDir is the reserved directory of a folder storing
+// the original contents of the sanitized items.
+const originalsDir = ".originals"
+
+// originalKey returns the storage key of the original content of an item.
+func originalKey(folderName, key string) string {
+	return storageKey(folderName, originalsDir+"/"+key)
+}
+
+// isReservedKey reports whether key is within the reserved directories of a folder.
+func isReservedKey(key string) bool {
+	key = strings.TrimPrefix(key, "/")
+	for _, dir := range []string{originalsDir, versionsDir, trashDir} {
+		if key == dir || strings.HasPrefix(key, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeMaxSize bounds the contents read into memory by the sanitizers
+// of formats which cannot be rewritten on the fly.
+var sanitizeMaxSize int64 = 64 << 20
+
+// sanitizer strips the metadata of a content type while copying r to w.
+type sanitizer struct {
+	Name  string
+	Strip func(w io.Writer, r io.Reader) error
+}
+
+// sanitizers are indexed by the sniffed MIME type of the contents.
+var sanitizers = map[string]sanitizer{
+	"image/jpeg":      {Name: "jpeg", Strip: stripJPEG},
+	"image/png":       {Name: "png", Strip: stripPNG},
+	"image/webp":      {Name: "webp", Strip: stripWebP},
+	"application/pdf": {Name: "pdf", Strip: stripPDF},
+}
+
+// sanitizeUpload strips the metadata of a completed upload into a new temporary file,
+// the previous one is returned as original, it is removed unless keepOriginal is set.
+// The content is left untouched when its type has no sanitizer or when it is sealed.
+// The items whose metadata could not be stripped are quarantined.
+func (t *torDropFileServer) sanitizeUpload(ev fileUpload, key []byte, keepOriginal bool) (up fileUpload, original string) {
+	s, ok := sanitizers[ev.File.MIME]
+	if !ok || ev.File.Sealed != "" {
+		return ev, ""
+	}
+	tmpFile, n, sums, err := t.sanitizeFile(ev.TmpFile, s, ev.File.Encrypted, key, ev.File.BLAKE2b != "")
+	if err != nil {
+		t.logger.Error("failed to sanitize file %v/%v: %v", ev.Folder, ev.File.Key(), err)
+		if ev.File.Quarantine == "" {
+			ev.File.Quarantine = fmt.Sprintf("the metadata stripping failed: %v", err)
+		}
+		return ev, ""
+	}
+	if keepOriginal {
+		original = ev.TmpFile
+		ev.File.OriginalSize = ev.File.StoredSize()
+	} else {
+		os.Remove(ev.TmpFile)
+	}
+	ev.TmpFile = tmpFile
+	ev.File.Size = n
+	ev.File.Uploaded = n
+	ev.File.SHA256, ev.File.BLAKE2b = sums.Sums()
+	ev.File.Sanitizers = append(ev.File.Sanitizers, s.Name)
+	return ev, original
+}
+
+func (t *torDropFileServer) sanitizeFile(fpath string, s sanitizer, encrypted bool, key []byte, withBLAKE2b bool) (string, uint64, *checksums, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if encrypted {
+		if key == nil {
+			return "", 0, nil, errCryptLocked
+		}
+		if r, err = newDecryptReader(f, key); err != nil {
+			return "", 0, nil, err
+		}
+	}
+	out, err := ioutil.TempFile(t.conf.TmpDir, "tor-drop")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	var w io.Writer = out
+	var enc io.WriteCloser
+	if encrypted {
+		if enc, err = newEncryptWriter(out, key); err != nil {
+			out.Close()
+			os.Remove(out.Name())
+			return "", 0, nil, err
+		}
+		w = enc
+	}
+	sums := newChecksums(withBLAKE2b)
+	c := &countWriter{Writer: io.MultiWriter(w, sums)}
+	err = s.Strip(c, r)
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil && c.n == 0 {
+		err = fmt.Errorf("the sanitized content is empty")
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, nil, err
+	}
+	return out.Name(), c.n, sums, nil
+}
+
+type countWriter struct {
+	io.Writer
+	n uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// readAllLimited reads r into memory up to sanitizeMaxSize bytes.
+func readAllLimited(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, sanitizeMaxSize+1))
+	if err == nil && int64(len(b)) > sanitizeMaxSize {
+		err = fmt.Errorf("the file is too large to be sanitized, must not exceed %v",
+			humanize.Bytes(uint64(sanitizeMaxSize)))
+	}
+	return b, err
+}
+
+// stripJPEG removes the APPn segments other than JFIF, ICC profiles and Adobe,
+// the comments, and the data trailing the end of image.
+func stripJPEG(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return fmt.Errorf("invalid jpeg file")
+	}
+	bw.Write(soi[:])
+	m, err := readJPEGMarker(br)
+	for {
+		if err != nil {
+			return fmt.Errorf("invalid jpeg file: %v", err)
+		}
+		switch {
+		case m == 0xd9:
+			bw.Write([]byte{0xff, m})
+			return bw.Flush()
+		case m == 0x01 || m >= 0xd0 && m <= 0xd7:
+			bw.Write([]byte{0xff, m})
+			m, err = readJPEGMarker(br)
+			continue
+		}
+		var l [2]byte
+		if _, err = io.ReadFull(br, l[:]); err != nil {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(l[:])) - 2
+		if n < 0 {
+			err = fmt.Errorf("invalid segment length")
+			continue
+		}
+		seg := make([]byte, n)
+		if _, err = io.ReadFull(br, seg); err != nil {
+			continue
+		}
+		if keepJPEGSegment(m, seg) {
+			bw.Write([]byte{0xff, m})
+			bw.Write(l[:])
+			bw.Write(seg)
+		}
+		if m == 0xda {
+			m, err = copyJPEGScan(bw, br)
+		} else {
+			m, err = readJPEGMarker(br)
+		}
+	}
+}
+
+func keepJPEGSegment(m byte, seg []byte) bool {
+	switch {
+	case m == 0xe0, m == 0xee:
+		return true
+	case m == 0xe2:
+		return bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00"))
+	case m > 0xe0 && m <= 0xef, m == 0xfe:
+		return false
+	}
+	return true
+}
+
+// readJPEGMarker reads a marker and its fill bytes.
+func readJPEGMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, fmt.Errorf("marker expected")
+	}
+	for b == 0xff {
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// copyJPEGScan copies the entropy coded data of a scan,
+// it returns the marker which ended it.
+func copyJPEGScan(bw *bufio.Writer, br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xff {
+			bw.WriteByte(b)
+			continue
+		}
+		for b == 0xff {
+			if b, err = br.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+		if b == 0x00 || b >= 0xd0 && b <= 0xd7 {
+			bw.Write([]byte{0xff, b})
+			continue
+		}
+		return b, nil
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the chunks removed by stripPNG, XMP is stored within an iTXt chunk.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG removes the textual, EXIF and time chunks, and the data trailing the IEND chunk.
+func stripPNG(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return fmt.Errorf("invalid png file")
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+	for {
+		var h [8]byte
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			return fmt.Errorf("invalid png file: %v", err)
+		}
+		typ := string(h[4:])
+		// the data is followed by its crc.
+		n := int64(binary.BigEndian.Uint32(h[:4])) + 4
+		var err error
+		if pngMetadataChunks[typ] {
+			_, err = io.CopyN(ioutil.Discard, br, n)
+		} else if _, err = w.Write(h[:]); err == nil {
+			_, err = io.CopyN(w, br, n)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid png file: %v", err)
+		}
+		if typ == "IEND" {
+			return nil
+		}
+	}
+}
+
+// stripWebP removes the EXIF and XMP chunks of the RIFF container and clears
+// their flags of the VP8X chunk. The whole content is read in memory as the
+// container starts with its size.
+func stripWebP(w io.Writer, r io.Reader) error {
+	b, err := readAllLimited(r)
+	if err != nil {
+		return err
+	}
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return fmt.Errorf("invalid webp file")
+	}
+	end := 8 + int64(binary.LittleEndian.Uint32(b[4:8]))
+	if end > int64(len(b)) {
+		return fmt.Errorf("invalid webp file: truncated")
+	}
+	var out bytes.Buffer
+	for b := b[12:end]; len(b) > 0; {
+		if len(b) < 8 {
+			return fmt.Errorf("invalid webp file: truncated chunk")
+		}
+		n := int64(binary.LittleEndian.Uint32(b[4:8]))
+		size := 8 + n + n%2
+		if size > int64(len(b)) {
+			size = int64(len(b))
+			if 8+n > size {
+				return fmt.Errorf("invalid webp file: truncated chunk")
+			}
+		}
+		chunk := b[:size]
+		b = b[size:]
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if n > 0 {
+				chunk = append([]byte{}, chunk...)
+				// the flags of the EXIF and XMP chunks.
+				chunk[8] &^= 0x08 | 0x04
+			}
+		}
+		out.Write(chunk)
+	}
+	var h [12]byte
+	copy(h[:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:8], uint32(out.Len()+4))
+	copy(h[8:], "WEBP")
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err = out.WriteTo(w)
+	return err
+}
+
+var (
+	pdfObjRe      = regexp.MustCompile(`(?:^|[^0-9])([0-9]+)\s+([0-9]+)\s+obj\b`)
+	pdfInfoRe     = regexp.MustCompile(`/Info\s+([0-9]+)\s+([0-9]+)\s+R`)
+	pdfMetadataRe = regexp.MustCompile(`/Type\s*/Metadata\b`)
+)
+
+// stripPDF blanks the strings of the document information dictionaries,
+// the contents of the XMP metadata streams and the XMP packets found elsewhere.
+// The values are overwritten with the same length so that the cross reference
+// tables remain valid. The documents whose information dictionary is within
+// a compressed object stream, or whose metadata streams are compressed,
+// cannot be stripped this way and are refused.
+func stripPDF(w io.Writer, r io.Reader) error {
+	b, err := readAllLimited(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(b, []byte("%PDF-")) {
+		return fmt.Errorf("invalid pdf file")
+	}
+	// the offsets of the objects by number and generation, the last definition wins.
+	objects := map[string]int{}
+	var starts []int
+	for _, m := range pdfObjRe.FindAllSubmatchIndex(b, -1) {
+		objects[string(b[m[2]:m[3]])+" "+string(b[m[4]:m[5]])] = m[1]
+		starts = append(starts, m[1])
+	}
+	for _, m := range pdfInfoRe.FindAllSubmatchIndex(b, -1) {
+		ref := string(b[m[2]:m[3]]) + " " + string(b[m[4]:m[5]])
+		i, ok := objects[ref]
+		if !ok {
+			return fmt.Errorf("the document information is compressed")
+		}
+		d := pdfDict(b[i:])
+		if d == nil {
+			return fmt.Errorf("invalid document information dictionary")
+		}
+		blankPDFStrings(d)
+	}
+	for _, m := range pdfMetadataRe.FindAllIndex(b, -1) {
+		// the metadata stream is the object starting before the type.
+		i := sort.SearchInts(starts, m[0]) - 1
+		if i < 0 {
+			continue
+		}
+		d := pdfDict(b[starts[i]:])
+		if d == nil || len(d) < m[0]-starts[i] {
+			continue
+		}
+		if bytes.Contains(d, []byte("/Filter")) {
+			return fmt.Errorf("the XMP metadata is compressed")
+		}
+		rest := b[starts[i]+len(d):]
+		j := bytes.Index(rest, []byte("stream"))
+		k := bytes.Index(rest, []byte("endstream"))
+		if j < 0 || k < j {
+			continue
+		}
+		for x := j + len("stream"); x < k; x++ {
+			if rest[x] != '\r' && rest[x] != '\n' {
+				rest[x] = ' '
+			}
+		}
+	}
+	begin, end := []byte("<x:xmpmeta"), []byte("</x:xmpmeta>")
+	for i := 0; ; {
+		j := bytes.Index(b[i:], begin)
+		if j < 0 {
+			break
+		}
+		i += j
+		k := bytes.Index(b[i:], end)
+		if k < 0 {
+			break
+		}
+		k += len(end)
+		for x := i; x < i+k; x++ {
+			b[x] = ' '
+		}
+		i += k
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// pdfDict returns the dictionary starting b after blanks, up to its end,
+// or nil if b does not start with a dictionary.
+func pdfDict(b []byte) []byte {
+	i := 0
+	for i < len(b) && bytes.IndexByte([]byte(" \t\r\n\f\x00"), b[i]) > -1 {
+		i++
+	}
+	if !bytes.HasPrefix(b[i:], []byte("<<")) {
+		return nil
+	}
+	depth := 0
+	for i < len(b) {
+		switch {
+		case bytes.HasPrefix(b[i:], []byte("<<")):
+			depth++
+			i += 2
+		case bytes.HasPrefix(b[i:], []byte(">>")):
+			depth--
+			i += 2
+			if depth == 0 {
+				return b[:i]
+			}
+		case b[i] == '(' || b[i] == '<':
+			i += pdfStringLen(b[i:])
+		default:
+			i++
+		}
+	}
+	return nil
+}
+
+// blankPDFStrings blanks the literal and hexadecimal strings of the dictionary d.
+func blankPDFStrings(d []byte) {
+	for i := 0; i < len(d); {
+		switch {
+		case bytes.HasPrefix(d[i:], []byte("<<")), bytes.HasPrefix(d[i:], []byte(">>")):
+			i += 2
+		case d[i] == '(' || d[i] == '<':
+			n := pdfStringLen(d[i:])
+			blankPDFString(d[i : i+n])
+			i += n
+		default:
+			i++
+		}
+	}
+}
+
+// pdfStringLen returns the length of the literal or hexadecimal string starting b.
+func pdfStringLen(b []byte) int {
+	if b[0] == '<' {
+		if i := bytes.IndexByte(b, '>'); i >= 0 {
+			return i + 1
+		}
+		return len(b)
+	}
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(b)
+}
+
+// blankPDFString blanks the literal or hexadecimal string value starting b.
+func blankPDFString(b []byte) {
+	i := 0
+	for i < len(b) && bytes.IndexByte([]byte(" \t\r\n\f\x00"), b[i]) > -1 {
+		i++
+	}
+	if i == len(b) {
+		return
+	}
+	switch {
+	case b[i] == '(':
+		depth := 1
+		for i++; i < len(b) && depth > 0; i++ {
+			switch b[i] {
+			case '\\':
+				b[i] = ' '
+				if i+1 < len(b) {
+					i++
+				}
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if depth > 0 {
+				b[i] = ' '
+			}
+		}
+	case b[i] == '<' && i+1 < len(b) && b[i+1] != '<':
+		for i++; i < len(b) && b[i] != '>'; i++ {
+			if isHexDigit(b[i]) {
+				b[i] = '0'
+			}
+		}
+	}
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
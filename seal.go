@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Folders with recipients seal the uploads with their public keys,
+// only the holders of the private keys can read them.
+const (
+	sealAge = "age"
+	sealPGP = "pgp"
+)
+
+// sealExt returns the file extension of the items sealed with format.
+func sealExt(format string) string {
+	switch format {
+	case sealAge:
+		return ".age"
+	case sealPGP:
+		return ".gpg"
+	}
+	return ""
+}
+
+// sealer encrypts the content to the recipients of a folder.
+type sealer struct {
+	Format string
+	age    []age.Recipient
+	pgp    openpgp.EntityList
+}
+
+// parseRecipients parses either age recipients, one per line,
+// or armored OpenPGP public keys. An empty list returns a nil sealer.
+func parseRecipients(s string) (*sealer, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if strings.Contains(s, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenPGP recipients: %v", err)
+		}
+		if len(entities) == 0 {
+			return nil, fmt.Errorf("no OpenPGP recipient found")
+		}
+		return &sealer{Format: sealPGP, pgp: entities}, nil
+	}
+	recipients, err := age.ParseRecipients(strings.NewReader(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipients: %v", err)
+	}
+	return &sealer{Format: sealAge, age: recipients}, nil
+}
+
+// Seal returns a writer encrypting to w, it must be closed to complete the encryption.
+func (s *sealer) Seal(w io.Writer, name string) (io.WriteCloser, error) {
+	if s.Format == sealPGP {
+		return openpgp.Encrypt(w, s.pgp, nil, &openpgp.FileHints{IsBinary: true, FileName: name}, nil)
+	}
+	return age.Encrypt(w, s.age...)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,7 +9,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -23,13 +26,22 @@ import (
 type torDropFileServer struct {
 	logger *logWriter
 
-	db   *torDropDB
-	conf torDropConfig
+	db      *torDropDB
+	store   *torDropStore
+	storage storage
+	conf    torDropConfig
 
-	UpdateInterval   time.Duration
-	AutosaveInterval time.Duration
+	UpdateInterval time.Duration
+	// ScrubInterval is the interval between two consistency checks
+	// of the database and the storage, zero disables them.
+	ScrubInterval time.Duration
+	ScrubOptions  fsckOptions
 
+	// DataFile is the legacy json database, imported once into the store.
 	DataFile string
+	// StoreFile is the path of the database, it defaults
+	// to DataFile with a .db extension.
+	StoreFile string
 
 	ops          chan func()
 	uploadEvents chan fileUpload
@@ -38,21 +50,38 @@ type torDropFileServer struct {
 	folderUploadManagers   map[string]*folderManager
 	folderDownloadManagers map[string]*folderManager
 	activeDownloads        map[string]int
+	scrubbing              bool
+
+	// kek is the key encrypting the folder keys, it is nil until unlocked.
+	kek  []byte
+	keys map[string][]byte
+
+	tusUploads map[string]*tusUpload
+	// progressSubs receive the progress events of the uploads.
+	progressSubs map[*progressSub]bool
+	// transfers are the uploads and downloads in flight.
+	transfers   map[uint64]*transfer
+	transferSeq uint64
 }
 
 func newFileServer(conf torDropConfig) *torDropFileServer {
+	s := conf.Storage
+	if s == nil {
+		s = localStorage{Dir: conf.StorageDir}
+	}
 	return &torDropFileServer{
-		conf:   conf,
-		logger: newLogger("file-server"),
+		conf:    conf,
+		storage: s,
+		logger:  newLogger("file-server"),
 		db: &torDropDB{
 			Items: map[string]fileItems{},
+			Dirs:  map[string][]string{},
 		},
-		AutosaveInterval: time.Minute,
-		UpdateInterval:   time.Minute,
-		ops:              make(chan func()),
-		uploadEvents:     make(chan fileUpload),
-		freeSlot:         make(chan bool),
-		DataFile:         "db.json",
+		UpdateInterval: time.Minute,
+		ops:            make(chan func()),
+		uploadEvents:   make(chan fileUpload),
+		freeSlot:       make(chan bool),
+		DataFile:       "db.json",
 	}
 }
 
@@ -116,6 +145,41 @@ type folder struct {
 	IsAdminOnlyReadable   bool
 	Password              *string
 	Users                 map[string][]string
+	// Encrypted folders encrypt the content of the new items at rest.
+	Encrypted bool
+	// Recipients are the public keys the new items are sealed to,
+	// either age recipients or armored OpenPGP keys. It supersedes Encrypted.
+	Recipients string
+	// Token authorizes the raw uploads sent with a bearer Authorization header.
+	Token string
+	// AllowTypes and DenyTypes are lists of MIME types and extensions,
+	// checked against the type sniffed from the content, see typePolicy.
+	// TypeMismatch is reject or quarantine, for the contents not matching their extension.
+	AllowTypes   string
+	DenyTypes    string
+	TypeMismatch string
+	// Sanitize strips the metadata of the new images and documents,
+	// KeepOriginal stores their original content for the administrators.
+	Sanitize     bool
+	KeepOriginal bool
+	// Processors lists the executables of the processors directory
+	// run in order on the new items, see processUpload.
+	Processors string
+	// Codenames gives the anonymous uploaders a codename to come back
+	// and read the replies of the administrators, see source.
+	Codenames bool
+	// Collisions is the policy applied to the new items taking
+	// the name of an existing one, see resolveName.
+	Collisions string
+	// Versioning keeps the older versions of the items uploaded again,
+	// MaxVersions and MaxVersionAge bound the older versions kept.
+	Versioning    bool
+	MaxVersions   *int
+	MaxVersionAge *durationDecoder
+	// MaxDownloads bounds the count of downloads of the items, BurnAfterRead
+	// allows a single one. The items are removed once reached, see DownloadLimit.
+	MaxDownloads  *int
+	BurnAfterRead bool
 }
 
 type fileItem struct {
@@ -124,12 +188,88 @@ type fileItem struct {
 	CreateDate time.Time
 	Size       uint64
 	Uploaded   uint64
+	// SHA256 and BLAKE2b are the hex encoded checksums of the content,
+	// computed while uploading. BLAKE2b is optional.
+	SHA256  string `json:",omitempty"`
+	BLAKE2b string `json:",omitempty"`
+	// Broken tells why the content is not usable anymore, it is set by the scrubber.
+	Broken string `json:",omitempty"`
+	// Encrypted is set when the content is encrypted with the folder key.
+	Encrypted bool `json:",omitempty"`
+	// Sealed is the format of the content sealed to the folder recipients,
+	// SealedSize is the size of the sealed content.
+	Sealed     string `json:",omitempty"`
+	SealedSize uint64 `json:",omitempty"`
+	// MIME is the type sniffed from the content.
+	MIME string `json:",omitempty"`
+	// Quarantine tells why the item is held for review,
+	// only the administrators can download it until released.
+	Quarantine string `json:",omitempty"`
+	// ScanVerdict is the verdict of the malware scanner.
+	ScanVerdict string `json:",omitempty"`
+	// Sanitizers lists the metadata sanitizers applied to the content.
+	Sanitizers []string `json:",omitempty"`
+	// Processors lists the processors which accepted or replaced the content.
+	Processors []string `json:",omitempty"`
+	// OriginalSize is the stored size of the original content
+	// kept by the sanitization, see originalKey.
+	OriginalSize uint64 `json:",omitempty"`
+	// Source is the id of the source which uploaded the item.
+	Source string `json:",omitempty"`
+	// Message items hold the text of a submission,
+	// Submission groups a message with its attached files.
+	Message    bool   `json:",omitempty"`
+	Submission string `json:",omitempty"`
+	// OriginalName is the name given by the uploader when the folder
+	// names the items with random identifiers.
+	OriginalName string `json:",omitempty"`
+	// Version numbers the content of the items of the versioned folders,
+	// Versions are the older versions kept, the last archived last, see itemVersionKey.
+	Version  int        `json:",omitempty"`
+	Versions []fileItem `json:",omitempty"`
+	// Downloads counts the downloads of the items with a download limit,
+	// MaxDownloads supersedes the limit of the folder.
+	Downloads    int `json:",omitempty"`
+	MaxDownloads int `json:",omitempty"`
 }
 
 func (f fileItem) IsComplete() bool {
 	return f.Uploaded >= f.Size
 }
 
+// StoredSize returns the size of the content within the storage.
+func (f fileItem) StoredSize() uint64 {
+	if f.Sealed != "" {
+		return f.SealedSize
+	}
+	if f.Encrypted {
+		return encryptedSize(f.Size)
+	}
+	return f.Size
+}
+
+// ServedSize returns the size of the content downloaded for the item,
+// or of its original content.
+func (f fileItem) ServedSize(original bool) uint64 {
+	switch {
+	case original:
+		return f.OriginalSize
+	case f.Sealed != "":
+		return f.SealedSize
+	}
+	return f.Size
+}
+
+// DownloadName returns the file name of the downloaded content.
+func (f fileItem) DownloadName() string {
+	return f.Name + sealExt(f.Sealed)
+}
+
+// Key returns the path of the item relative to its folder.
+func (f fileItem) Key() string {
+	return strings.TrimPrefix(path.Join(f.Path, f.Name), "/")
+}
+
 type fileUpload struct {
 	TmpFile    string
 	Folder     string
@@ -137,34 +277,118 @@ type fileUpload struct {
 	LastActive time.Time
 	Error      error
 	Completed  chan error
+	// Committing is set once the file is being moved into the storage.
+	Committing bool
+	// Resumable uploads are expired by their tus session.
+	Resumable bool
+	// Done is set once the content was entirely received.
+	Done bool
+	// Owner identifies the uploader, see uploadOptions.
+	Owner     string
+	StartDate time.Time
 }
 
 type torDropDB struct {
+	Version int
 	Uploads fileUploads `json:"-"`
 	Folders folders
 	Items   map[string]fileItems
+	// Dirs lists the directories of each folder, the root directory / is implicit.
+	Dirs map[string][]string
+	// Sources lists the sources of the folders with codenames.
+	Sources map[string][]source `json:",omitempty"`
+	// Trash lists the items and the folders deleted by the administrators.
+	Trash map[string][]trashEntry `json:",omitempty"`
+	// reserved are the keys held by reserve.
+	reserved map[string]bool
+}
+
+func (t *torDropFileServer) storeFile() string {
+	if t.StoreFile != "" {
+		return t.StoreFile
+	}
+	return strings.TrimSuffix(t.DataFile, filepath.Ext(t.DataFile)) + ".db"
 }
 
 func (t *torDropFileServer) load() error {
-	f, err := os.Open(t.DataFile)
+	s, err := openStore(t.storeFile())
+	if err != nil {
+		return err
+	}
+	t.store = s
+	if err := t.importDataFile(); err != nil {
+		return fmt.Errorf("failed to import %q: %v", t.DataFile, err)
+	}
+	from, err := t.store.Migrate(t.logger.Info)
 	if err != nil {
 		return err
 	}
+	if from != dbVersion {
+		t.logger.Info("migrated tor-drop database from version %v to %v", from, dbVersion)
+	}
+	return t.store.Load(t.db)
+}
+
+// readDataFile reads the whole-file json database of previous versions,
+// it returns nil if there is none.
+func (t *torDropFileServer) readDataFile() (*torDropDB, error) {
+	f, err := os.Open(t.DataFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 	defer f.Close()
-	err = json.NewDecoder(f).Decode(&t.db)
-	return err
+	var db torDropDB
+	err = json.NewDecoder(f).Decode(&db)
+	return &db, err
 }
 
-func (t *torDropFileServer) save() error {
-	f, err := os.OpenFile(t.DataFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+// importDataFile imports the legacy json database,
+// it is then renamed so that it is never imported again.
+func (t *torDropFileServer) importDataFile() error {
+	if t.store.Imported() {
+		return nil
+	}
+	db, err := t.readDataFile()
+	if err != nil || db == nil {
+		return err
+	}
+	if err = t.store.Import(db); err != nil {
+		return err
+	}
+	t.logger.Info("imported %v folders from %v", len(db.Folders), t.DataFile)
+	return os.Rename(t.DataFile, t.DataFile+".imported")
+}
+
+// MigrateDryRun prints the changes the pending migrations
+// would apply to the database without saving them.
+// It works on a copy of the database, which is never written.
+func (t *torDropFileServer) MigrateDryRun(w io.Writer) error {
+	tmp, err := ioutil.TempFile(t.conf.TmpDir, "tor-drop-dry-run")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", " ")
-	err = enc.Encode(t.db)
-	return err
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err = copyStore(t.storeFile(), tmp.Name()); err != nil {
+		return err
+	}
+	s, err := openStore(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	var legacy *torDropDB
+	if !s.Imported() {
+		legacy, err = t.readDataFile()
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %v", t.DataFile, err)
+		}
+	}
+	return s.DryRun(legacy, func(f string, args ...interface{}) {
+		fmt.Fprintf(w, f+"\n", args...)
+	})
 }
 
 type folderManager struct {
@@ -222,14 +446,6 @@ func (t *torDropFileServer) setDownloadLimit(folderName string, n int) error {
 	return nil
 }
 
-func (t *torDropFileServer) getUploadReader(folderName string, src io.ReadCloser) io.ReadCloser {
-	x, ok := t.folderUploadManagers[folderName]
-	if !ok {
-		return src
-	}
-	return readCloser{Closer: src, Reader: x.NewReader(src)}
-}
-
 func (t *torDropFileServer) getDownloadReader(folderName string, src io.ReadCloser) io.ReadCloser {
 	x, ok := t.folderDownloadManagers[folderName]
 	if !ok {
@@ -254,31 +470,29 @@ func (t *torDropFileServer) Listen(ctx context.Context) error {
 	if t.UpdateInterval < 1 {
 		t.UpdateInterval = time.Minute
 	}
-	if t.AutosaveInterval < 1 {
-		t.AutosaveInterval = time.Minute * 2
-	}
 
 	if err := t.load(); err != nil {
-		t.logger.Info("failed to load tor-drop database: %v", err)
+		return fmt.Errorf("failed to load tor-drop database: %v", err)
 	}
+	defer func() {
+		err := t.store.Close()
+		t.logger.Info("closing tor-drop database: %v", err)
+	}()
 
 	t.db.ClearUploads(func(up fileUpload) {
 		err := os.Remove(up.TmpFile)
 		t.logger.Info("removed tmp file %q err=%v", up.TmpFile, err)
 	})
 
-	if err := t.save(); err != nil {
-		t.logger.Info("failed to save tor-drop database: %v", err)
-	}
-	defer func() {
-		err := t.save()
-		t.logger.Info("saving tor-drop database: %v", err)
-	}()
-
 	tm := time.NewTicker(t.UpdateInterval)
 	defer tm.Stop()
-	t2m := time.NewTicker(t.AutosaveInterval)
-	defer t2m.Stop()
+
+	var scrubC <-chan time.Time
+	if t.ScrubInterval > 0 {
+		st := time.NewTicker(t.ScrubInterval)
+		defer st.Stop()
+		scrubC = st.C
+	}
 
 	for _, folder := range t.db.GetFolders() {
 		if folder.MaxDlBytesPerSec != nil && *folder.MaxDlBytesPerSec > 0 {
@@ -293,12 +507,6 @@ func (t *torDropFileServer) Listen(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-t2m.C:
-			if err := t.save(); err != nil {
-				t.logger.Info("failed to save tor-drop database: %v", err)
-				continue
-			}
-			t.logger.Info("saved tor-drop database to %v", t.DataFile)
 
 		case <-tm.C:
 			t.logger.Info("checking tor-drop uploads...")
@@ -307,43 +515,67 @@ func (t *torDropFileServer) Listen(ctx context.Context) error {
 			t.db.ClearLifetimeExceededUploads(lifetime, func(up fileUpload) {
 				t.logger.Info("detected inactive file upload %q since %v", up.File.Name,
 					time.Now().Add(lifetime).Sub(up.LastActive))
+				err := fmt.Errorf("cancelled because too slow")
+				t.publishProgress(up, progressFailed, err)
 				go func() {
-					up.Completed <- fmt.Errorf("cancelled because too slow")
+					up.Completed <- err
 				}()
-				err := os.Remove(up.TmpFile)
+				err = os.Remove(up.TmpFile)
 				if err != nil {
 					t.logger.Info("failed to remove temp file %q err=%v", up.TmpFile, err)
 				}
 			})
 
+			t.expireResumables(lifetime)
+
+			t.db.PruneVersions(func(folderName string, i fileItem, versions []fileItem) {
+				if err := t.store.PutItem(folderName, i); err != nil {
+					t.logger.Error("failed to update item %v/%v: %v", folderName, i.Key(), err)
+				}
+				go func() {
+					err := t.deleteVersions(folderName, i.Key(), versions)
+					if err != nil {
+						t.logger.Error("failed to delete versions of %v/%v: %v", folderName, i.Key(), err)
+					}
+				}()
+			})
+
+			t.purgeExpiredTrash()
+
 			t.db.ClearLifetimeExceededItems(func(folderName string, i fileItem) {
 				t.logger.Info("max lifetime exceeded for file %v/%v", folderName, i.Name)
-				u := filepath.Join(t.conf.StorageDir, folderName, i.Name)
-				err := os.Remove(u)
-				if err != nil {
-					t.logger.Error("failed to delete file for lifetime exceeded: %v", folderName, i.Name, err)
+				if err := t.store.DeleteItem(folderName, i.Key()); err != nil {
+					t.logger.Error("failed to delete item %v/%v: %v", folderName, i.Key(), err)
 				}
+				go func() {
+					err := t.deleteObjects(folderName, i)
+					if err != nil {
+						t.logger.Error("failed to delete file %v/%v for lifetime exceeded: %v", folderName, i.Key(), err)
+					}
+				}()
 			})
 
-			t.save()
-
 		case ev := <-t.uploadEvents:
-			if ev.File.IsComplete() {
+			if ev.Done || ev.Error != nil {
 				select {
 				case t.freeSlot <- true:
 				default:
 				}
-				t.db.CompleteUpload(ev)
 				if ev.Error != nil {
+					t.db.CompleteUpload(ev)
+					t.publishProgress(ev, progressFailed, ev.Error)
 					ev.Completed <- ev.Error
 					t.logger.Error("file %q upload completion error: %v", ev.File.Name, ev.Error)
+					os.Remove(ev.TmpFile)
 					continue
 				}
 
-				_, err := t.db.GetItem(ev.Folder, ev.File.Name)
-				if err == nil {
+				_, err := t.db.GetItem(ev.Folder, ev.File.Key())
+				if err == nil && !t.db.Overwrites(ev.Folder) {
+					t.db.CompleteUpload(ev)
 					err := fmt.Errorf("file %q upload completion error: %v", ev.File.Name, fmt.Errorf("file %q already exists", ev.File.Name))
 					t.logger.Error("%v", err)
+					t.publishProgress(ev, progressFailed, err)
 					ev.Completed <- err
 					err = os.Remove(ev.TmpFile)
 					if err != nil {
@@ -352,38 +584,51 @@ func (t *torDropFileServer) Listen(ctx context.Context) error {
 					continue
 				}
 
-				du := filepath.Join(t.conf.StorageDir, ev.Folder)
-				t.logger.Info("creating path %q: %v", du, os.MkdirAll(du, os.ModePerm))
-
-				u := filepath.Join(t.conf.StorageDir, ev.Folder, ev.File.Name)
-				if err := os.Rename(ev.TmpFile, u); err != nil {
+				if err := t.db.FitsFolder(ev.Folder, ev.File); err != nil {
+					t.db.CompleteUpload(ev)
 					t.logger.Error("file %q upload completion error: %v", ev.File.Name, err)
+					t.publishProgress(ev, progressFailed, err)
 					ev.Completed <- err
-					err = os.Remove(ev.TmpFile)
-					t.logger.Error("temporary file %q upload completion error: %v", ev.File.Name, err)
+					os.Remove(ev.TmpFile)
 					continue
 				}
-				if err := t.db.AddItem(ev.Folder, ev.File); err != nil {
-					t.logger.Error("file %q upload completion error: %v", ev.File.Name, err)
-					ev.Completed <- err
-					err = os.Remove(u)
-					if err != nil {
-						t.logger.Error("file %q upload cleaning error: %v", ev.File.Name, err)
-					}
-					continue
+
+				ev.Committing = true
+				t.db.UploadEvent(ev)
+				var fd folder
+				if x := t.db.Folder(ev.Folder); x != nil {
+					fd = *x
 				}
-				t.logger.Printf("added file %q to %q\n", ev.File.Name, u)
-				if err := t.save(); err != nil {
-					ev.Completed <- err
-					t.logger.Error("failed to save the database: %v", err)
-					continue
+				// the key decrypts the content to scan, to process and to sanitize.
+				var key []byte
+				if (t.conf.Scanner != nil || fd.Sanitize || fd.Processors != "") && ev.File.Encrypted {
+					key, _ = t.folderKey(ev.Folder)
 				}
-				ev.Completed <- nil
+				go t.commitUpload(ev, key, fd)
 				continue
 			}
 			if !t.db.UploadEventNewer(ev) {
 				log.Printf("ev ent not updated %v\n", ev)
+				continue
+			}
+			t.publishProgress(ev, progressUploading, nil)
+
+		case <-scrubC:
+			if t.scrubbing {
+				continue
 			}
+			t.scrubbing = true
+			go func() {
+				report, err := t.Fsck(t.ScrubOptions)
+				if err != nil {
+					t.logger.Error("scrubber failed: %v", err)
+				} else {
+					var b bytes.Buffer
+					report.Write(&b)
+					t.logger.Info("scrubber report:\n%v", strings.TrimSpace(b.String()))
+				}
+				t.ops <- func() { t.scrubbing = false }
+			}()
 
 		case op := <-t.ops:
 			op()
@@ -391,6 +636,109 @@ func (t *torDropFileServer) Listen(ctx context.Context) error {
 	}
 }
 
+// commitUpload moves the completed upload into the storage, it runs
+// outside of the main loop as remote storages and scanners might be slow.
+func (t *torDropFileServer) commitUpload(ev fileUpload, cryptKey []byte, fd folder) {
+	if t.conf.Scanner != nil {
+		ev.File = t.scanUpload(ev, cryptKey)
+	}
+	processors, err := t.parseProcessors(fd.Processors)
+	if err == nil {
+		tmpFile := ev.TmpFile
+		ev, err = t.processUpload(ev, cryptKey, processors)
+		// the contents replaced by a processor are scanned again.
+		if err == nil && ev.TmpFile != tmpFile && t.conf.Scanner != nil {
+			ev.File = t.scanUpload(ev, cryptKey)
+		}
+	}
+	var original string
+	if err == nil && fd.Sanitize {
+		ev, original = t.sanitizeUpload(ev, cryptKey, fd.KeepOriginal)
+	}
+	var archived *fileItem
+	if err == nil && fd.Versioning {
+		archived, err = t.archiveVersion(ev.Folder, ev.File.Key())
+	}
+	key := storageKey(ev.Folder, ev.File.Key())
+	if err == nil {
+		err = putFile(t.storage, ev.TmpFile, key)
+	}
+	if err == nil && original != "" {
+		if err = putFile(t.storage, original, originalKey(ev.Folder, ev.File.Key())); err != nil {
+			t.storage.Delete(key)
+		}
+	}
+	// the current content was not replaced.
+	if err != nil && archived != nil {
+		t.storage.Delete(itemVersionKey(ev.Folder, ev.File.Key(), archived.Version))
+	}
+	t.ops <- func() {
+		t.db.CompleteUpload(ev)
+		if err != nil {
+			t.logger.Error("file %q upload completion error: %v", ev.File.Name, err)
+			t.publishProgress(ev, progressFailed, err)
+			ev.Completed <- err
+			os.Remove(ev.TmpFile)
+			if original != "" {
+				os.Remove(original)
+			}
+			return
+		}
+		// the item is replaced when the folder overwrites or versions its items.
+		old, e := t.db.GetItem(ev.Folder, ev.File.Key())
+		replaced := e == nil
+		var pruned []fileItem
+		if replaced && archived != nil {
+			ev.File.Version = old.nextVersion()
+			ev.File.Versions = append(append([]fileItem{}, old.Versions...), *archived)
+			pruned = pruneVersions(&fd, &ev.File)
+		}
+		if replaced {
+			err = t.db.UpdateItem(ev.Folder, ev.File)
+		} else {
+			err = t.db.AddItem(ev.Folder, ev.File)
+		}
+		if err == nil {
+			err = t.store.PutItem(ev.Folder, ev.File)
+			if err != nil && replaced {
+				t.db.UpdateItem(ev.Folder, old)
+			} else if err != nil {
+				t.db.RmItem(ev.Folder, ev.File.Key())
+			}
+		}
+		if err != nil {
+			t.logger.Error("file %q upload completion error: %v", ev.File.Name, err)
+			t.publishProgress(ev, progressFailed, err)
+			ev.Completed <- err
+			go func() {
+				if archived != nil {
+					t.unarchiveVersion(ev.Folder, ev.File.Key(), *archived)
+				} else if err := t.deleteObjects(ev.Folder, ev.File); err != nil {
+					t.logger.Error("file %q upload cleaning error: %v", ev.File.Name, err)
+				}
+			}()
+			return
+		}
+		if len(pruned) > 0 {
+			go func() {
+				if err := t.deleteVersions(ev.Folder, ev.File.Key(), pruned); err != nil {
+					t.logger.Error("file %q versions cleaning error: %v", ev.File.Name, err)
+				}
+			}()
+		}
+		if replaced && old.OriginalSize > 0 && ev.File.OriginalSize == 0 {
+			go func() {
+				if err := t.storage.Delete(originalKey(ev.Folder, old.Key())); err != nil {
+					t.logger.Error("file %q original cleaning error: %v", old.Name, err)
+				}
+			}()
+		}
+		t.logger.Printf("added file %q to %q\n", ev.File.Name, key)
+		t.publishProgress(ev, progressStored, nil)
+		ev.Completed <- nil
+	}
+}
+
 func (t *torDropFileServer) Folders(includePrivate bool) []folder {
 	ret := make(chan []folder)
 	t.ops <- func() {
@@ -412,9 +760,27 @@ func (t *torDropFileServer) Folder(name string) *folder {
 }
 
 func (t *torDropFileServer) UpdateFolder(fd folder, users bool) error {
+	if _, err := parseRecipients(fd.Recipients); err != nil {
+		return err
+	}
+	if err := validateCollisions(fd.Collisions); err != nil {
+		return err
+	}
+	if _, err := newTypePolicy(&fd); err != nil {
+		return err
+	}
+	if _, err := t.parseProcessors(fd.Processors); err != nil {
+		return err
+	}
 	ret := make(chan error)
 	t.ops <- func() {
-		err := t.db.UpdateFolder(fd, users)
+		var err error
+		if fd.Encrypted {
+			err = t.ensureFolderKey(fd.Name)
+		}
+		if err == nil {
+			err = t.db.UpdateFolder(fd, users)
+		}
 		if err == nil {
 			if fd.MaxDlBytesPerSec != nil {
 				t.setDownloadLimit(fd.Name, int(*fd.MaxDlBytesPerSec))
@@ -424,7 +790,7 @@ func (t *torDropFileServer) UpdateFolder(fd folder, users bool) error {
 			}
 		}
 		if err == nil {
-			err = t.save()
+			err = t.store.PutFolder(*t.db.Folder(fd.Name))
 		}
 		ret <- err
 	}
@@ -458,6 +824,7 @@ func (t *torDropFileServer) RmFolder(name string) error {
 	t.ops <- func() {
 		err := t.db.RmFolder(name)
 		if err == nil {
+			delete(t.keys, name)
 			x, ok := t.folderUploadManagers[name]
 			if ok {
 				x.Close()
@@ -470,46 +837,259 @@ func (t *torDropFileServer) RmFolder(name string) error {
 			}
 		}
 		if err == nil {
-			err = t.fsRemoveFolder(name)
-		}
-		if err == nil {
-			err = t.save()
+			err = t.store.DeleteFolder(name)
 		}
 		ret <- err
 	}
-	return <-ret
+	if err := <-ret; err != nil {
+		return err
+	}
+	return deletePrefix(t.storage, storageKey(name, ""))
 }
 
 func (t *torDropFileServer) RmItem(folderName, name string) error {
+	var item fileItem
 	ret := make(chan error)
 	t.ops <- func() {
 		var err error
-		err = t.db.RmItem(folderName, name)
+		item, err = t.db.GetItem(folderName, name)
+		if err == nil {
+			err = t.db.RmItem(folderName, name)
+		}
 		if err == nil {
-			err = t.fsRemove(folderName, name)
+			err = t.store.DeleteItem(folderName, name)
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	return t.deleteObjects(folderName, item)
+}
+
+// deleteObjects deletes the content of the item, its original content
+// and its older versions.
+func (t *torDropFileServer) deleteObjects(folderName string, item fileItem) error {
+	err := t.storage.Delete(storageKey(folderName, item.Key()))
+	if item.OriginalSize > 0 {
+		if e := t.storage.Delete(originalKey(folderName, item.Key())); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := t.deleteVersions(folderName, item.Key(), item.Versions); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// QuarantineItem holds the item for review, an empty reason releases it.
+func (t *torDropFileServer) QuarantineItem(folderName, key, reason string) error {
+	ret := make(chan error)
+	t.ops <- func() {
+		item, err := t.db.GetItem(folderName, key)
+		if err != nil {
+			ret <- err
+			return
 		}
+		item.Quarantine = reason
+		err = t.store.PutItem(folderName, item)
 		if err == nil {
-			err = t.save()
+			err = t.db.UpdateItem(folderName, item)
 		}
 		ret <- err
 	}
 	return <-ret
 }
 
-func (t *torDropFileServer) fsRemoveFolder(name string) error {
-	fsPath := filepath.Join(t.conf.StorageDir, name)
-	return os.RemoveAll(fsPath)
+// quarantinedItem is a quarantined item of a folder.
+type quarantinedItem struct {
+	Folder string
+	Item   fileItem
+}
+
+// QuarantinedItems returns the quarantined items of all the folders.
+func (t *torDropFileServer) QuarantinedItems() []quarantinedItem {
+	ret := make(chan []quarantinedItem)
+	t.ops <- func() {
+		var res []quarantinedItem
+		for _, fd := range t.db.GetFolders() {
+			items, _ := t.db.GetItems(fd.Name, false)
+			for _, i := range items {
+				if i.Quarantine != "" {
+					res = append(res, quarantinedItem{Folder: fd.Name, Item: i})
+				}
+			}
+		}
+		ret <- res
+	}
+	return <-ret
+}
+
+func (t *torDropFileServer) Dirs(folderName, dir string) ([]string, error) {
+	var dirs []string
+	ret := make(chan error)
+	t.ops <- func() {
+		if !t.db.HasDir(folderName, dir) {
+			ret <- fmt.Errorf("directory %q not found in folder %q", dir, folderName)
+			return
+		}
+		dirs = t.db.GetDirs(folderName, dir)
+		ret <- nil
+	}
+	return dirs, <-ret
+}
+
+func (t *torDropFileServer) CreateDir(folderName, dir string) error {
+	ret := make(chan error)
+	t.ops <- func() {
+		dir = cleanDir(dir)
+		err := t.db.AddDir(folderName, dir)
+		if err == nil {
+			err = t.store.Batch(func(b storeTx) error {
+				return b.PutDir(folderName, dir)
+			})
+			if err != nil {
+				t.db.RmDir(folderName, dir)
+			}
+		}
+		ret <- err
+	}
+	return <-ret
 }
-func (t *torDropFileServer) fsRemove(folder, name string) error {
-	fsPath := filepath.Join(t.conf.StorageDir, folder, name)
-	return os.Remove(fsPath)
+
+// RmDir removes the directory dir with all its content.
+func (t *torDropFileServer) RmDir(folderName, dir string) error {
+	var items fileItems
+	ret := make(chan error)
+	t.ops <- func() {
+		var dirs []string
+		var err error
+		items, dirs, err = t.db.RmDir(folderName, dir)
+		if err == nil {
+			err = t.store.Batch(func(b storeTx) error {
+				for _, i := range items {
+					if err := b.DeleteItem(folderName, i.Key()); err != nil {
+						return err
+					}
+				}
+				for _, d := range dirs {
+					if err := b.DeleteDir(folderName, d); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	var err error
+	for _, i := range items {
+		if e := t.deleteObjects(folderName, i); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// RenameDir gives the directory dir the new name within its parent directory.
+func (t *torDropFileServer) RenameDir(folderName, dir, name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return fmt.Errorf("invalid directory name %q", name)
+	}
+	var moved [][2]fileItem
+	ret := make(chan error)
+	t.ops <- func() {
+		dir = cleanDir(dir)
+		to := path.Join(path.Dir(dir), name)
+		var dirs []string
+		for _, d := range t.db.Dirs[folderName] {
+			if isInDir(d, dir) {
+				dirs = append(dirs, d)
+			}
+		}
+		var err error
+		moved, err = t.db.RenameDir(folderName, dir, to)
+		if err != nil {
+			ret <- err
+			return
+		}
+		err = t.store.Batch(func(b storeTx) error {
+			for _, m := range moved {
+				if err := b.DeleteItem(folderName, m[0].Key()); err != nil {
+					return err
+				}
+				if err := b.PutItem(folderName, m[1]); err != nil {
+					return err
+				}
+			}
+			for _, d := range dirs {
+				if err := b.DeleteDir(folderName, d); err != nil {
+					return err
+				}
+				if err := b.PutDir(folderName, to+strings.TrimPrefix(d, dir)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.db.RenameDir(folderName, to, dir)
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	var err error
+	for _, m := range moved {
+		e := moveObject(t.storage, storageKey(folderName, m[0].Key()), storageKey(folderName, m[1].Key()))
+		if e == nil && m[0].OriginalSize > 0 {
+			e = moveObject(t.storage, originalKey(folderName, m[0].Key()), originalKey(folderName, m[1].Key()))
+		}
+		for _, v := range m[0].Versions {
+			if e == nil {
+				e = moveObject(t.storage, itemVersionKey(folderName, m[0].Key(), v.Version), itemVersionKey(folderName, m[1].Key(), v.Version))
+			}
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (t *torDropFileServer) CreateFolder(fd folder) error {
+	if _, err := parseRecipients(fd.Recipients); err != nil {
+		return err
+	}
+	if err := validateCollisions(fd.Collisions); err != nil {
+		return err
+	}
+	if _, err := newTypePolicy(&fd); err != nil {
+		return err
+	}
+	if _, err := t.parseProcessors(fd.Processors); err != nil {
+		return err
+	}
 	ret := make(chan error)
 	t.ops <- func() {
 		var err error
-		err = t.db.CreateFolder(fd)
+		fd.Name = t.db.clean(fd.Name)
+		if fd.Encrypted && t.kek == nil {
+			err = errCryptLocked
+		}
+		if err == nil {
+			err = t.db.CreateFolder(fd)
+		}
+		if err == nil && fd.Encrypted {
+			err = t.ensureFolderKey(fd.Name)
+			if err != nil {
+				t.db.RmFolder(fd.Name)
+			}
+		}
 		if err == nil {
 			if fd.MaxDlBytesPerSec != nil {
 				t.setDownloadLimit(fd.Name, int(*fd.MaxDlBytesPerSec))
@@ -519,7 +1099,10 @@ func (t *torDropFileServer) CreateFolder(fd folder) error {
 			}
 		}
 		if err == nil {
-			err = t.save()
+			err = t.store.PutFolder(*t.db.Folder(fd.Name))
+			if err != nil {
+				t.db.RmFolder(fd.Name)
+			}
 		}
 		ret <- err
 	}
@@ -549,7 +1132,7 @@ func (t *torDropFileServer) AddFolderLogin(folderName, user, pwd string) error {
 			fd.Users[user] = []string{pwd}
 			err = t.db.UpdateFolder(*fd, true)
 			if err == nil {
-				err = t.save()
+				err = t.store.PutFolder(*t.db.Folder(folderName))
 			}
 		}
 		ret <- err
@@ -572,8 +1155,9 @@ func (t *torDropFileServer) RmFolderLogin(folderName, user string) error {
 				fd.Users = nil
 			}
 		}
+		err = t.db.UpdateFolder(*fd, true)
 		if err == nil {
-			err = t.save()
+			err = t.store.PutFolder(*t.db.Folder(folderName))
 		}
 		ret <- err
 	}
@@ -587,6 +1171,9 @@ func (t *torDropFileServer) WriteItem(folderName string, name string, content []
 	if name == "" {
 		return fmt.Errorf("file name must not be empty")
 	}
+	var old fileItem
+	var fd folder
+	var key []byte
 	ret := make(chan error)
 	t.ops <- func() {
 
@@ -600,7 +1187,7 @@ func (t *torDropFileServer) WriteItem(folderName string, name string, content []
 			return
 		}
 
-		fd := t.db.Folder(folderName)
+		x := t.db.Folder(folderName)
 		items, err := t.db.GetItems(folderName, true)
 		if err != nil {
 			ret <- err
@@ -608,61 +1195,190 @@ func (t *torDropFileServer) WriteItem(folderName string, name string, content []
 		}
 
 		fsize := uint64(len(content))
-		if fd.MaxFileSize != nil {
-			mfs := uint64(*fd.MaxFileSize)
+		if x.MaxFileSize != nil {
+			mfs := uint64(*x.MaxFileSize)
 			if fsize > mfs {
 				ret <- fmt.Errorf("the file too large, must not exceed %v", humanize.Bytes(mfs))
 				return
 			}
 		}
-		if fd.MaxFileCount != nil {
-			mfc := *fd.MaxFileCount
+		if x.MaxFileCount != nil {
+			mfc := *x.MaxFileCount
 			if uint64(len(items)+1) > mfc {
 				ret <- fmt.Errorf("this folder cannot accept more files")
 				return
 			}
 		}
-		if fd.MaxTotalSize != nil {
-			mts := uint64(*fd.MaxTotalSize)
+		if x.MaxTotalSize != nil {
+			mts := uint64(*x.MaxTotalSize)
 			curSize := items.Size()
 			if curSize+fsize > mts {
 				ret <- fmt.Errorf("file is too large, demands %v, only %v available", humanize.Bytes(fsize), humanize.Bytes(mts-curSize))
 				return
 			}
 		}
+		if x.Encrypted && x.Recipients == "" {
+			if key, err = t.folderKey(folderName); err != nil {
+				ret <- err
+				return
+			}
+		}
+		// the item is reserved while its content is written in the storage.
+		old, fd = item, *x
+		ret <- t.db.reserve(folderName, name)
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	item, pruned, err := t.writeContent(&fd, old, content, key)
+	t.ops <- func() {
+		defer t.db.release(folderName, name)
+		if err == nil {
+			err = t.db.UpdateItem(folderName, item)
+		}
+		if err == nil {
+			if err = t.store.PutItem(folderName, item); err != nil {
+				t.db.UpdateItem(folderName, old)
+			}
+		}
+		ret <- err
+	}
+	if err = <-ret; err != nil {
+		if fd.Versioning {
+			t.unarchiveVersion(folderName, old.Key(), old.asVersion())
+		}
+		return err
+	}
+	if old.OriginalSize > 0 {
+		t.storage.Delete(originalKey(folderName, old.Key()))
+	}
+	if err := t.deleteVersions(folderName, old.Key(), pruned); err != nil {
+		t.logger.Error("file %q versions cleaning error: %v", old.Name, err)
+	}
+	return nil
+}
 
-		fpath := filepath.Join(t.conf.StorageDir, folderName, item.Name)
-		os.Remove(fpath)
-		err = ioutil.WriteFile(fpath, content, os.ModePerm)
+// writeContent replaces the content of the item old, the versioned folders
+// copy it to its version key first so that it remains readable meanwhile.
+// It returns the new item and its pruned versions.
+func (t *torDropFileServer) writeContent(fd *folder, old fileItem, content, key []byte) (fileItem, []fileItem, error) {
+	item := old
+	data := content
+	item.Encrypted = false
+	item.Sealed = ""
+	item.Sanitizers = nil
+	item.OriginalSize = 0
+	sums := newChecksums(item.BLAKE2b != "")
+	sums.Write(content)
+	item.SHA256, item.BLAKE2b = sums.Sums()
+	item.MIME = sniffType(content)
+	seal, err := parseRecipients(fd.Recipients)
+	if err != nil {
+		return item, nil, err
+	}
+	if seal != nil {
+		var b bytes.Buffer
+		var w io.WriteCloser
+		if w, err = seal.Seal(&b, item.Name); err == nil {
+			if _, err = w.Write(content); err == nil {
+				err = w.Close()
+			}
+		}
 		if err != nil {
-			os.Remove(fpath)
-			ret <- err
-			return
+			return item, nil, err
 		}
+		data = b.Bytes()
+		item.Sealed = seal.Format
+		item.SealedSize = uint64(len(data))
+	} else if key != nil {
+		if data, err = encryptBytes(content, key); err != nil {
+			return item, nil, err
+		}
+		item.Encrypted = true
+	}
 
-		item.Size = fsize
-		item.CreateDate = time.Now()
-
-		ret <- t.db.AddItem(folderName, item)
+	objKey := storageKey(fd.Name, item.Key())
+	var pruned []fileItem
+	if fd.Versioning {
+		v := old.asVersion()
+		if err = copyObject(t.storage, objKey, itemVersionKey(fd.Name, item.Key(), v.Version)); err != nil {
+			return item, nil, err
+		}
+		item.Version = old.nextVersion()
+		item.Versions = append(append([]fileItem{}, old.Versions...), v)
+		pruned = pruneVersions(fd, &item)
 	}
-	return <-ret
+	if err = t.storage.Put(objKey, bytes.NewReader(data), int64(len(data))); err != nil {
+		if fd.Versioning {
+			t.storage.Delete(itemVersionKey(fd.Name, item.Key(), old.CurrentVersion()))
+		}
+		return item, nil, err
+	}
+	item.Size = uint64(len(content))
+	item.Uploaded = item.Size
+	item.CreateDate = time.Now()
+	return item, pruned, nil
+}
+
+func (t *torDropFileServer) OpenItem(folderName string, fileName string) (fileItem, io.ReadCloser, error) {
+	return t.OpenContent(folderName, fileName, openOptions{})
 }
 
-func (t *torDropFileServer) OpenItem(folderName string, fileName string) (io.ReadCloser, error) {
+// openOptions select the content of an item to open.
+type openOptions struct {
+	// Original is the original content of a sanitized item.
+	Original bool
+	// Version is an older version of the item.
+	Version int
+	// Offset skips the beginning of the content.
+	Offset int64
+	// Count counts the download against the download limit of the item.
+	Count bool
+}
+
+// OpenContent opens the content of an item selected by opts,
+// the returned item describes the content.
+func (t *torDropFileServer) OpenContent(folderName string, fileName string, opts openOptions) (fileItem, io.ReadCloser, error) {
+	original, version := opts.Original, opts.Version
 	if folderName == "" {
-		return nil, fmt.Errorf("folder name must not be empty")
+		return fileItem{}, nil, fmt.Errorf("folder name must not be empty")
 	}
 	if fileName == "" {
-		return nil, fmt.Errorf("file name must not be empty")
+		return fileItem{}, nil, fmt.Errorf("file name must not be empty")
 	}
-	var src io.ReadCloser
+	var item fileItem
+	var limit *folderManager
+	var key []byte
 	ret := make(chan error)
 	t.ops <- func() {
-		item, err := t.db.GetItem(folderName, fileName)
+		var err error
+		item, err = t.db.GetItem(folderName, fileName)
 		if err != nil {
 			ret <- err
 			return
 		}
+		if item.Broken != "" {
+			ret <- fmt.Errorf("file %q is broken: %v", fileName, item.Broken)
+			return
+		}
+		if original && item.OriginalSize == 0 {
+			ret <- fmt.Errorf("file %q has no original content", fileName)
+			return
+		}
+		if version > 0 && version != item.CurrentVersion() {
+			if item, err = item.GetVersion(version); err != nil {
+				ret <- err
+				return
+			}
+		} else {
+			version = 0
+		}
+		if item.Encrypted {
+			if key, err = t.folderKey(folderName); err != nil {
+				ret <- err
+				return
+			}
+		}
 
 		fd := t.db.Folder(folderName)
 		if fd == nil {
@@ -678,25 +1394,91 @@ func (t *torDropFileServer) OpenItem(folderName string, fileName string) (io.Rea
 				return
 			}
 		}
+		if opts.Count && !original && version == 0 {
+			if err := t.countDownload(fd, &item); err != nil {
+				ret <- err
+				return
+			}
+		}
 		t.activeDownloads[fd.Name]++
+		limit = t.folderUploadManagers[folderName]
+		ret <- nil
+	}
+	if err := <-ret; err != nil {
+		return item, nil, err
+	}
 
-		fpath := filepath.Join(t.conf.StorageDir, folderName, item.Name)
-		src, err = os.Open(fpath)
-		src = t.getUploadReader(folderName, src)
-		src = &readDownloader{
-			ReadCloser: src,
-			fd:         fd.Name,
-			fs:         t,
+	objKey := storageKey(folderName, item.Key())
+	if original {
+		objKey = originalKey(folderName, item.Key())
+	} else if version > 0 {
+		objKey = itemVersionKey(folderName, item.Key(), version)
+	}
+	// the encrypted contents are skipped once decrypted.
+	skip := opts.Offset
+	var src io.ReadCloser
+	var err error
+	if r, ok := t.storage.(storageRanger); ok && key == nil && skip > 0 {
+		src, err = r.OpenAt(objKey, skip)
+		skip = 0
+	} else {
+		src, err = t.storage.Open(objKey)
+	}
+	if err == nil && key != nil {
+		var r io.Reader
+		if r, err = newDecryptReader(src, key); err == nil {
+			src = readCloser{Closer: src, Reader: r}
+		} else {
+			src.Close()
 		}
-		ret <- err
 	}
-	return src, <-ret
+	if err == nil && skip > 0 {
+		if _, err = io.CopyN(ioutil.Discard, src, skip); err != nil {
+			src.Close()
+		}
+	}
+	if err != nil {
+		t.ops <- func() {
+			if t.activeDownloads[folderName] > 0 {
+				t.activeDownloads[folderName]--
+			}
+		}
+		if opts.Count && !original && version == 0 {
+			t.uncountDownload(folderName, item)
+		}
+		return item, nil, err
+	}
+	if limit != nil {
+		src = readCloser{Closer: src, Reader: limit.NewReader(src)}
+	}
+	cr := &cancelReader{ReadCloser: src}
+	tr := &transfer{
+		Kind:   transferDownload,
+		Folder: folderName,
+		Name:   item.Key(),
+		bytes:  cr.Bytes,
+		cancel: cr.Cancel,
+	}
+	if size := item.ServedSize(original); uint64(opts.Offset) < size {
+		tr.Size = size - uint64(opts.Offset)
+	}
+	t.ops <- func() {
+		t.addTransfer(tr)
+	}
+	src = &readDownloader{
+		ReadCloser: cr,
+		fd:         folderName,
+		fs:         t,
+		tr:         tr,
+	}
+	return item, src, nil
 }
 
 type readDownloader struct {
 	io.ReadCloser
 	fd string
 	fs *torDropFileServer
+	tr *transfer
 }
 
 func (r *readDownloader) Close() error {
@@ -704,6 +1486,7 @@ func (r *readDownloader) Close() error {
 		if r.fs.activeDownloads[r.fd] > 0 {
 			r.fs.activeDownloads[r.fd]--
 		}
+		delete(r.fs.transfers, r.tr.ID)
 	}
 	return r.ReadCloser.Close()
 }
@@ -713,16 +1496,51 @@ type readCloser struct {
 	io.Reader
 }
 
-func (t *torDropFileServer) UploadItem(folderName string, item fileItem, src io.ReadCloser) error {
+// uploadOptions are the properties of an upload which are not stored with its item.
+type uploadOptions struct {
+	// Owner identifies the uploader, the progress of the upload is only reported to him.
+	Owner string
+	// Resumable uploads are not reaped when inactive, their src must be closed instead.
+	Resumable bool
+}
+
+// UploadItem stores the content of src as item within the folder.
+// The checksums set on item are the expected ones, the upload fails on mismatch.
+// When item.Size is zero the size is unknown, src is read until the folder limits
+// are exceeded and the item takes the size actually received.
+// It returns the item as named by the collision policy of the folder.
+func (t *torDropFileServer) UploadItem(folderName string, item fileItem, src io.ReadCloser, opts uploadOptions) (fileItem, error) {
+	item, done, err := t.startUpload(folderName, item, src, opts)
+	if err != nil {
+		return item, err
+	}
+	return item, <-done
+}
+
+// startUpload checks and registers the upload of item, the content of src
+// is then copied in the background and done receives the result of the upload.
+// The returned item is named by the collision policy of the folder.
+func (t *torDropFileServer) startUpload(folderName string, item fileItem, src io.ReadCloser, opts uploadOptions) (started fileItem, done <-chan error, err error) {
 	if folderName == "" {
-		return fmt.Errorf("folder name must not be empty")
+		return item, nil, fmt.Errorf("folder name must not be empty")
 	}
 	if item.Name == "" {
-		return fmt.Errorf("file name must not be empty")
+		return item, nil, fmt.Errorf("file name must not be empty")
+	}
+	if strings.ContainsAny(item.Name, "/\\") {
+		return item, nil, fmt.Errorf("invalid file name %q", item.Name)
 	}
-	if item.Size < 1 {
-		return fmt.Errorf("content length must be greater than zero")
+	item.Path = cleanDir(item.Path)
+	if isReservedKey(item.Key()) {
+		return item, nil, fmt.Errorf("file name %q is reserved", item.Name)
 	}
+	// a full or unwritable temporary directory rejects the upload.
+	tfile, err := ioutil.TempFile(t.conf.TmpDir, "tor-drop")
+	if err != nil {
+		t.logger.Error("failed to create the temporary file of %v/%v: %v", folderName, item.Name, err)
+		return item, nil, fmt.Errorf("the upload could not be stored, try again later")
+	}
+	result := make(chan error, 1)
 	ret := make(chan error)
 	t.ops <- func() {
 
@@ -739,23 +1557,43 @@ func (t *torDropFileServer) UploadItem(folderName string, item fileItem, src io.
 			return
 		}
 
-		items, err := t.db.GetItems(folderName, true)
-		if err != nil {
+		if !t.db.HasDir(folderName, item.Path) {
+			ret <- fmt.Errorf("directory %q not found in folder %q", item.Path, folderName)
+			return
+		}
+
+		var err error
+		if item, err = t.db.resolveName(fd, item); err != nil {
 			ret <- err
 			return
 		}
-		if items.Has(item.Name) {
-			ret <- fmt.Errorf("file %q already exists or being uploaded", item.Name)
+		all, err := t.db.GetItems(folderName, true)
+		if err != nil {
+			ret <- err
 			return
 		}
+		// the overwritten item does not count in the limits.
+		var items fileItems
+		for _, i := range all {
+			if i.Key() != item.Key() {
+				items = append(items, i)
+			}
+		}
 
 		fsize := item.Size
+		// the limit of a streamed upload, and the error once exceeded.
+		limit := item.Size
+		var limitErr error
 		if fd.MaxFileSize != nil {
 			mfs := uint64(*fd.MaxFileSize)
 			if fsize > mfs && mfs > 0 {
 				ret <- fmt.Errorf("the file too large, must not exceed %v", humanize.Bytes(mfs))
 				return
 			}
+			if limit == 0 && mfs > 0 {
+				limit = mfs
+				limitErr = fmt.Errorf("the file too large, must not exceed %v", humanize.Bytes(mfs))
+			}
 		}
 		if fd.MaxFileCount != nil {
 			mfc := *fd.MaxFileCount
@@ -771,52 +1609,194 @@ func (t *torDropFileServer) UploadItem(folderName string, item fileItem, src io.
 				ret <- fmt.Errorf("file is too large, demands %v, only %v available", humanize.Bytes(fsize), humanize.Bytes(mts-curSize))
 				return
 			}
+			if item.Size == 0 && mts > 0 {
+				if curSize >= mts {
+					ret <- fmt.Errorf("file is too large, only %v available", humanize.Bytes(0))
+					return
+				}
+				if limit == 0 || mts-curSize < limit {
+					limit = mts - curSize
+					limitErr = fmt.Errorf("file is too large, only %v available", humanize.Bytes(limit))
+				}
+			}
+		}
+
+		seal, err := parseRecipients(fd.Recipients)
+		if err != nil {
+			ret <- err
+			return
+		}
+		types, err := newTypePolicy(fd)
+		if err != nil {
+			ret <- err
+			return
+		}
+		var key []byte
+		if fd.Encrypted && seal == nil {
+			if key, err = t.folderKey(fd.Name); err != nil {
+				ret <- err
+				return
+			}
+		}
+		item.Encrypted = key != nil
+		item.Sealed = ""
+		if seal != nil {
+			item.Sealed = seal.Format
 		}
 
-		src = t.getDownloadReader(fd.Name, src)
+		cr := &cancelReader{ReadCloser: src}
+		tr := &transfer{
+			Kind:   transferUpload,
+			Folder: folderName,
+			Name:   item.Key(),
+			Size:   item.Size,
+			bytes:  cr.Bytes,
+			cancel: cr.Cancel,
+		}
+		t.addTransfer(tr)
+		src = t.getDownloadReader(fd.Name, cr)
 
 		var up fileUpload
 		up.Completed = make(chan error)
 		up.File = item
 		up.Folder = folderName
 		up.LastActive = time.Now()
+		up.Resumable = opts.Resumable
+		up.Owner = opts.Owner
+		up.StartDate = up.LastActive
 		t.db.Uploads = append(t.db.Uploads, up)
+		ret <- nil
 
 		go func() {
-			tfile, _ := ioutil.TempFile(t.conf.TmpDir, "tor-drop")
 			defer tfile.Close()
 			up.TmpFile = tfile.Name()
-			dc := datacounter.NewWriterCounter(tfile)
-			errC := make(chan error)
+			// only the sealed content is written when the folder has recipients.
+			stored := datacounter.NewWriterCounter(tfile)
+			var w io.Writer = stored
+			var enc io.WriteCloser
+			var err error
+			if seal != nil {
+				enc, err = seal.Seal(stored, item.Name)
+				w = enc
+			} else if key != nil {
+				enc, err = newEncryptWriter(stored, key)
+				w = enc
+			}
+			sums := newChecksums(t.conf.BLAKE2b || item.BLAKE2b != "")
+			dc := datacounter.NewWriterCounter(io.MultiWriter(w, sums))
+			errC := make(chan error, 1)
+			var mimeType, quarantine string
 			go func() {
 				defer src.Close()
-				_, err := io.Copy(dc, src)
+				// the type is sniffed from the first bytes, before anything is stored.
+				var head []byte
+				if err == nil {
+					head, err = readHead(src)
+				}
+				if err == nil {
+					mimeType = sniffType(head)
+					// the messages are text whatever the types of the folder.
+					if !item.Message {
+						quarantine, err = types.check(item.Name, mimeType)
+					}
+				}
+				if err != nil {
+					errC <- err
+					return
+				}
+				in := io.MultiReader(bytes.NewReader(head), src)
+				var n int64
+				if limit > 0 {
+					// one more byte tells whether the limit is exceeded.
+					n, err = io.Copy(dc, io.LimitReader(in, int64(limit)+1))
+				} else {
+					n, err = io.Copy(dc, in)
+				}
+				switch {
+				case err != nil:
+				case uint64(n) > limit && limit > 0 && item.Size == 0:
+					err = limitErr
+				case uint64(n) > limit && limit > 0:
+					err = fmt.Errorf("upload exceeds its length of %v bytes", item.Size)
+				case n == 0:
+					err = fmt.Errorf("content length must be greater than zero")
+				case uint64(n) < item.Size:
+					err = fmt.Errorf("upload ended after %v of %v bytes", n, item.Size)
+				}
+				if err == nil && enc != nil {
+					err = enc.Close()
+				}
 				errC <- err
 			}()
 			var d bool
+			copying := true
 			for !d {
+				// progress is not reported anymore once the copy ended.
+				var tick <-chan time.Time
+				if copying {
+					tick = time.After(time.Second)
+				}
 				select {
-				case <-time.After(time.Second):
+				case <-tick:
 					up.LastActive = time.Now()
 					up.File.Uploaded = dc.Count()
+					if item.Size == 0 {
+						up.File.Size = up.File.Uploaded
+					}
 					t.uploadEvents <- up
 				case err := <-up.Completed:
-					ret <- err
+					result <- err
 					d = true
 				case err := <-errC:
+					copying = false
+					up.Done = true
 					up.LastActive = time.Now()
 					up.File.Uploaded = dc.Count()
+					if item.Size == 0 {
+						up.File.Size = up.File.Uploaded
+					}
+					up.File.SHA256, up.File.BLAKE2b = sums.Sums()
+					up.File.MIME, up.File.Quarantine = mimeType, quarantine
+					if seal != nil {
+						up.File.SealedSize = stored.Count()
+					}
+					if err == nil {
+						err = verifyChecksums(item, up.File)
+					}
 					up.Error = err
 					t.uploadEvents <- up
 				}
 			}
+			t.endTransfer(tr.ID)
 		}()
 	}
-	return <-ret
+	if err = <-ret; err != nil {
+		tfile.Close()
+		os.Remove(tfile.Name())
+	}
+	return item, result, err
 }
 
+// HasUpload reports whether the item is being uploaded, or reserved.
 func (t *torDropDB) HasUpload(folderName string, name string) bool {
-	return t.Uploads.Has(folderName, name)
+	return t.Uploads.Has(folderName, name) || t.reserved[folderName+"/"+name]
+}
+
+// reserve holds the key of an item while its content is changed in the storage,
+// outside of the ops routine. The reserved keys count as being uploaded.
+func (t *torDropDB) reserve(folderName, key string) error {
+	if t.HasUpload(folderName, key) {
+		return fmt.Errorf("file %q is being uploaded", key)
+	}
+	if t.reserved == nil {
+		t.reserved = map[string]bool{}
+	}
+	t.reserved[folderName+"/"+key] = true
+	return nil
+}
+
+func (t *torDropDB) release(folderName, key string) {
+	delete(t.reserved, folderName+"/"+key)
 }
 
 func (t *torDropDB) GetFolders() folders {
@@ -835,7 +1815,7 @@ func (t *torDropDB) ClearUploads(each func(fileUpload)) {
 func (t *torDropDB) ClearLifetimeExceededUploads(lifetime time.Duration, exceeded func(fileUpload)) {
 	var n fileUploads
 	for _, up := range t.Uploads {
-		if up.LastActive.Add(lifetime).Before(time.Now()) {
+		if !up.Committing && !up.Resumable && up.LastActive.Add(lifetime).Before(time.Now()) {
 			exceeded(up)
 			continue
 		}
@@ -876,6 +1856,34 @@ func (t *torDropDB) UploadEventNewer(ev fileUpload) bool {
 	return t.Uploads.UpdateNewer(ev)
 }
 
+// FitsFolder checks that the stored items of the folder leave enough
+// room for item, the size of a streamed upload is only known once received.
+func (t *torDropDB) FitsFolder(folderName string, item fileItem) error {
+	fd := t.Folder(folderName)
+	if fd == nil {
+		return fmt.Errorf("folder %q does not exist", folderName)
+	}
+	if fd.MaxTotalSize == nil || *fd.MaxTotalSize == 0 {
+		return nil
+	}
+	items, err := t.GetItems(folderName, false)
+	if err != nil {
+		return err
+	}
+	mts := uint64(*fd.MaxTotalSize)
+	// the item replaced by an overwrite does not count.
+	var curSize uint64
+	for _, i := range items {
+		if i.Key() != item.Key() {
+			curSize += i.Size
+		}
+	}
+	if curSize+item.Size > mts {
+		return fmt.Errorf("this folder cannot accept more data")
+	}
+	return nil
+}
+
 func (t *torDropDB) UploadCount(folderName string) int {
 	if folderName == "" {
 		return len(t.Uploads)
@@ -930,6 +1938,135 @@ func (t *torDropDB) GetItem(folderName string, name string) (fileItem, error) {
 	return f, nil
 }
 
+// cleanDir returns the absolute slash separated form of the directory p.
+func cleanDir(p string) string {
+	return path.Clean("/" + strings.Replace(p, "\\", "/", -1))
+}
+
+func (t *torDropDB) HasDir(folderName, dir string) bool {
+	dir = cleanDir(dir)
+	if dir == "/" {
+		return t.Folder(folderName) != nil
+	}
+	for _, d := range t.Dirs[folderName] {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDirs returns the direct sub directories of dir.
+func (t *torDropDB) GetDirs(folderName, dir string) []string {
+	dir = cleanDir(dir)
+	var ret []string
+	for _, d := range t.Dirs[folderName] {
+		if path.Dir(d) == dir {
+			ret = append(ret, d)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (t *torDropDB) AddDir(folderName, dir string) error {
+	dir = cleanDir(dir)
+	if t.Folder(folderName) == nil {
+		return fmt.Errorf("folder %q does not exist", folderName)
+	}
+	if dir == "/" {
+		return fmt.Errorf("directory name must not be empty")
+	}
+	if isReservedKey(dir) {
+		return fmt.Errorf("directory name %q is reserved", path.Base(dir))
+	}
+	if !t.HasDir(folderName, path.Dir(dir)) {
+		return fmt.Errorf("directory %q not found in folder %q", path.Dir(dir), folderName)
+	}
+	items, _ := t.GetItems(folderName, true)
+	if t.HasDir(folderName, dir) || items.Has(strings.TrimPrefix(dir, "/")) {
+		return fmt.Errorf("%q already exists in folder %q", dir, folderName)
+	}
+	t.Dirs[folderName] = append(t.Dirs[folderName], dir)
+	return nil
+}
+
+// RmDir removes dir, its sub directories and their items, it returns what was removed.
+func (t *torDropDB) RmDir(folderName, dir string) (fileItems, []string, error) {
+	dir = cleanDir(dir)
+	if dir == "/" || !t.HasDir(folderName, dir) {
+		return nil, nil, fmt.Errorf("directory %q not found in folder %q", dir, folderName)
+	}
+	for _, up := range t.Uploads.Items(folderName) {
+		if isInDir(up.Path, dir) {
+			return nil, nil, fmt.Errorf("directory %q has uploads in progress", dir)
+		}
+	}
+	var rmItems fileItems
+	var items fileItems
+	for _, i := range t.Items[folderName] {
+		if isInDir(i.Path, dir) {
+			rmItems = append(rmItems, i)
+			continue
+		}
+		items = append(items, i)
+	}
+	var rmDirs []string
+	var dirs []string
+	for _, d := range t.Dirs[folderName] {
+		if isInDir(d, dir) {
+			rmDirs = append(rmDirs, d)
+			continue
+		}
+		dirs = append(dirs, d)
+	}
+	t.Items[folderName] = items
+	t.Dirs[folderName] = dirs
+	return rmItems, rmDirs, nil
+}
+
+// RenameDir renames dir to the directory to within the same parent directory,
+// it returns the moved items as pairs of previous and new values.
+func (t *torDropDB) RenameDir(folderName, dir, to string) ([][2]fileItem, error) {
+	dir = cleanDir(dir)
+	if dir == "/" || !t.HasDir(folderName, dir) {
+		return nil, fmt.Errorf("directory %q not found in folder %q", dir, folderName)
+	}
+	to = cleanDir(to)
+	if to == "/" || path.Dir(to) != path.Dir(dir) || isReservedKey(to) {
+		return nil, fmt.Errorf("invalid directory name %q", path.Base(to))
+	}
+	items, _ := t.GetItems(folderName, true)
+	if t.HasDir(folderName, to) || items.Has(strings.TrimPrefix(to, "/")) {
+		return nil, fmt.Errorf("%q already exists in folder %q", to, folderName)
+	}
+	for _, up := range t.Uploads.Items(folderName) {
+		if isInDir(up.Path, dir) {
+			return nil, fmt.Errorf("directory %q has uploads in progress", dir)
+		}
+	}
+	var moved [][2]fileItem
+	for i, item := range t.Items[folderName] {
+		if isInDir(item.Path, dir) {
+			n := item
+			n.Path = to + strings.TrimPrefix(item.Path, dir)
+			t.Items[folderName][i] = n
+			moved = append(moved, [2]fileItem{item, n})
+		}
+	}
+	for i, d := range t.Dirs[folderName] {
+		if isInDir(d, dir) {
+			t.Dirs[folderName][i] = to + strings.TrimPrefix(d, dir)
+		}
+	}
+	return moved, nil
+}
+
+// isInDir reports whether p is dir or one of its sub directories.
+func isInDir(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
 func (t *torDropDB) RmFolder(name string) error {
 	if !t.Folders.Has(name) {
 		return fmt.Errorf("folder %q not found", name)
@@ -942,6 +2079,9 @@ func (t *torDropDB) RmFolder(name string) error {
 		n = append(n, f)
 	}
 	delete(t.Items, name)
+	delete(t.Dirs, name)
+	delete(t.Sources, name)
+	delete(t.Trash, name)
 	t.Folders = n
 	return nil
 }
@@ -956,7 +2096,7 @@ func (t *torDropDB) RmItem(folderName, name string) error {
 	}
 	var n []fileItem
 	for _, i := range t.Items[folderName] {
-		if i.Name == name {
+		if i.Key() == name {
 			continue
 		}
 		n = append(n, i)
@@ -991,6 +2131,16 @@ func (t *torDropDB) AddItem(folderName string, item fileItem) error {
 	return nil
 }
 
+func (t *torDropDB) UpdateItem(folderName string, item fileItem) error {
+	for i, x := range t.Items[folderName] {
+		if x.Key() == item.Key() {
+			t.Items[folderName][i] = item
+			return nil
+		}
+	}
+	return fmt.Errorf("file %q not found in folder %q", item.Key(), folderName)
+}
+
 func (t *torDropDB) CreateFolder(fd folder) error {
 	fd.Name = t.clean(fd.Name)
 	if fd.Name == "" {
@@ -999,6 +2149,9 @@ func (t *torDropDB) CreateFolder(fd folder) error {
 	if t.Folders.Has(fd.Name) {
 		return fmt.Errorf("folder %q already exists", fd.Name)
 	}
+	if t.IsTrashed(fd.Name) {
+		return fmt.Errorf("folder %q is in the trash", fd.Name)
+	}
 	fd.CreateDate = time.Now()
 	t.Folders = append(t.Folders, fd)
 	return nil
@@ -1008,7 +2161,7 @@ type fileUploads []fileUpload
 
 func (f fileUploads) Remove(up fileUpload) (n fileUploads) {
 	for _, fd := range f {
-		if fd.Folder == up.Folder && fd.File.Name == up.File.Name {
+		if fd.Folder == up.Folder && fd.File.Key() == up.File.Key() {
 			continue
 		}
 		n = append(n, fd)
@@ -1018,7 +2171,7 @@ func (f fileUploads) Remove(up fileUpload) (n fileUploads) {
 
 func (f fileUploads) Has(folderName, name string) bool {
 	for _, fd := range f {
-		if fd.Folder == folderName && fd.File.Name == name {
+		if fd.Folder == folderName && fd.File.Key() == name {
 			return true
 		}
 	}
@@ -1027,7 +2180,7 @@ func (f fileUploads) Has(folderName, name string) bool {
 
 func (f fileUploads) Get(folderName, name string) fileUpload {
 	for _, fd := range f {
-		if fd.Folder == folderName && fd.File.Name == name {
+		if fd.Folder == folderName && fd.File.Key() == name {
 			return fd
 		}
 	}
@@ -1036,7 +2189,7 @@ func (f fileUploads) Get(folderName, name string) fileUpload {
 
 func (f fileUploads) Update(up fileUpload) bool {
 	for i, fd := range f {
-		if fd.Folder == up.Folder && fd.File.Name == up.File.Name {
+		if fd.Folder == up.Folder && fd.File.Key() == up.File.Key() {
 			f[i] = up
 			return true
 		}
@@ -1046,7 +2199,7 @@ func (f fileUploads) Update(up fileUpload) bool {
 
 func (f fileUploads) UpdateNewer(up fileUpload) bool {
 	for i, fd := range f {
-		if fd.Folder == up.Folder && fd.File.Name == up.File.Name && fd.LastActive.Before(up.LastActive) {
+		if fd.Folder == up.Folder && fd.File.Key() == up.File.Key() && fd.LastActive.Before(up.LastActive) {
 			f[i] = up
 			return true
 		}
@@ -1126,24 +2279,36 @@ func (f folders) Set(fd folder) {
 
 type fileItems []fileItem
 
-func (f fileItems) Has(name string) bool {
+func (f fileItems) Has(key string) bool {
 	for _, fd := range f {
-		if fd.Name == name {
+		if fd.Key() == key {
 			return true
 		}
 	}
 	return false
 }
 
-func (f fileItems) Get(name string) fileItem {
+func (f fileItems) Get(key string) fileItem {
 	for _, fd := range f {
-		if fd.Name == name {
+		if fd.Key() == key {
 			return fd
 		}
 	}
 	return fileItem{}
 }
 
+// In returns the items located in the directory dir.
+func (f fileItems) In(dir string) fileItems {
+	dir = cleanDir(dir)
+	var n fileItems
+	for _, fd := range f {
+		if cleanDir(fd.Path) == dir {
+			n = append(n, fd)
+		}
+	}
+	return n
+}
+
 func (f fileItems) Size() (curSize uint64) {
 	for _, i := range f {
 		curSize += i.Size
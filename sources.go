@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sethvargo/go-diceware/diceware"
+)
+
+// codenameWords is the number of diceware words of a codename.
+const codenameWords = 7
+
+// maxReplyLen bounds the length of a reply to a source.
+const maxReplyLen = 64 << 10
+
+// source is an anonymous uploader of a folder, it comes back with its codename.
+// Only a hash of the codename is stored, it identifies the source.
+type source struct {
+	ID         string
+	CreateDate time.Time
+	Replies    []sourceReply `json:",omitempty"`
+}
+
+// sourceReply is a message written by an administrator to a source.
+type sourceReply struct {
+	Date time.Time
+	Text string
+}
+
+func newCodename() (string, error) {
+	words, err := diceware.Generate(codenameWords)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate a codename: %v", err)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// sourceID returns the id of the source of a folder with the given codename,
+// the case and the spaces of the codename do not matter.
+func sourceID(folderName, codename string) string {
+	codename = strings.Join(strings.Fields(strings.ToLower(codename)), " ")
+	h := sha256.Sum256([]byte(folderName + "\x00" + codename))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateSource creates a new source of the folder, the codename is returned only once.
+func (t *torDropFileServer) CreateSource(folderName string) (source, string, error) {
+	codename, err := newCodename()
+	if err != nil {
+		return source{}, "", err
+	}
+	src := source{ID: sourceID(folderName, codename), CreateDate: time.Now()}
+	ret := make(chan error)
+	t.ops <- func() {
+		err := t.db.AddSource(folderName, src)
+		if err == nil {
+			err = t.store.PutSource(folderName, src)
+			if err != nil {
+				t.db.RmSource(folderName, src.ID)
+			}
+		}
+		ret <- err
+	}
+	return src, codename, <-ret
+}
+
+// SourceByCodename returns the source of the folder with the given codename.
+func (t *torDropFileServer) SourceByCodename(folderName, codename string) (source, error) {
+	src, err := t.Source(folderName, sourceID(folderName, codename))
+	if err != nil {
+		return src, fmt.Errorf("unknown codename")
+	}
+	return src, nil
+}
+
+func (t *torDropFileServer) Source(folderName, id string) (source, error) {
+	var src source
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		src, err = t.db.GetSource(folderName, id)
+		ret <- err
+	}
+	return src, <-ret
+}
+
+func (t *torDropFileServer) Sources(folderName string) []source {
+	ret := make(chan []source)
+	t.ops <- func() {
+		ret <- append([]source{}, t.db.Sources[folderName]...)
+	}
+	return <-ret
+}
+
+// ReplySource adds the reply of an administrator to a source.
+func (t *torDropFileServer) ReplySource(folderName, id, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("the reply must not be empty")
+	}
+	if len(text) > maxReplyLen {
+		return fmt.Errorf("the reply is too long, it must not exceed %v bytes", maxReplyLen)
+	}
+	ret := make(chan error)
+	t.ops <- func() {
+		src, err := t.db.GetSource(folderName, id)
+		if err != nil {
+			ret <- err
+			return
+		}
+		src.Replies = append(src.Replies, sourceReply{Date: time.Now(), Text: text})
+		err = t.store.PutSource(folderName, src)
+		if err == nil {
+			err = t.db.UpdateSource(folderName, src)
+		}
+		ret <- err
+	}
+	return <-ret
+}
+
+func (t *torDropDB) AddSource(folderName string, src source) error {
+	if t.Folder(folderName) == nil {
+		return fmt.Errorf("folder %q does not exist", folderName)
+	}
+	if _, err := t.GetSource(folderName, src.ID); err == nil {
+		return fmt.Errorf("source %q already exists", src.ID)
+	}
+	if t.Sources == nil {
+		t.Sources = map[string][]source{}
+	}
+	t.Sources[folderName] = append(t.Sources[folderName], src)
+	return nil
+}
+
+func (t *torDropDB) GetSource(folderName, id string) (source, error) {
+	for _, s := range t.Sources[folderName] {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return source{}, fmt.Errorf("source %q not found in folder %q", id, folderName)
+}
+
+func (t *torDropDB) UpdateSource(folderName string, src source) error {
+	for i, s := range t.Sources[folderName] {
+		if s.ID == src.ID {
+			t.Sources[folderName][i] = src
+			return nil
+		}
+	}
+	return fmt.Errorf("source %q not found in folder %q", src.ID, folderName)
+}
+
+func (t *torDropDB) RmSource(folderName, id string) {
+	var n []source
+	for _, s := range t.Sources[folderName] {
+		if s.ID != id {
+			n = append(n, s)
+		}
+	}
+	t.Sources[folderName] = n
+}
+
+// uploadSource returns the source of the session tagging the uploads to a folder
+// with codenames, a source is created on the first upload and its codename
+// is flashed to the session.
+func (t *torDropApp) uploadSource(fd *folder, w http.ResponseWriter, r *http.Request) (string, error) {
+	if t.isAdmin || !fd.Codenames {
+		return "", nil
+	}
+	if id := t.sessionSource(fd.Name, r); id != "" {
+		return id, nil
+	}
+	src, codename, err := t.fs.CreateSource(fd.Name)
+	if err != nil {
+		return "", err
+	}
+	sess, _ := t.session.Get(r, "source")
+	sess.Values[fd.Name] = src.ID
+	sess.AddFlash(codename, "codename-"+fd.Name)
+	if err := t.session.Save(r, w, sess); err != nil {
+		t.logger.Error("failed to save session store source: %v", err)
+	}
+	return src.ID, nil
+}
+
+// loggedSource returns the source of the session tagging the tus and the PUT
+// uploads to a folder with codenames, they cannot show a new codename
+// so the anonymous ones are refused.
+func (t *torDropApp) loggedSource(fd *folder, r *http.Request) (string, error) {
+	if t.isAdmin || !fd.Codenames {
+		return "", nil
+	}
+	if id := t.sessionSource(fd.Name, r); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("folder %q gives codenames to its sources, upload with the form or log in with your codename first", fd.Name)
+}
+
+// sessionSource returns the source logged in the session for the folder.
+func (t *torDropApp) sessionSource(folderName string, r *http.Request) string {
+	sess, err := t.session.Get(r, "source")
+	if err != nil {
+		return ""
+	}
+	id, _ := sess.Values[folderName].(string)
+	return id
+}
+
+// newCodenameFlash returns the codename created for the session, once.
+func (t *torDropApp) newCodenameFlash(folderName string, w http.ResponseWriter, r *http.Request) string {
+	sess, err := t.session.Get(r, "source")
+	if err != nil {
+		return ""
+	}
+	flashes := sess.Flashes("codename-" + folderName)
+	if len(flashes) == 0 {
+		return ""
+	}
+	if err := t.session.Save(r, w, sess); err != nil {
+		t.logger.Error("failed to save session store source: %v", err)
+	}
+	codename, _ := flashes[0].(string)
+	return codename
+}
+
+// SourceLogin lets a source log in with its codename to read the replies
+// and to list its uploads.
+func (t *torDropApp) SourceLogin(w http.ResponseWriter, r *http.Request) {
+	folderName := mux.Vars(r)["folder"]
+	fd := t.fs.Folder(folderName)
+	if fd == nil || !fd.Codenames {
+		http.NotFound(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err == nil && !t.assetAuth(folderName, fd, w, r) {
+		return
+	}
+
+	if err == nil && r.Method == http.MethodPost {
+		sess, _ := t.session.Get(r, "source")
+		switch r.Form.Get("action") {
+		case "codename":
+			var src source
+			src, err = t.fs.SourceByCodename(folderName, r.Form.Get("Codename"))
+			if err == nil {
+				sess.Values[folderName] = src.ID
+			}
+		case "logout":
+			delete(sess.Values, folderName)
+		}
+		if err == nil {
+			if err = t.session.Save(r, w, sess); err == nil {
+				http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+				return
+			}
+		}
+	}
+
+	var src *source
+	var items fileItems
+	if id := t.sessionSource(folderName, r); id != "" {
+		if s, e := t.fs.Source(folderName, id); e == nil {
+			src = &s
+			all, _ := t.fs.Items(folderName, false)
+			for _, i := range all {
+				if i.Source == id {
+					items = append(items, i)
+				}
+			}
+		}
+	}
+
+	data := map[string]interface{}{
+		"IsAdmin":  t.isAdmin,
+		"Request":  r,
+		"Folder":   fd,
+		"Source":   src,
+		"Items":    items,
+		"Codename": t.newCodenameFlash(folderName, w, r),
+		"Error":    err,
+		"Now":      time.Now(),
+	}
+	err = t.tpl.source.Execute(w, data)
+	if err != nil {
+		log.Printf("failed to serve source handler: %v\n", err)
+	}
+}
+
+// Sources lists the sources of a folder with their uploads,
+// the administrators reply to them.
+func (t *torDropApp) Sources(w http.ResponseWriter, r *http.Request) {
+	folderName := mux.Vars(r)["folder"]
+	fd := t.fs.Folder(folderName)
+	if fd == nil {
+		http.NotFound(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err == nil && r.Method == http.MethodPost && r.Form.Get("action") == "reply" {
+		err = t.fs.ReplySource(folderName, r.Form.Get("Source"), r.Form.Get("Text"))
+		if err == nil {
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+			return
+		}
+	}
+
+	type sourceItems struct {
+		source
+		Items fileItems
+	}
+	var sources []sourceItems
+	all, _ := t.fs.Items(folderName, false)
+	for _, s := range t.fs.Sources(folderName) {
+		x := sourceItems{source: s}
+		for _, i := range all {
+			if i.Source == s.ID {
+				x.Items = append(x.Items, i)
+			}
+		}
+		sources = append(sources, x)
+	}
+
+	data := map[string]interface{}{
+		"IsAdmin": t.isAdmin,
+		"Request": r,
+		"Folder":  fd,
+		"Sources": sources,
+		"Error":   err,
+		"Now":     time.Now(),
+	}
+	err = t.tpl.sources.Execute(w, data)
+	if err != nil {
+		log.Printf("failed to serve sources handler: %v\n", err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storage stores the content of the items,
+// keys are slash separated paths such as folder/name.
+type storage interface {
+	// Put stores size bytes read from src under key.
+	Put(key string, src io.Reader, size int64) error
+	Open(key string) (io.ReadCloser, error)
+	Stat(key string) (storageObject, error)
+	Delete(key string) error
+	// List returns the objects whose key starts with prefix.
+	List(prefix string) ([]storageObject, error)
+}
+
+// storageMover is implemented by storages able to
+// take ownership of a local file without copying it.
+type storageMover interface {
+	Move(fpath, key string) error
+}
+
+type storageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+func storageKey(folderName, name string) string {
+	return folderName + "/" + name
+}
+
+// putFile stores the local file fpath under key, fpath is removed.
+func putFile(s storage, fpath, key string) error {
+	if m, ok := s.(storageMover); ok {
+		return m.Move(fpath, key)
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fpath)
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Put(key, f, st.Size())
+}
+
+// storageRanger is implemented by storages able to
+// open an object from an offset without reading what precedes.
+type storageRanger interface {
+	OpenAt(key string, offset int64) (io.ReadCloser, error)
+}
+
+// storageRenamer is implemented by storages able to
+// change the key of an object without copying it.
+type storageRenamer interface {
+	Rename(from, to string) error
+}
+
+// moveObject changes the key of an object from from to to.
+func moveObject(s storage, from, to string) error {
+	if r, ok := s.(storageRenamer); ok {
+		return r.Rename(from, to)
+	}
+	if err := copyObject(s, from, to); err != nil {
+		return err
+	}
+	return s.Delete(from)
+}
+
+// copyObject copies the object from to the key to, an existing object
+// to is replaced once the copy is complete.
+func copyObject(s storage, from, to string) error {
+	o, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	src, err := s.Open(from)
+	if err != nil {
+		return err
+	}
+	err = s.Put(to, src, o.Size)
+	src.Close()
+	return err
+}
+
+// deletePrefix deletes all objects whose key starts with prefix.
+func deletePrefix(s storage, prefix string) error {
+	objects, err := s.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := s.Delete(o.Key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+const localTmpPrefix = ".tor-drop"
+
+// localStorage stores the objects as files within Dir.
+type localStorage struct {
+	Dir string
+}
+
+func (l localStorage) path(key string) (string, error) {
+	key = path.Clean("/" + key)
+	if key == "/" {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+func (l localStorage) Put(key string, src io.Reader, size int64) error {
+	fpath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fpath)
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, localTmpPrefix)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, src)
+	if err == nil && size > -1 && n != size {
+		err = fmt.Errorf("%v bytes written, expected %v", n, size)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (l localStorage) Move(src, key string) error {
+	fpath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return err
+	}
+	if os.Rename(src, fpath) == nil {
+		return nil
+	}
+	// src and Dir might live on different devices.
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src)
+	defer f.Close()
+	return l.Put(key, f, -1)
+}
+
+func (l localStorage) Rename(from, to string) error {
+	fpath, err := l.path(from)
+	if err != nil {
+		return err
+	}
+	if err = l.Move(fpath, to); err != nil {
+		return err
+	}
+	l.prune(filepath.Dir(fpath))
+	return nil
+}
+
+func (l localStorage) Open(key string) (io.ReadCloser, error) {
+	fpath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fpath)
+}
+
+func (l localStorage) OpenAt(key string, offset int64) (io.ReadCloser, error) {
+	fpath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l localStorage) Stat(key string) (storageObject, error) {
+	fpath, err := l.path(key)
+	if err != nil {
+		return storageObject{}, err
+	}
+	st, err := os.Stat(fpath)
+	if err != nil {
+		return storageObject{}, err
+	}
+	return storageObject{Key: key, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+// Delete removes the file of key and its parent directories once empty.
+func (l localStorage) Delete(key string) error {
+	fpath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(fpath); err != nil {
+		return err
+	}
+	l.prune(filepath.Dir(fpath))
+	return nil
+}
+
+// prune removes dir and its parent directories while they are empty.
+func (l localStorage) prune(dir string) {
+	root := filepath.Clean(l.Dir)
+	for ; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// List walks the directory of prefix only, or its parent directory
+// when prefix ends with a partial name.
+func (l localStorage) List(prefix string) ([]storageObject, error) {
+	var ret []storageObject
+	root := filepath.Clean(l.Dir)
+	start := root
+	if dir := path.Dir(prefix + "x"); dir != "." {
+		start = filepath.Join(root, filepath.FromSlash(dir))
+	}
+	err := filepath.Walk(start, func(fpath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && fpath == start {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), localTmpPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			ret = append(ret, storageObject{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	return ret, err
+}
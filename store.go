@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	foldersBucket = []byte("folders")
+	itemsBucket   = []byte("items")
+	dirsBucket    = []byte("dirs")
+	keysBucket    = []byte("keys")
+	metaBucket    = []byte("meta")
+	sourcesBucket = []byte("sources")
+	trashBucket   = []byte("trash")
+
+	importedKey = []byte("imported")
+	kekKey      = []byte("kek")
+)
+
+// torDropStore persists the folders and their items
+// as individual records within a bolt database.
+// Every write is committed within its own transaction.
+type torDropStore struct {
+	db *bolt.DB
+}
+
+func openStore(fpath string) (*torDropStore, error) {
+	db, err := bolt.Open(fpath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %q: %v", fpath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		fresh := tx.Bucket(metaBucket) == nil
+		for _, b := range [][]byte{foldersBucket, itemsBucket, dirsBucket, keysBucket, metaBucket, sourcesBucket, trashBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if fresh {
+			return setVersion(tx, dbVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &torDropStore{db: db}, nil
+}
+
+// copyStore copies a snapshot of the store at fpath to dst,
+// the store is opened read only. A missing store is not copied.
+func copyStore(fpath, dst string) error {
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := bolt.Open(fpath, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open store %q: %v", fpath, err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(dst, 0600)
+	})
+}
+
+func (s *torDropStore) Close() error {
+	return s.db.Close()
+}
+
+// Load reads all folders and items into db.
+func (s *torDropStore) Load(db *torDropDB) error {
+	var fds folders
+	var version int
+	items := map[string]fileItems{}
+	dirs := map[string][]string{}
+	sources := map[string][]source{}
+	trash := map[string][]trashEntry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		version = getVersion(tx)
+		err := tx.Bucket(foldersBucket).ForEach(func(k, v []byte) error {
+			var fd folder
+			if err := json.Unmarshal(v, &fd); err != nil {
+				return fmt.Errorf("failed to decode folder %q: %v", k, err)
+			}
+			fds = append(fds, fd)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(itemsBucket).ForEachBucket(func(k []byte) error {
+			folderName := string(k)
+			return tx.Bucket(itemsBucket).Bucket(k).ForEach(func(k, v []byte) error {
+				var item fileItem
+				if err := json.Unmarshal(v, &item); err != nil {
+					return fmt.Errorf("failed to decode item %q in folder %q: %v", k, folderName, err)
+				}
+				items[folderName] = append(items[folderName], item)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(dirsBucket).ForEachBucket(func(k []byte) error {
+			folderName := string(k)
+			return tx.Bucket(dirsBucket).Bucket(k).ForEach(func(k, v []byte) error {
+				dirs[folderName] = append(dirs[folderName], string(k))
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(sourcesBucket).ForEachBucket(func(k []byte) error {
+			folderName := string(k)
+			return tx.Bucket(sourcesBucket).Bucket(k).ForEach(func(k, v []byte) error {
+				var src source
+				if err := json.Unmarshal(v, &src); err != nil {
+					return fmt.Errorf("failed to decode source %q in folder %q: %v", k, folderName, err)
+				}
+				sources[folderName] = append(sources[folderName], src)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(trashBucket).ForEachBucket(func(k []byte) error {
+			folderName := string(k)
+			return tx.Bucket(trashBucket).Bucket(k).ForEach(func(k, v []byte) error {
+				var e trashEntry
+				if err := json.Unmarshal(v, &e); err != nil {
+					return fmt.Errorf("failed to decode trash entry %q in folder %q: %v", k, folderName, err)
+				}
+				trash[folderName] = append(trash[folderName], e)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(fds, func(i, j int) bool {
+		return fds[i].CreateDate.Before(fds[j].CreateDate)
+	})
+	for _, x := range items {
+		sort.SliceStable(x, func(i, j int) bool {
+			return x[i].CreateDate.Before(x[j].CreateDate)
+		})
+	}
+	for _, x := range sources {
+		sort.SliceStable(x, func(i, j int) bool {
+			return x[i].CreateDate.Before(x[j].CreateDate)
+		})
+	}
+	for _, x := range trash {
+		sort.SliceStable(x, func(i, j int) bool {
+			return x[i].DeleteDate.Before(x[j].DeleteDate)
+		})
+	}
+	db.Version = version
+	db.Folders = fds
+	db.Items = items
+	db.Dirs = dirs
+	db.Sources = sources
+	db.Trash = trash
+	return nil
+}
+
+// Imported reports whether a legacy database was already imported.
+func (s *torDropStore) Imported() bool {
+	var ok bool
+	s.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(metaBucket).Get(importedKey) != nil
+		return nil
+	})
+	return ok
+}
+
+// Import writes all folders and items of db within a single transaction,
+// the store takes the schema version of db so that it can be migrated.
+func (s *torDropStore) Import(db *torDropDB) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return importTx(tx, db)
+	})
+}
+
+func importTx(tx *bolt.Tx, db *torDropDB) error {
+	for _, fd := range db.Folders {
+		if err := putFolder(tx, fd); err != nil {
+			return err
+		}
+	}
+	for folderName, items := range db.Items {
+		for _, item := range items {
+			if err := putItem(tx, folderName, item); err != nil {
+				return err
+			}
+		}
+	}
+	for folderName, dirs := range db.Dirs {
+		for _, dir := range dirs {
+			if err := putDir(tx, folderName, dir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := setVersion(tx, db.Version); err != nil {
+		return err
+	}
+	d, _ := time.Now().MarshalText()
+	return tx.Bucket(metaBucket).Put(importedKey, d)
+}
+
+// storeTx groups several writes within a single transaction.
+type storeTx struct {
+	tx *bolt.Tx
+}
+
+// Batch commits all the writes made by fn, or none of them.
+func (s *torDropStore) Batch(fn func(b storeTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(storeTx{tx: tx})
+	})
+}
+
+func (b storeTx) PutItem(folderName string, item fileItem) error {
+	return putItem(b.tx, folderName, item)
+}
+
+func (b storeTx) DeleteItem(folderName, key string) error {
+	return deleteIn(b.tx.Bucket(itemsBucket), folderName, key)
+}
+
+func (b storeTx) PutDir(folderName, dir string) error {
+	return putDir(b.tx, folderName, dir)
+}
+
+func (b storeTx) DeleteDir(folderName, dir string) error {
+	return deleteIn(b.tx.Bucket(dirsBucket), folderName, dir)
+}
+
+func (b storeTx) PutFolder(fd folder) error {
+	return putFolder(b.tx, fd)
+}
+
+func (b storeTx) PutSource(folderName string, src source) error {
+	return putSource(b.tx, folderName, src)
+}
+
+func (b storeTx) PutTrash(folderName string, e trashEntry) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	t, err := b.tx.Bucket(trashBucket).CreateBucketIfNotExists([]byte(folderName))
+	if err != nil {
+		return err
+	}
+	return t.Put([]byte(e.ID), d)
+}
+
+func (b storeTx) DeleteTrash(folderName, id string) error {
+	return deleteIn(b.tx.Bucket(trashBucket), folderName, id)
+}
+
+// TrashFolder removes the records of the folder, its content is kept
+// within its trash entry, its key is kept for its restoration.
+func (b storeTx) TrashFolder(name string, e trashEntry) error {
+	if err := b.tx.Bucket(foldersBucket).Delete([]byte(name)); err != nil {
+		return err
+	}
+	if err := deleteBuckets(b.tx, name, itemsBucket, dirsBucket, sourcesBucket); err != nil {
+		return err
+	}
+	return b.PutTrash(name, e)
+}
+
+func (s *torDropStore) PutFolder(fd folder) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putFolder(tx, fd)
+	})
+}
+
+// DeleteFolder removes the folder with all its items, directories and trash.
+func (s *torDropStore) DeleteFolder(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(foldersBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(keysBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return deleteBuckets(tx, name, itemsBucket, dirsBucket, sourcesBucket, trashBucket)
+	})
+}
+
+// deleteBuckets deletes the buckets of the folder within the given buckets.
+func deleteBuckets(tx *bolt.Tx, name string, buckets ...[]byte) error {
+	for _, b := range buckets {
+		err := tx.Bucket(b).DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *torDropStore) PutItem(folderName string, item fileItem) error {
+	return s.Batch(func(b storeTx) error {
+		return b.PutItem(folderName, item)
+	})
+}
+
+func (s *torDropStore) DeleteItem(folderName, key string) error {
+	return s.Batch(func(b storeTx) error {
+		return b.DeleteItem(folderName, key)
+	})
+}
+
+func deleteIn(b *bolt.Bucket, folderName, key string) error {
+	b = b.Bucket([]byte(folderName))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+func putFolder(tx *bolt.Tx, fd folder) error {
+	if fd.Name == "" {
+		return fmt.Errorf("folder name must not be empty")
+	}
+	d, err := json.Marshal(fd)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(foldersBucket).Put([]byte(fd.Name), d)
+}
+
+func putItem(tx *bolt.Tx, folderName string, item fileItem) error {
+	if item.Name == "" {
+		return fmt.Errorf("item name must not be empty")
+	}
+	b, err := tx.Bucket(itemsBucket).CreateBucketIfNotExists([]byte(folderName))
+	if err != nil {
+		return err
+	}
+	d, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(item.Key()), d)
+}
+
+// PutSource saves the source of a folder with its replies.
+func (s *torDropStore) PutSource(folderName string, src source) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putSource(tx, folderName, src)
+	})
+}
+
+func putSource(tx *bolt.Tx, folderName string, src source) error {
+	d, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	b, err := tx.Bucket(sourcesBucket).CreateBucketIfNotExists([]byte(folderName))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(src.ID), d)
+}
+
+func putDir(tx *bolt.Tx, folderName, dir string) error {
+	b, err := tx.Bucket(dirsBucket).CreateBucketIfNotExists([]byte(folderName))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(dir), []byte{})
+}
+
+// KEK returns the parameters of the key encrypting the folder keys,
+// ok is false until a passphrase was set.
+func (s *torDropStore) KEK() (p cryptKEK, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		d := tx.Bucket(metaBucket).Get(kekKey)
+		if d == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(d, &p)
+	})
+	return
+}
+
+// PutKEK saves the parameters of the key encrypting the folder keys
+// together with the folder keys wrapped by it.
+func (s *torDropStore) PutKEK(p cryptKEK, keys map[string][]byte) error {
+	d, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for folderName, key := range keys {
+			if err := tx.Bucket(keysBucket).Put([]byte(folderName), key); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(kekKey, d)
+	})
+}
+
+// Keys returns the wrapped keys of the encrypted folders.
+func (s *torDropStore) Keys() (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(k, v []byte) error {
+			keys[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (s *torDropStore) PutKey(folderName string, wrapped []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte(folderName), wrapped)
+	})
+}
@@ -0,0 +1,169 @@
+{{define "title"}}
+  tor-drop file {{.File.Name}}
+{{end}}
+
+{{define "body"}}
+  <h2>
+    {{if .IsAdmin}}
+    Welcome to the administrator zone
+    {{else}}
+    Welcome to the public zone
+    {{end}}
+  </h2>
+
+  <h3>File {{.File.Name}} in folder <a href="{{urlFor "folder-listing" "folder" .Folder.Name}}">{{.Folder.Name}}</a></h3>
+
+  {{if .Error}}
+    <b style="color:red">{{.Error}}</b>
+    <br/>
+  {{end}}
+
+  <table>
+    <tr>
+      <td>Path</td>
+      <td>{{.File.Key}}</td>
+    </tr>
+    <tr>
+      <td>Create date</td>
+      <td>{{.File.CreateDate | times}}</td>
+    </tr>
+    <tr>
+      <td>Size</td>
+      <td>{{.File.Size | bytes}}</td>
+    </tr>
+    {{if .File.MIME}}
+    <tr>
+      <td>Type</td>
+      <td>{{.File.MIME}}</td>
+    </tr>
+    {{end}}
+    {{if .File.Sealed}}
+    <tr>
+      <td>Sealed</td>
+      <td>{{.File.Sealed}}, download {{.File.DownloadName}} and decrypt it with a recipient key, the checksums are those of the decrypted file</td>
+    </tr>
+    {{end}}
+    <tr>
+      <td>SHA-256</td>
+      <td><code>{{.File.SHA256}}</code></td>
+    </tr>
+    {{if .File.Broken}}
+    <tr>
+      <td>Broken</td>
+      <td><b style="color:red">{{.File.Broken}}</b></td>
+    </tr>
+    {{end}}
+    {{if .File.Quarantine}}
+    <tr>
+      <td>Quarantined</td>
+      <td><b style="color:red">{{.File.Quarantine}}</b></td>
+    </tr>
+    {{end}}
+    {{if .File.ScanVerdict}}
+    <tr>
+      <td>Malware scan</td>
+      <td>{{.File.ScanVerdict}}</td>
+    </tr>
+    {{end}}
+    {{if and .IsAdmin .File.Source}}
+    <tr>
+      <td>Source</td>
+      <td><a href="{{urlFor "sources" "folder" .Folder.Name}}"><code>{{.File.Source | printf "%.12s"}}</code></a></td>
+    </tr>
+    {{end}}
+    {{if and .IsAdmin .File.OriginalName}}
+    <tr>
+      <td>Original name</td>
+      <td>{{.File.OriginalName}}</td>
+    </tr>
+    {{end}}
+    {{if .File.Processors}}
+    <tr>
+      <td>Processed by</td>
+      <td>{{range $i, $p := .File.Processors}}{{if $i}}, {{end}}{{$p}}{{end}}</td>
+    </tr>
+    {{end}}
+    {{if .File.Sanitizers}}
+    <tr>
+      <td>Metadata stripped</td>
+      <td>{{range $i, $s := .File.Sanitizers}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+    </tr>
+    {{end}}
+    {{if and .IsAdmin .File.OriginalSize}}
+    <tr>
+      <td>Original</td>
+      <td><a href="{{urlFor "asset-dl" "folder" .Folder.Name "name" .File.Key}}?original=1" target="_blank">download the original</a></td>
+    </tr>
+    {{end}}
+    {{if or .IsAdmin (.Folder.DownloadLimit .File)}}
+    <tr>
+      <td>Downloads</td>
+      <td>
+        {{if .Folder.DownloadLimit .File}}{{.File.Downloads}} of {{.Folder.DownloadLimit .File}}, removed once reached{{else}}no limit{{end}}
+        {{if .IsAdmin}}
+        <form method="POST" action="">
+          {{$.Request | csrf}}
+          <input type="text" name="MaxDownloads" placeholder="0 applies the folder limit"
+            value="{{if .File.MaxDownloads}}{{.File.MaxDownloads}}{{end}}" />
+          <button type="submit" name="action" value="limit">set the limit</button>
+        </form>
+        {{end}}
+      </td>
+    </tr>
+    {{end}}
+    {{if .File.BLAKE2b}}
+    <tr>
+      <td>BLAKE2b-256</td>
+      <td><code>{{.File.BLAKE2b}}</code></td>
+    </tr>
+    {{end}}
+  </table>
+
+  <a href="{{urlFor "asset-dl" "folder" .Folder.Name "name" .File.Key}}" target="_blank">download</a>
+
+  {{if .File.Versions}}
+  <h3>Version history</h3>
+  <table>
+    <tr>
+      <td>Version</td>
+      <td>Create date</td>
+      <td>Size</td>
+      <td>SHA-256</td>
+      {{if $.IsAdmin}}
+      <td></td>
+      <td></td>
+      {{end}}
+    </tr>
+    <tr>
+      <td>{{.File.CurrentVersion}} (current)</td>
+      <td>{{.File.CreateDate | times}}</td>
+      <td>{{.File.Size | bytes}}</td>
+      <td><code>{{.File.SHA256}}</code></td>
+      {{if $.IsAdmin}}
+      <td></td>
+      <td></td>
+      {{end}}
+    </tr>
+    {{range $v := .File.History}}
+    <tr>
+      <td>{{$v.Version}}</td>
+      <td>{{$v.CreateDate | times}}</td>
+      <td>{{$v.Size | bytes}}</td>
+      <td><code>{{$v.SHA256}}</code></td>
+      {{if $.IsAdmin}}
+      <td><a href="{{urlFor "asset-dl" "folder" $.Folder.Name "name" $.File.Key}}?version={{$v.Version}}" target="_blank">download</a></td>
+      <td>
+        <form method="POST" action="">
+          {{$.Request | csrf}}
+          <input type="hidden" name="Version" value="{{$v.Version}}" />
+          <button type="submit" name="action" value="restore">restore</button>
+        </form>
+      </td>
+      {{end}}
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+{{end}}
+
+{{template "layout" .}}
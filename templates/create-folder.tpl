@@ -43,6 +43,16 @@
     <input type="text" name="Folder.MaxActiveDownloads" placeholder="0 means no limit"
       value="{{.Folder.MaxActiveDownloads |ints }}" />
     <br/>
+    Maximum downloads per file, then removed:
+    <input type="text" name="Folder.MaxDownloads" placeholder="empty means no limit"
+      value="{{.Folder.MaxDownloads |ints }}" />
+    <br/>
+    Burn after read, the files are removed once downloaded:
+      <span>yes<input type="radio" name="Folder.BurnAfterRead" value="true"
+        {{if .Folder.BurnAfterRead}}checked{{end}} /></span>
+      <span>no<input type="radio" name="Folder.BurnAfterRead" value="false"
+        {{if not .Folder.BurnAfterRead}}checked{{end}} /></span>
+    <br/>
     Maximum upload bytes per second:
       <input type="text" name="Folder.MaxUpBytesPerSec" value="{{.Folder.MaxUpBytesPerSec | bytes}}"
         placeholder="1b 250kb 1Mb" />
@@ -91,9 +101,79 @@
       <span>no<input type="radio" name="Folder.CaptchaForAnonymous" value="false"
         {{if not .Folder.CaptchaForAnonymous}}checked{{end}} /></span>
     <br/>
+    Encrypt the files at rest:
+      <span>yes<input type="radio" name="Folder.Encrypted" value="true"
+        {{if .Folder.Encrypted}}checked{{end}} /></span>
+      <span>no<input type="radio" name="Folder.Encrypted" value="false"
+        {{if not .Folder.Encrypted}}checked{{end}} /></span>
+    <br/>
+    Seal the files to the recipients, age recipients one per line or armored OpenPGP public keys:
+    <br/>
+      <textarea name="Folder.Recipients" rows="4" cols="64">{{.Folder.Recipients}}</textarea>
+    <br/>
+    Accepted file types, MIME types such as image/* or extensions such as .pdf, empty accepts all:
+      <input type="text" name="Folder.AllowTypes" value="{{.Folder.AllowTypes}}" />
+    <br/>
+    Refused file types:
+      <input type="text" name="Folder.DenyTypes" value="{{.Folder.DenyTypes}}" />
+    <br/>
+    When the content does not match the file extension:
+      <span>reject<input type="radio" name="Folder.TypeMismatch" value="reject"
+        {{if ne .Folder.TypeMismatch "quarantine"}}checked{{end}} /></span>
+      <span>quarantine<input type="radio" name="Folder.TypeMismatch" value="quarantine"
+        {{if eq .Folder.TypeMismatch "quarantine"}}checked{{end}} /></span>
+    <br/>
+    Strip the metadata of the images and PDF documents:
+      <span>yes<input type="radio" name="Folder.Sanitize" value="true"
+        {{if .Folder.Sanitize}}checked{{end}} /></span>
+      <span>no<input type="radio" name="Folder.Sanitize" value="false"
+        {{if not .Folder.Sanitize}}checked{{end}} /></span>
+    <br/>
+    Keep the original of the stripped files for the administrators:
+      <span>yes<input type="radio" name="Folder.KeepOriginal" value="true"
+        {{if .Folder.KeepOriginal}}checked{{end}} /></span>
+      <span>no<input type="radio" name="Folder.KeepOriginal" value="false"
+        {{if not .Folder.KeepOriginal}}checked{{end}} /></span>
+    <br/>
+    Processors run in order on the uploads, executables of the processors directory:
+      <input type="text" name="Folder.Processors" value="{{.Folder.Processors}}" />
+    <br/>
+    Give the uploaders a codename to read the replies of the administrators:
+      <span>yes<input type="radio" name="Folder.Codenames" value="true"
+        {{if .Folder.Codenames}}checked{{end}} /></span>
+      <span>no<input type="radio" name="Folder.Codenames" value="false"
+        {{if not .Folder.Codenames}}checked{{end}} /></span>
+    <br/>
+    When a new file takes the name of an existing one:
+      <span>reject<input type="radio" name="Folder.Collisions" value="reject"
+        {{if or (eq .Folder.Collisions "") (eq .Folder.Collisions "reject")}}checked{{end}} /></span>
+      <span>rename<input type="radio" name="Folder.Collisions" value="rename"
+        {{if eq .Folder.Collisions "rename"}}checked{{end}} /></span>
+      <span>overwrite<input type="radio" name="Folder.Collisions" value="overwrite"
+        {{if eq .Folder.Collisions "overwrite"}}checked{{end}} /></span>
+      <span>random names<input type="radio" name="Folder.Collisions" value="random"
+        {{if eq .Folder.Collisions "random"}}checked{{end}} /></span>
+    <br/>
+    Keep the older versions of the files uploaded again:
+      <span>yes<input type="radio" name="Folder.Versioning" value="true"
+        {{if .Folder.Versioning}}checked{{end}} /></span>
+      <span>no<input type="radio" name="Folder.Versioning" value="false"
+        {{if not .Folder.Versioning}}checked{{end}} /></span>
+    <br/>
+    Maximum older versions kept per file:
+    <input type="text" name="Folder.MaxVersions" placeholder="empty means no limit"
+      value="{{.Folder.MaxVersions |ints }}" />
+    <br/>
+    Maximum age of the older versions:
+      <input type="text" name="Folder.MaxVersionAge" value="{{.Folder.MaxVersionAge | durations}}"
+        placeholder="1m 1s 1h12m" />
+    <br/>
     Require a password:
       <input type="text" name="Folder.Password" value="{{or .Folder.Password ""}}" />
     <br/>
+    Token of the scripted uploads:
+      <input type="text" name="Folder.Token" value="{{.Folder.Token}}" />
+    <br/>
     Add an user:
       <input type="text" placeholder="user login" name="User.Login" value="{{.User.Login}}" />
       <input type="password" placeholder="user password"name="User.Password" value="{{.User.Password}}" />
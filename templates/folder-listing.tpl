@@ -13,17 +13,39 @@
 
   <h3>Listing folder {{.Folder.Name}}</h3>
 
+  <div>
+    <a href="{{urlFor "folder-listing" "folder" .Folder.Name}}">{{.Folder.Name}}</a>
+    {{range $d := .Breadcrumbs}}
+    / <a href="{{urlFor "folder-dir" "folder" $.Folder.Name "path" $d.Path}}">{{$d.Name}}</a>
+    {{end}}
+  </div>
+
   {{if .Error}}
     <b style="color:red">{{.Error}}</b>
     <br/>
   {{end}}
 
+  {{if .Codename}}
+    <p>
+      Your codename is <b><code>{{.Codename}}</code></b>, write it down and keep it secret.
+      It is shown only once, enter it at <a href="{{urlFor "source" "folder" .Folder.Name}}">the source page</a>
+      to read the replies to your uploads.
+    </p>
+  {{end}}
+  {{if .Folder.Codenames}}
+    {{if .IsAdmin}}
+    <a href="{{urlFor "sources" "folder" .Folder.Name}}">Sources and replies</a>
+    {{else}}
+    <a href="{{urlFor "source" "folder" .Folder.Name}}">Read the replies with your codename</a>
+    {{end}}
+  {{end}}
+
   <span>
     {{if not (.Folder.MaxFileCount | isZero)}}
-      {{.Items | len}} / {{.Folder.MaxFileCount}} files
+      {{.AllItems | len}} / {{.Folder.MaxFileCount}} files
     {{end}}
     {{if not (.Folder.MaxTotalSize | isZero)}}
-      {{.Items.Size | bytes}} consumed of
+      {{.AllItems.Size | bytes}} consumed of
       {{.Folder.MaxTotalSize | bytes}} available
     {{end}}
     {{if not (.Folder.MaxFileSize | isZero)}}
@@ -32,11 +54,17 @@
     {{if not (.Folder.MaxLifeTime | isZero)}}
       Maximum file lifetime {{.Folder.MaxLifeTime | durations}}
     {{end}}
+    {{if .Folder.AllowTypes}}
+      Accepted file types {{.Folder.AllowTypes}}
+    {{end}}
+    {{if .Folder.DenyTypes}}
+      Refused file types {{.Folder.DenyTypes}}
+    {{end}}
   </span>
 
-  <form method="POST" action="" enctype="multipart/form-data">
-    {{$.Request | csrf}}
-    Upload a file <input type="file" name="files" />
+  <form method="POST" action="?gorilla.csrf.Token={{$.Request | csrfToken}}" enctype="multipart/form-data">
+    <input type="hidden" name="action" value="upload" />
+    <input type="text" name="SHA256" placeholder="expected sha256 checksum (optional)" />
     {{if $.CaptchaID}}
     <br/>
     <img src="{{urlFor "captcha" "id" $.CaptchaID}}" />
@@ -44,8 +72,118 @@
     <input type="text" name="Solution" placeholder="type in the captcha solution" />
     <br/>
     {{end}}
-    <button type="submit" name="action" value="upload">send</button>
+    <br/>
+    <textarea name="Message" rows="4" cols="64" placeholder="write a message (optional)"></textarea>
+    <br/>
+    <!-- the files must follow the other fields, they are checked first -->
+    Upload a file <input type="file" name="files" />
+    <button type="submit">send</button>
+  </form>
+
+  <ul id="progress"></ul>
+  <script>
+    (function() {
+      if (!window.EventSource) {
+        return;
+      }
+      var list = document.getElementById("progress");
+      var rows = {};
+      var src = new EventSource({{urlFor "progress" "folder" .Folder.Name}});
+      src.addEventListener("progress", function(e) {
+        var ev = JSON.parse(e.data);
+        var row = rows[ev.name];
+        if (!row) {
+          row = rows[ev.name] = list.appendChild(document.createElement("li"));
+        }
+        var text = ev.name + " " + ev.state + " " + ev.uploaded + " of " + (ev.size || "?") + " bytes";
+        if (ev.state == "uploading") {
+          text += ", " + ev.rate + " bytes/s";
+          if (ev.eta) {
+            text += ", " + ev.eta + "s left";
+          }
+        }
+        if (ev.error) {
+          text += ": " + ev.error;
+        }
+        row.textContent = text;
+      });
+    })();
+  </script>
+
+  {{if .IsAdmin}}
+  <form method="POST" action="">
+    {{$.Request | csrf}}
+    <input type="text" name="Name" placeholder="directory name" />
+    <button type="submit" name="action" value="mkdir">create directory</button>
+  </form>
+  {{end}}
+
+  {{if gt (len .Dirs) 0}}
+  <table>
+    <tr>
+      <td>Directory</td>
+      {{if .IsAdmin}}
+      <td>Rename</td>
+      <td>Remove</td>
+      {{end}}
+    </tr>
+    {{range $d := .Dirs}}
+    <tr>
+      <td><a href="{{urlFor "folder-dir" "folder" $.Folder.Name "path" $d.Path}}">{{$d.Name}}/</a></td>
+      {{if $.IsAdmin}}
+      <td>
+        <form method="POST" action="">
+          {{$.Request | csrf}}
+          <input type="hidden" name="Name" value="{{$d.Name}}" />
+          <input type="text" name="NewName" value="{{$d.Name}}" />
+          <button type="submit" name="action" value="mvdir">rename</button>
+        </form>
+      </td>
+      <td>
+        <form method="POST" action="">
+          {{$.Request | csrf}}
+          <input type="hidden" name="Name" value="{{$d.Name}}" />
+          <button type="submit" name="action" value="rmdir">remove</button>
+        </form>
+      </td>
+      {{end}}
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+
+  {{if .Submissions}}
+  <h4>Messages</h4>
+  {{range $s := .Submissions}}
+  <div>
+    <i>{{$s.Message.CreateDate | times}}</i>
+    {{if $s.Message.Source}}from source <a href="{{urlFor "sources" "folder" $.Folder.Name}}"><code>{{$s.Message.Source | printf "%.12s"}}</code></a>{{end}}
+    {{if $s.Message.Quarantine}}<b style="color:red">quarantined: {{$s.Message.Quarantine}}</b>{{end}}
+    <pre>{{$s.Text}}</pre>
+    <a href="{{urlFor "asset-dl" "folder" $.Folder.Name "name" $s.Message.Key}}" target="_blank">download</a>
+    {{range $f := $s.Files}}
+    attached <a href="{{urlFor "asset-info" "folder" $.Folder.Name "name" $f.Key}}">{{$f.DownloadName}}</a>
+    {{end}}
+    <form method="post">
+      {{$.Request | csrf}}
+      <input type="hidden" name="action" value="rma" />
+      <button type="submit" name="Name" value="{{$s.Message.Key}}">remove the message</button>
+    </form>
+  </div>
+  {{end}}
+  {{end}}
+
+  {{if and (or .Items .Dirs) (or .IsAdmin (not .Folder.IsAdminOnlyReadable))}}
+  <form id="archive" method="GET" action="{{urlFor "folder-archive" "folder" .Folder.Name}}">
+    <input type="hidden" name="path" value="{{.Path}}" />
+    <select name="format">
+      <option value="zip">zip</option>
+      <option value="tar.gz">tar.gz</option>
+    </select>
+    <button type="submit">download all</button>
+    or the selected files
   </form>
+  {{end}}
 
   {{if gt (len .Items) 0}}
   <form method="post">
@@ -53,31 +191,43 @@
     <input type="hidden" name="action" value="rma" />
     <table>
       <tr>
+        <td>Select</td>
         <td>Name</td>
         <td>Create date</td>
         <td>Size</td>
         <td>Uploaded</td>
+        <td>Type</td>
+        <td>SHA-256</td>
         {{if .IsAdmin}}
         <td>Remove</td>
         {{end}}
       </tr>
       {{range $f := .Items}}
       <tr>
-        <td><a href="{{urlFor "asset-dl" "folder" $.Folder.Name "name" $f.Name}}" target="_blank">{{$f.Name}}</a></td>
+        <td><input type="checkbox" name="name" value="{{$f.Key}}" form="archive" /></td>
+        <td><a href="{{urlFor "asset-dl" "folder" $.Folder.Name "name" $f.Key}}" target="_blank">{{$f.DownloadName}}</a>{{if $f.Broken}} <b style="color:red">broken: {{$f.Broken}}</b>{{end}}{{if $f.Quarantine}} <b style="color:red">quarantined: {{$f.Quarantine}}</b>{{end}}</td>
         <td>{{$f.CreateDate | times}}</td>
         <td>{{$f.Size | bytes}}</td>
         <td>{{$f.Uploaded | bytes}}</td>
+        <td>{{$f.MIME}}</td>
+        <td><a href="{{urlFor "asset-info" "folder" $.Folder.Name "name" $f.Key}}"><code>{{$f.SHA256 | printf "%.12s"}}</code></a></td>
         {{if $.IsAdmin}}
         <td>
           <button type="submit"
-            name="Name" value="{{$f.Name}}">remove</button>
+            name="Name" value="{{$f.Key}}">remove</button>
+        </td>
+        {{end}}
+        {{if and $.IsAdmin $f.Quarantine}}
+        <td>
+          <button type="submit"
+            name="Release" value="{{$f.Key}}">release</button>
         </td>
         {{end}}
       </tr>
       {{end}}
     </table>
   </form>
-  {{else}}
+  {{else if eq (len .Dirs) 0}}
     This folder is currently empty!
   {{end}}
 
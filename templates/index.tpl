@@ -15,6 +15,26 @@
       Create folder
     </button>
   </a>
+  <a href="{{urlFor "unlock"}}">
+    <button>
+      {{if .Locked}}Unlock the encryption keys{{else}}Change the encryption passphrase{{end}}
+    </button>
+  </a>
+  <a href="{{urlFor "transfers"}}">
+    <button>
+      Active transfers
+    </button>
+  </a>
+  <a href="{{urlFor "quarantine"}}">
+    <button>
+      Quarantine
+    </button>
+  </a>
+  <a href="{{urlFor "trash"}}">
+    <button>
+      Trash
+    </button>
+  </a>
   {{end}}
 
   {{if not (len .Folders)}}
@@ -0,0 +1,30 @@
+{{define "title"}}tor-drop quarantine{{end}}
+
+{{define "body"}}
+  <h2>Welcome to the administrator zone</h2>
+
+  <h3>Quarantined files</h3>
+
+  {{if not (len .Items)}}
+    No file is quarantined.
+  {{else}}
+  <table>
+    <tr>
+      <td>Folder</td>
+      <td>File</td>
+      <td>Size</td>
+      <td>Reason</td>
+    </tr>
+    {{range $q := .Items}}
+    <tr>
+      <td><a href="{{urlFor "folder-listing" "folder" $q.Folder}}">{{$q.Folder}}</a></td>
+      <td><a href="{{urlFor "asset-info" "folder" $q.Folder "name" $q.Item.Key}}">{{$q.Item.Key}}</a></td>
+      <td>{{$q.Item.Size | bytes}}</td>
+      <td><b style="color:red">{{$q.Item.Quarantine}}</b></td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+{{end}}
+
+{{template "layout" .}}
@@ -0,0 +1,71 @@
+{{define "title"}}
+  tor-drop source of folder {{.Folder.Name}}
+{{end}}
+
+{{define "body"}}
+  <h2>Welcome to the public zone</h2>
+
+  <h3>Source of folder <a href="{{urlFor "folder-listing" "folder" .Folder.Name}}">{{.Folder.Name}}</a></h3>
+
+  {{if .Error}}
+    <b style="color:red">{{.Error}}</b>
+    <br/>
+  {{end}}
+
+  {{if .Codename}}
+    <p>
+      Your codename is <b><code>{{.Codename}}</code></b>, write it down and keep it secret.
+      It is shown only once, enter it on this page to read the replies to your uploads.
+    </p>
+  {{end}}
+
+  {{if not .Source}}
+  <form method="POST" action="">
+    {{$.Request | csrf}}
+    <input type="hidden" name="action" value="codename" />
+    <input type="password" name="Codename" placeholder="codename" autocomplete="off" />
+    <button type="submit">log in</button>
+  </form>
+  {{else}}
+  <form method="POST" action="">
+    {{$.Request | csrf}}
+    <button type="submit" name="action" value="logout">log out</button>
+  </form>
+
+  <a href="{{urlFor "folder-listing" "folder" .Folder.Name}}">upload more files</a>
+
+  <h4>Your uploads</h4>
+  {{if not (len .Items)}}
+    No upload yet.
+  {{else}}
+  <table>
+    <tr>
+      <td>Name</td>
+      <td>Create date</td>
+      <td>Size</td>
+    </tr>
+    {{range $f := .Items}}
+    <tr>
+      <td>{{$f.Key}}</td>
+      <td>{{$f.CreateDate | times}}</td>
+      <td>{{$f.Size | bytes}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+
+  <h4>Replies</h4>
+  {{if not (len .Source.Replies)}}
+    No reply yet, come back later.
+  {{else}}
+    {{range $r := .Source.Replies}}
+    <p>
+      <i>{{$r.Date | times}}</i>
+      <pre>{{$r.Text}}</pre>
+    </p>
+    {{end}}
+  {{end}}
+  {{end}}
+{{end}}
+
+{{template "layout" .}}
@@ -0,0 +1,41 @@
+{{define "title"}}
+  tor-drop sources of folder {{.Folder.Name}}
+{{end}}
+
+{{define "body"}}
+  <h2>Welcome to the administrator zone</h2>
+
+  <h3>Sources of folder <a href="{{urlFor "folder-listing" "folder" .Folder.Name}}">{{.Folder.Name}}</a></h3>
+
+  {{if .Error}}
+    <b style="color:red">{{.Error}}</b>
+    <br/>
+  {{end}}
+
+  {{if not (len .Sources)}}
+    No source yet.
+  {{end}}
+  {{range $s := .Sources}}
+  <h4>Source <code>{{$s.ID | printf "%.12s"}}</code> since {{$s.CreateDate | times}}</h4>
+  <ul>
+    {{range $f := $s.Items}}
+    <li><a href="{{urlFor "asset-info" "folder" $.Folder.Name "name" $f.Key}}">{{$f.Key}}</a> {{$f.CreateDate | times}}</li>
+    {{end}}
+  </ul>
+  {{range $r := $s.Replies}}
+  <p>
+    <i>{{$r.Date | times}}</i>
+    <pre>{{$r.Text}}</pre>
+  </p>
+  {{end}}
+  <form method="POST" action="">
+    {{$.Request | csrf}}
+    <input type="hidden" name="action" value="reply" />
+    <input type="hidden" name="Source" value="{{$s.ID}}" />
+    <textarea name="Text" rows="4" cols="64" placeholder="reply to the source"></textarea>
+    <button type="submit">reply</button>
+  </form>
+  {{end}}
+{{end}}
+
+{{template "layout" .}}
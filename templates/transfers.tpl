@@ -0,0 +1,62 @@
+{{define "title"}}tor-drop active transfers{{end}}
+
+{{define "body"}}
+  <h2>Welcome to the administrator zone</h2>
+
+  <h3>Active transfers</h3>
+
+  {{if .Error}}
+    <b style="color:red">{{.Error}}</b>
+    <br/>
+  {{end}}
+  {{if .Success}}
+    <b>{{.Success}}</b>
+    <br/>
+  {{end}}
+
+  <a href="{{urlFor "transfers"}}"><button>Refresh</button></a>
+
+  {{if not (len .Transfers)}}
+    <br/>
+    <br/>
+    No transfer in flight.
+  {{else}}
+  <form method="POST">
+    {{$.Request | csrf}}
+    <input type="hidden" name="action" value="cancel" />
+    <table>
+      <tr>
+        <td>Kind</td>
+        <td>Folder</td>
+        <td>File</td>
+        <td>Transferred</td>
+        <td>Rate</td>
+        <td>Age</td>
+        <td>Cancel</td>
+      </tr>
+      {{range $tr := .Transfers}}
+      <tr>
+        <td>{{$tr.Kind}}</td>
+        <td><a href="{{urlFor "folder-listing" "folder" $tr.Folder}}">{{$tr.Folder}}</a></td>
+        <td>{{$tr.Name}}</td>
+        <td>{{$tr.Bytes | bytes}}{{if $tr.Size}} of {{$tr.Size | bytes}}{{end}}</td>
+        <td>{{$tr.Rate | bytes}}/s</td>
+        <td>{{$tr.Age}}</td>
+        <td><button type="submit" name="ID" value="{{$tr.ID}}">cancel</button></td>
+      </tr>
+      {{end}}
+    </table>
+  </form>
+
+  <h3>Cancel all the transfers of a folder</h3>
+  {{range $f := .Folders}}
+  <form method="POST" style="display:inline">
+    {{$.Request | csrf}}
+    <input type="hidden" name="action" value="cancel-folder" />
+    <button type="submit" name="Folder" value="{{$f}}">{{$f}}</button>
+  </form>
+  {{end}}
+  {{end}}
+{{end}}
+
+{{template "layout" .}}
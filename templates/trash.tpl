@@ -0,0 +1,53 @@
+{{define "title"}}tor-drop trash{{end}}
+
+{{define "body"}}
+  <h2>Welcome to the administrator zone</h2>
+
+  <h3>Trash</h3>
+
+  {{if .Error}}
+    <b style="color:red">{{.Error}}</b>
+    <br/>
+  {{end}}
+
+  {{if not (len .Items)}}
+    The trash is empty.
+  {{else}}
+  <table>
+    <tr>
+      <td>Folder</td>
+      <td>File</td>
+      <td>Size</td>
+      <td>Deleted</td>
+      <td></td>
+      <td></td>
+    </tr>
+    {{range $e := .Items}}
+    <tr>
+      <td>{{$e.Folder}}</td>
+      <td>{{if $e.Item}}{{$e.Item.Key}}{{else}}the whole folder, {{len $e.Contents.Items}} files{{end}}</td>
+      <td>{{$e.Size | bytes}}</td>
+      <td>{{$e.DeleteDate | since}}</td>
+      <td>
+        <form method="POST" action="">
+          {{$.Request | csrf}}
+          <input type="hidden" name="Folder" value="{{$e.Folder}}" />
+          <input type="hidden" name="ID" value="{{$e.ID}}" />
+          <button type="submit" name="action" value="restore">restore</button>
+        </form>
+      </td>
+      <td>
+        <form method="POST" action="">
+          {{$.Request | csrf}}
+          <input type="hidden" name="Folder" value="{{$e.Folder}}" />
+          <input type="hidden" name="ID" value="{{$e.ID}}" />
+          <button type="submit" name="action" value="purge">purge</button>
+        </form>
+      </td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+{{end}}
+
+{{template "layout" .}}
@@ -0,0 +1,47 @@
+{{define "title"}}tor-drop encryption keys{{end}}
+
+{{define "body"}}
+  <h2>Welcome to the administrator zone</h2>
+
+  {{if .Locked}}
+  <h3>Unlock the encryption keys</h3>
+  {{else}}
+  <h3>Change the encryption passphrase</h3>
+  {{end}}
+
+  {{if .Error}}
+    <b style="color:red">{{.Error}}</b>
+    <br/>
+  {{end}}
+  {{if .Success}}
+    <b>{{.Success}}</b>
+    <br/>
+  {{end}}
+
+  <form method="POST">
+    {{$.Request | csrf}}
+    {{if .Locked}}
+      {{if .Initialized}}
+      Passphrase <input type="password" name="Passphrase" value="" />
+      <br/>
+      <button type="submit" name="action" value="unlock">Unlock</button>
+      {{else}}
+      No passphrase was set yet, it will protect the keys of the encrypted folders.
+      <br/>
+      Passphrase <input type="password" name="Passphrase" value="" />
+      <br/>
+      Confirm <input type="password" name="Confirm" value="" />
+      <br/>
+      <button type="submit" name="action" value="unlock">Set the passphrase</button>
+      {{end}}
+    {{else}}
+      New passphrase <input type="password" name="Passphrase" value="" />
+      <br/>
+      Confirm <input type="password" name="Confirm" value="" />
+      <br/>
+      <button type="submit" name="action" value="change">Change the passphrase</button>
+    {{end}}
+  </form>
+{{end}}
+
+{{template "layout" .}}
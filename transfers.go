@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var errTransferCancelled = errors.New("the transfer was cancelled by an administrator")
+
+const (
+	transferUpload   = "upload"
+	transferDownload = "download"
+)
+
+// transfer is an upload or a download in flight,
+// it is registered within the main loop until it ends.
+type transfer struct {
+	ID        uint64
+	Kind      string
+	Folder    string
+	Name      string
+	Size      uint64
+	StartDate time.Time
+
+	bytes  func() uint64
+	cancel func()
+}
+
+// transferInfo is a snapshot of a transfer.
+type transferInfo struct {
+	ID        uint64
+	Kind      string
+	Folder    string
+	Name      string
+	Size      uint64
+	Bytes     uint64
+	StartDate time.Time
+}
+
+// Rate returns the average throughput in bytes per second.
+func (t transferInfo) Rate() uint64 {
+	if d := time.Since(t.StartDate).Seconds(); d > 0 {
+		return uint64(float64(t.Bytes) / d)
+	}
+	return 0
+}
+
+// Age returns the duration since the transfer started.
+func (t transferInfo) Age() time.Duration {
+	return time.Since(t.StartDate).Truncate(time.Second)
+}
+
+// cancelReader fails the reads once cancelled.
+type cancelReader struct {
+	io.ReadCloser
+	n         uint64
+	cancelled int32
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.cancelled) != 0 {
+		return 0, errTransferCancelled
+	}
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddUint64(&r.n, uint64(n))
+	return n, err
+}
+
+func (r *cancelReader) Bytes() uint64 {
+	return atomic.LoadUint64(&r.n)
+}
+
+func (r *cancelReader) Cancel() {
+	atomic.StoreInt32(&r.cancelled, 1)
+	// a pipe reader is waiting for the next request of a resumable upload.
+	if pr, ok := r.ReadCloser.(*io.PipeReader); ok {
+		pr.CloseWithError(errTransferCancelled)
+	}
+}
+
+// addTransfer registers tr, it must be called within the main loop.
+func (t *torDropFileServer) addTransfer(tr *transfer) {
+	if t.transfers == nil {
+		t.transfers = map[uint64]*transfer{}
+	}
+	t.transferSeq++
+	tr.ID = t.transferSeq
+	tr.StartDate = time.Now()
+	t.transfers[tr.ID] = tr
+}
+
+// endTransfer unregisters the transfer id from outside of the main loop.
+func (t *torDropFileServer) endTransfer(id uint64) {
+	t.ops <- func() {
+		delete(t.transfers, id)
+	}
+}
+
+// Transfers returns the transfers in flight, oldest first.
+func (t *torDropFileServer) Transfers() []transferInfo {
+	ret := make(chan []transferInfo)
+	t.ops <- func() {
+		var res []transferInfo
+		for _, tr := range t.transfers {
+			res = append(res, transferInfo{
+				ID:        tr.ID,
+				Kind:      tr.Kind,
+				Folder:    tr.Folder,
+				Name:      tr.Name,
+				Size:      tr.Size,
+				Bytes:     tr.bytes(),
+				StartDate: tr.StartDate,
+			})
+		}
+		ret <- res
+	}
+	res := <-ret
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// CancelTransfer cancels the transfer id.
+func (t *torDropFileServer) CancelTransfer(id uint64) error {
+	ret := make(chan error)
+	t.ops <- func() {
+		tr, ok := t.transfers[id]
+		if !ok {
+			ret <- fmt.Errorf("transfer %v not found", id)
+			return
+		}
+		tr.cancel()
+		t.logger.Info("cancelled %v of %v/%v", tr.Kind, tr.Folder, tr.Name)
+		ret <- nil
+	}
+	return <-ret
+}
+
+// CancelFolderTransfers cancels all the transfers of a folder,
+// it returns the number of cancelled transfers.
+func (t *torDropFileServer) CancelFolderTransfers(folderName string) int {
+	ret := make(chan int)
+	t.ops <- func() {
+		var n int
+		for _, tr := range t.transfers {
+			if tr.Folder == folderName {
+				tr.cancel()
+				n++
+			}
+		}
+		t.logger.Info("cancelled %v transfers of %v", n, folderName)
+		ret <- n
+	}
+	return <-ret
+}
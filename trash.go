@@ -0,0 +1,612 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// trashDir holds the contents of the trashed items of a folder.
+const trashDir = ".trash"
+
+// defaultTrashRetention is the duration the trash keeps the deleted items and folders.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashEntry is an item or a folder deleted by an administrator,
+// it is kept until restored or purged.
+type trashEntry struct {
+	ID         string
+	DeleteDate time.Time
+	// Item is a deleted item, its contents are moved under its trash keys.
+	Item *fileItem `json:",omitempty"`
+	// Contents is a deleted folder with its content, the objects stay in place
+	// and the name of the folder cannot be reused until purged.
+	Contents *folderContents `json:",omitempty"`
+}
+
+type folderContents struct {
+	Folder  folder
+	Items   fileItems `json:",omitempty"`
+	Dirs    []string  `json:",omitempty"`
+	Sources []source  `json:",omitempty"`
+}
+
+func newTrashEntry() trashEntry {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return trashEntry{ID: hex.EncodeToString(b), DeleteDate: time.Now()}
+}
+
+// trashKeys returns the storage keys of the contents of a trashed item,
+// as pairs of their keys in the folder and in the trash.
+func trashKeys(folderName string, e trashEntry) [][2]string {
+	item := *e.Item
+	dir := trashDir + "/" + e.ID + "/"
+	keys := [][2]string{{storageKey(folderName, item.Key()), storageKey(folderName, dir+item.Name)}}
+	if item.OriginalSize > 0 {
+		keys = append(keys, [2]string{originalKey(folderName, item.Key()), storageKey(folderName, dir+originalsDir+"/"+item.Name)})
+	}
+	for _, v := range item.Versions {
+		keys = append(keys, [2]string{itemVersionKey(folderName, item.Key(), v.Version), storageKey(folderName, dir+versionsDir+"/"+strconv.Itoa(v.Version))})
+	}
+	return keys
+}
+
+// TrashItem moves the item into the trash,
+// it is deleted at once when the trash is disabled.
+func (t *torDropFileServer) TrashItem(folderName, name string) error {
+	if t.conf.TrashRetention <= 0 {
+		return t.RmItem(folderName, name)
+	}
+	var items fileItems
+	ret := make(chan error)
+	t.ops <- func() {
+		item, err := t.db.GetItem(folderName, name)
+		if err == nil {
+			err = t.db.reserve(folderName, name)
+		}
+		items = fileItems{item}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	return t.trashItems(folderName, items, func() (fileItems, []string, error) {
+		item, err := t.db.GetItem(folderName, name)
+		if err == nil {
+			err = t.db.RmItem(folderName, name)
+		}
+		return fileItems{item}, nil, err
+	})
+}
+
+// TrashDir moves the items of the directory dir into the trash and removes it,
+// they are deleted at once when the trash is disabled.
+func (t *torDropFileServer) TrashDir(folderName, dir string) error {
+	if t.conf.TrashRetention <= 0 {
+		return t.RmDir(folderName, dir)
+	}
+	dir = cleanDir(dir)
+	var items fileItems
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		items, err = t.dirItems(folderName, dir)
+		for i, item := range items {
+			if err = t.db.reserve(folderName, item.Key()); err != nil {
+				for _, item := range items[:i] {
+					t.db.release(folderName, item.Key())
+				}
+				break
+			}
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	return t.trashItems(folderName, items, func() (fileItems, []string, error) {
+		// the items added to the directory meanwhile were not moved.
+		cur, err := t.dirItems(folderName, dir)
+		if err == nil && len(cur) != len(items) {
+			err = fmt.Errorf("directory %q changed, try again", dir)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return t.db.RmDir(folderName, dir)
+	})
+}
+
+// dirItems returns the items of the directory dir and of its sub directories,
+// it fails when some are being uploaded. It runs within the main loop.
+func (t *torDropFileServer) dirItems(folderName, dir string) (fileItems, error) {
+	if dir == "/" || !t.db.HasDir(folderName, dir) {
+		return nil, fmt.Errorf("directory %q not found in folder %q", dir, folderName)
+	}
+	for _, up := range t.db.Uploads.Items(folderName) {
+		if isInDir(up.Path, dir) {
+			return nil, fmt.Errorf("directory %q has uploads in progress", dir)
+		}
+	}
+	var items fileItems
+	for _, i := range t.db.Items[folderName] {
+		if isInDir(i.Path, dir) {
+			items = append(items, i)
+		}
+	}
+	return items, nil
+}
+
+// TrashFolder moves the folder with all its content into the trash,
+// it is deleted at once when the trash is disabled.
+func (t *torDropFileServer) TrashFolder(name string) error {
+	if t.conf.TrashRetention <= 0 {
+		return t.RmFolder(name)
+	}
+	ret := make(chan error)
+	t.ops <- func() {
+		e, err := t.db.TrashFolder(name)
+		if err == nil {
+			err = t.store.Batch(func(b storeTx) error {
+				return b.TrashFolder(name, e)
+			})
+			if err != nil {
+				t.db.RestoreFolder(e)
+			}
+		}
+		if err == nil {
+			for _, m := range []map[string]*folderManager{t.folderUploadManagers, t.folderDownloadManagers} {
+				if x, ok := m[name]; ok {
+					x.Close()
+					delete(m, name)
+				}
+			}
+		}
+		ret <- err
+	}
+	return <-ret
+}
+
+// trashItems moves the reserved items into the trash: their contents are moved
+// under their trash keys first, then rm removes their records within the main loop
+// and they are released. The contents are moved back when rm fails.
+func (t *torDropFileServer) trashItems(folderName string, items fileItems, rm func() (fileItems, []string, error)) error {
+	var entries []trashEntry
+	var keys [][2]string
+	for _, i := range items {
+		e := newTrashEntry()
+		item := i
+		e.Item = &item
+		entries = append(entries, e)
+		keys = append(keys, trashKeys(folderName, e)...)
+	}
+	err := moveObjects(t.storage, keys)
+	ret := make(chan error)
+	t.ops <- func() {
+		defer func() {
+			for _, i := range items {
+				t.db.release(folderName, i.Key())
+			}
+		}()
+		if err != nil {
+			ret <- err
+			return
+		}
+		ret <- t.trashRecords(folderName, entries, rm)
+	}
+	if err = <-ret; err != nil {
+		if e := moveObjects(t.storage, swapKeys(keys)); e != nil {
+			t.logger.Error("failed to move back the contents of the trashed files of %v: %v", folderName, e)
+		}
+	}
+	return err
+}
+
+// trashRecords removes the records of the items of the entries with rm and
+// stores the entries, it runs within the main loop.
+func (t *torDropFileServer) trashRecords(folderName string, entries []trashEntry, rm func() (fileItems, []string, error)) error {
+	items, dirs, err := rm()
+	if err != nil {
+		return err
+	}
+	// the records are taken again, their download counts may have changed meanwhile.
+	for _, e := range entries {
+		if items.Has(e.Item.Key()) {
+			*e.Item = items.Get(e.Item.Key())
+		}
+	}
+	err = t.store.Batch(func(b storeTx) error {
+		for _, i := range items {
+			if err := b.DeleteItem(folderName, i.Key()); err != nil {
+				return err
+			}
+		}
+		for _, d := range dirs {
+			if err := b.DeleteDir(folderName, d); err != nil {
+				return err
+			}
+		}
+		for _, e := range entries {
+			if err := b.PutTrash(folderName, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for _, d := range dirs {
+			t.db.AddDir(folderName, d)
+		}
+		for _, i := range items {
+			t.db.AddItem(folderName, i)
+		}
+		return err
+	}
+	if t.db.Trash == nil {
+		t.db.Trash = map[string][]trashEntry{}
+	}
+	t.db.Trash[folderName] = append(t.db.Trash[folderName], entries...)
+	return nil
+}
+
+// moveObjects moves the objects from the first key of the pairs to the second one,
+// the objects already moved are moved back when one fails. The missing objects are skipped.
+func moveObjects(s storage, keys [][2]string) error {
+	for i, k := range keys {
+		if _, err := s.Stat(k[0]); err != nil {
+			continue
+		}
+		if err := moveObject(s, k[0], k[1]); err != nil {
+			for _, k := range keys[:i] {
+				moveObject(s, k[1], k[0])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// swapKeys returns the pairs of keys in the opposite direction.
+func swapKeys(keys [][2]string) [][2]string {
+	res := make([][2]string, len(keys))
+	for i, k := range keys {
+		res[i] = [2]string{k[1], k[0]}
+	}
+	return res
+}
+
+// trashedItem is an entry of the trash with its folder.
+type trashedItem struct {
+	Folder string
+	trashEntry
+}
+
+// Size returns the size of the trashed item or folder.
+func (e trashEntry) Size() uint64 {
+	if e.Contents != nil {
+		return e.Contents.Items.Size()
+	}
+	return e.Item.Size
+}
+
+// Trash lists the entries of the trash of all the folders, the newest first.
+func (t *torDropFileServer) Trash() []trashedItem {
+	ret := make(chan []trashedItem)
+	t.ops <- func() {
+		var res []trashedItem
+		for folderName, entries := range t.db.Trash {
+			for _, e := range entries {
+				res = append(res, trashedItem{Folder: folderName, trashEntry: e})
+			}
+		}
+		ret <- res
+	}
+	res := <-ret
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].DeleteDate.After(res[j].DeleteDate)
+	})
+	return res
+}
+
+// RestoreTrash restores the trashed item or folder at its location.
+func (t *torDropFileServer) RestoreTrash(folderName, id string) error {
+	var e trashEntry
+	entryKey := trashDir + "/" + id
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		e, err = t.db.GetTrash(folderName, id)
+		if err != nil {
+			ret <- err
+			return
+		}
+		if e.Contents != nil {
+			ret <- t.restoreFolder(e)
+			return
+		}
+		// the item and the entry are held while the contents are moved back.
+		if t.db.HasUpload(folderName, entryKey) {
+			err = fmt.Errorf("entry %q is being restored", id)
+		}
+		if err == nil {
+			err = t.canRestoreItem(folderName, *e.Item)
+		}
+		if err == nil {
+			err = t.db.reserve(folderName, e.Item.Key())
+		}
+		if err == nil {
+			t.db.reserve(folderName, entryKey)
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil || e.Contents != nil {
+		return err
+	}
+	keys := swapKeys(trashKeys(folderName, e))
+	err := moveObjects(t.storage, keys)
+	t.ops <- func() {
+		defer t.db.release(folderName, e.Item.Key())
+		defer t.db.release(folderName, entryKey)
+		if err != nil {
+			ret <- err
+			return
+		}
+		ret <- t.restoreItem(folderName, e)
+	}
+	if err = <-ret; err != nil {
+		if e := moveObjects(t.storage, swapKeys(keys)); e != nil {
+			t.logger.Error("failed to move back the contents of %v/%v to the trash: %v", folderName, id, e)
+		}
+	}
+	return err
+}
+
+// canRestoreItem checks that the trashed item can be restored at its location,
+// it runs within the main loop.
+func (t *torDropFileServer) canRestoreItem(folderName string, item fileItem) error {
+	if t.db.Folder(folderName) == nil {
+		return fmt.Errorf("folder %q does not exist", folderName)
+	}
+	items, _ := t.db.GetItems(folderName, true)
+	if items.Has(item.Key()) || t.db.HasDir(folderName, "/"+item.Key()) {
+		return fmt.Errorf("file %q already exists", item.Key())
+	}
+	return nil
+}
+
+// restoreItem restores the record of a trashed item, and its
+// directories when they were removed, it runs within the main loop.
+func (t *torDropFileServer) restoreItem(folderName string, e trashEntry) error {
+	item := *e.Item
+	if err := t.canRestoreItem(folderName, item); err != nil {
+		return err
+	}
+	var dirs []string
+	for d := cleanDir(item.Path); d != "/" && !t.db.HasDir(folderName, d); d = path.Dir(d) {
+		dirs = append(dirs, d)
+	}
+	err := t.store.Batch(func(b storeTx) error {
+		for _, d := range dirs {
+			if err := b.PutDir(folderName, d); err != nil {
+				return err
+			}
+		}
+		if err := b.PutItem(folderName, item); err != nil {
+			return err
+		}
+		return b.DeleteTrash(folderName, e.ID)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		t.db.AddDir(folderName, dirs[i])
+	}
+	t.db.RmTrash(folderName, e.ID)
+	return t.db.AddItem(folderName, item)
+}
+
+// restoreFolder restores the records of a trashed folder, it runs within the main loop.
+func (t *torDropFileServer) restoreFolder(e trashEntry) error {
+	c := e.Contents
+	name := c.Folder.Name
+	if t.db.Folders.Has(name) {
+		return fmt.Errorf("folder %q already exists", name)
+	}
+	err := t.store.Batch(func(b storeTx) error {
+		if err := b.PutFolder(c.Folder); err != nil {
+			return err
+		}
+		for _, i := range c.Items {
+			if err := b.PutItem(name, i); err != nil {
+				return err
+			}
+		}
+		for _, d := range c.Dirs {
+			if err := b.PutDir(name, d); err != nil {
+				return err
+			}
+		}
+		for _, s := range c.Sources {
+			if err := b.PutSource(name, s); err != nil {
+				return err
+			}
+		}
+		return b.DeleteTrash(name, e.ID)
+	})
+	if err != nil {
+		return err
+	}
+	t.db.RestoreFolder(e)
+	if c.Folder.MaxDlBytesPerSec != nil && *c.Folder.MaxDlBytesPerSec > 0 {
+		t.setDownloadLimit(name, int(*c.Folder.MaxDlBytesPerSec))
+	}
+	if c.Folder.MaxUpBytesPerSec != nil && *c.Folder.MaxUpBytesPerSec > 0 {
+		t.setUploadLimit(name, int(*c.Folder.MaxUpBytesPerSec))
+	}
+	return nil
+}
+
+// PurgeTrash deletes the trashed item or folder for good.
+func (t *torDropFileServer) PurgeTrash(folderName, id string) error {
+	ret := make(chan error)
+	t.ops <- func() {
+		e, err := t.db.GetTrash(folderName, id)
+		if err == nil && t.db.HasUpload(folderName, trashDir+"/"+id) {
+			err = fmt.Errorf("entry %q is being restored", id)
+		}
+		if err == nil {
+			err = t.purgeTrash(folderName, e)
+		}
+		ret <- err
+	}
+	return <-ret
+}
+
+// purgeTrash removes the trash entry, then deletes its contents.
+// The trash of a purged folder is purged with it. It runs within the main loop.
+func (t *torDropFileServer) purgeTrash(folderName string, e trashEntry) error {
+	if e.Contents != nil {
+		if err := t.store.DeleteFolder(folderName); err != nil {
+			return err
+		}
+		delete(t.db.Trash, folderName)
+		delete(t.keys, folderName)
+		t.logger.Info("purged folder %v from the trash", folderName)
+		go func() {
+			if err := deletePrefix(t.storage, storageKey(folderName, "")); err != nil {
+				t.logger.Error("failed to delete the trashed folder %v: %v", folderName, err)
+			}
+		}()
+		return nil
+	}
+	err := t.store.Batch(func(b storeTx) error {
+		return b.DeleteTrash(folderName, e.ID)
+	})
+	if err != nil {
+		return err
+	}
+	t.db.RmTrash(folderName, e.ID)
+	t.logger.Info("purged file %v/%v from the trash", folderName, e.Item.Key())
+	go func() {
+		for _, k := range trashKeys(folderName, e) {
+			if err := t.storage.Delete(k[1]); err != nil {
+				t.logger.Error("failed to delete the trashed file %v: %v", k[1], err)
+			}
+		}
+	}()
+	return nil
+}
+
+// purgeExpiredTrash purges the trash entries older than the retention,
+// it runs within the main loop.
+func (t *torDropFileServer) purgeExpiredTrash() {
+	retention := t.conf.TrashRetention
+	if retention <= 0 {
+		retention = defaultTrashRetention
+	}
+	for folderName, entries := range t.db.Trash {
+		for _, e := range entries {
+			if time.Since(e.DeleteDate) <= retention || t.db.HasUpload(folderName, trashDir+"/"+e.ID) {
+				continue
+			}
+			if _, err := t.db.GetTrash(folderName, e.ID); err != nil {
+				// purged along with its folder.
+				continue
+			}
+			if err := t.purgeTrash(folderName, e); err != nil {
+				t.logger.Error("failed to purge %v/%v from the trash: %v", folderName, e.ID, err)
+			}
+		}
+	}
+}
+
+// TrashFolder moves the folder with all its content into its trash entry.
+func (t *torDropDB) TrashFolder(name string) (trashEntry, error) {
+	fd := t.Folder(name)
+	if fd == nil {
+		return trashEntry{}, fmt.Errorf("folder %q not found", name)
+	}
+	e := newTrashEntry()
+	e.Contents = &folderContents{
+		Folder:  *fd,
+		Items:   t.Items[name],
+		Dirs:    t.Dirs[name],
+		Sources: t.Sources[name],
+	}
+	var n []folder
+	for _, f := range t.Folders {
+		if f.Name != name {
+			n = append(n, f)
+		}
+	}
+	t.Folders = n
+	delete(t.Items, name)
+	delete(t.Dirs, name)
+	delete(t.Sources, name)
+	if t.Trash == nil {
+		t.Trash = map[string][]trashEntry{}
+	}
+	t.Trash[name] = append(t.Trash[name], e)
+	return e, nil
+}
+
+// RestoreFolder moves back the folder of the trash entry e with all its content.
+func (t *torDropDB) RestoreFolder(e trashEntry) {
+	c := e.Contents
+	name := c.Folder.Name
+	t.RmTrash(name, e.ID)
+	t.Folders = append(t.Folders, c.Folder)
+	if t.Items == nil {
+		t.Items = map[string]fileItems{}
+	}
+	if t.Dirs == nil {
+		t.Dirs = map[string][]string{}
+	}
+	if t.Sources == nil {
+		t.Sources = map[string][]source{}
+	}
+	if len(c.Items) > 0 {
+		t.Items[name] = c.Items
+	}
+	if len(c.Dirs) > 0 {
+		t.Dirs[name] = c.Dirs
+	}
+	if len(c.Sources) > 0 {
+		t.Sources[name] = c.Sources
+	}
+}
+
+// IsTrashed reports whether the folder is within the trash.
+func (t *torDropDB) IsTrashed(name string) bool {
+	for _, e := range t.Trash[name] {
+		if e.Contents != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *torDropDB) GetTrash(folderName, id string) (trashEntry, error) {
+	for _, e := range t.Trash[folderName] {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return trashEntry{}, fmt.Errorf("entry %q not found in the trash of folder %q", id, folderName)
+}
+
+func (t *torDropDB) RmTrash(folderName, id string) {
+	var n []trashEntry
+	for _, e := range t.Trash[folderName] {
+		if e.ID != id {
+			n = append(n, e)
+		}
+	}
+	t.Trash[folderName] = n
+}
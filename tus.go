@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+)
+
+// The tus 1.0 resumable upload protocol, with the creation and termination extensions.
+// The metadata of an upload are its filename, and optionally the path of its
+// directory, its expected sha256 or blake2b checksum and the captcha_id and
+// captcha_solution of the captcha required by the folder.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+)
+
+// tusMetadata decodes the Upload-Metadata header.
+func tusMetadata(h string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, pair := range strings.Split(h, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		var v []byte
+		if len(parts) > 1 {
+			var err error
+			v, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid metadata %q: %v", parts[0], err)
+			}
+		}
+		m[parts[0]] = string(v)
+	}
+	return m, nil
+}
+
+// tusRequest checks the protocol version and the folder authorization,
+// it writes the error response and returns nil on failure.
+func (t *torDropApp) tusRequest(w http.ResponseWriter, r *http.Request) *folder {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	folderName := mux.Vars(r)["folder"]
+	fd := t.fs.Folder(folderName)
+	if fd == nil {
+		http.Error(w, fmt.Sprintf("folder %q not found", folderName), http.StatusNotFound)
+		return nil
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if fd.MaxFileSize != nil && *fd.MaxFileSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatUint(uint64(*fd.MaxFileSize), 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return nil
+	}
+	if !t.isAdmin {
+		if err := t.hasAuthFolder(folderName, w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return nil
+		}
+	}
+	return fd
+}
+
+// TusCreate creates a resumable upload.
+func (t *torDropApp) TusCreate(w http.ResponseWriter, r *http.Request) {
+	fd := t.tusRequest(w, r)
+	if fd == nil {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	length, err := strconv.ParseUint(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length == 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	meta, err := tusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t.captchaRequired(fd, true) {
+		if err := t.verifyCaptcha(meta["captcha_id"], meta["captcha_solution"]); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if meta["filename"] == "" {
+		http.Error(w, "the filename metadata is required", http.StatusBadRequest)
+		return
+	}
+	source, err := t.loggedSource(fd, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	item := fileItem{
+		CreateDate: time.Now(),
+		Name:       uploadName(meta["filename"]),
+		Path:       meta["path"],
+		Size:       length,
+		SHA256:     meta["sha256"],
+		BLAKE2b:    meta["blake2b"],
+		Source:     source,
+	}
+	id, err := t.fs.CreateResumable(fd.Name, item, t.uploaderID(w, r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := t.router.Get("tus-upload").URL("folder", fd.Name, "id", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", u.String())
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusUpload reports, writes or terminates a resumable upload.
+func (t *torDropApp) TusUpload(w http.ResponseWriter, r *http.Request) {
+	fd := t.tusRequest(w, r)
+	if fd == nil {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	switch r.Method {
+	case http.MethodHead:
+		offset, length, err := t.fs.Resumable(fd.Name, id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatUint(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatUint(length, 10))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseUint(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+			return
+		}
+		offset, err = t.fs.WriteResumable(fd.Name, id, offset, r.Body)
+		w.Header().Set("Upload-Offset", strconv.FormatUint(offset, 10))
+		switch {
+		case err == errResumableOffset || err == errResumableBusy:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case http.MethodDelete:
+		if err := t.fs.TerminateResumable(fd.Name, id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// csrfExempt skips the csrf check of the tus requests, browsers cannot
+// send their Tus-Resumable header across origins without a preflight request.
+func csrfExempt(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/tus/") && r.Header.Get("Tus-Resumable") != "" {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
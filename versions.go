@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// versionsDir holds the older versions of the items of the versioned folders.
+const versionsDir = ".versions"
+
+func itemVersionKey(folderName, key string, version int) string {
+	return storageKey(folderName, fmt.Sprintf("%v/%v/%v", versionsDir, key, version))
+}
+
+// CurrentVersion returns the version number of the content of the item,
+// the items stored before the folder was versioned are the first version.
+func (f fileItem) CurrentVersion() int {
+	if f.Version < 1 {
+		return 1
+	}
+	return f.Version
+}
+
+func (f fileItem) nextVersion() int {
+	n := f.CurrentVersion()
+	for _, v := range f.Versions {
+		if v.Version > n {
+			n = v.Version
+		}
+	}
+	return n + 1
+}
+
+// asVersion returns the item as an older version of itself.
+func (f fileItem) asVersion() fileItem {
+	f.Version = f.CurrentVersion()
+	f.Versions = nil
+	f.OriginalSize = 0
+	f.Downloads, f.MaxDownloads = 0, 0
+	return f
+}
+
+// GetVersion returns the version of the item with the given number.
+func (f fileItem) GetVersion(version int) (fileItem, error) {
+	if version == f.CurrentVersion() {
+		return f, nil
+	}
+	for _, v := range f.Versions {
+		if v.Version == version {
+			v.Name, v.Path = f.Name, f.Path
+			return v, nil
+		}
+	}
+	return f, fmt.Errorf("file %q has no version %v", f.Key(), version)
+}
+
+// History returns the older versions of the item, the newest first.
+func (f fileItem) History() []fileItem {
+	var res []fileItem
+	for i := len(f.Versions) - 1; i >= 0; i-- {
+		res = append(res, f.Versions[i])
+	}
+	return res
+}
+
+// pruneVersions removes the older versions of item exceeding the retention
+// of the folder, it returns the removed versions.
+func pruneVersions(fd *folder, item *fileItem) (pruned []fileItem) {
+	var keep []fileItem
+	for i, v := range item.Versions {
+		switch {
+		case fd.MaxVersions != nil && *fd.MaxVersions >= 0 && len(item.Versions)-i > *fd.MaxVersions:
+		case fd.MaxVersionAge != nil && *fd.MaxVersionAge > 0 && time.Since(v.CreateDate) > time.Duration(*fd.MaxVersionAge):
+		default:
+			keep = append(keep, v)
+			continue
+		}
+		pruned = append(pruned, v)
+	}
+	item.Versions = keep
+	return pruned
+}
+
+// archiveVersion copies the content of the item being replaced by a new upload
+// to its version key, it remains readable until replaced. It returns the archived version.
+func (t *torDropFileServer) archiveVersion(folderName, key string) (*fileItem, error) {
+	var item fileItem
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		item, err = t.db.GetItem(folderName, key)
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		// a new item.
+		return nil, nil
+	}
+	v := item.asVersion()
+	err := copyObject(t.storage, storageKey(folderName, key), itemVersionKey(folderName, key, v.Version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive the version %v of %q: %v", v.Version, key, err)
+	}
+	return &v, nil
+}
+
+// unarchiveVersion moves back the content of an archived version,
+// it restores the content replaced by a failed write.
+func (t *torDropFileServer) unarchiveVersion(folderName, key string, v fileItem) {
+	err := moveObject(t.storage, itemVersionKey(folderName, key, v.Version), storageKey(folderName, key))
+	if err != nil {
+		t.logger.Error("failed to restore the version %v of %v/%v: %v", v.Version, folderName, key, err)
+	}
+}
+
+// deleteVersions deletes the contents of the given versions of an item.
+func (t *torDropFileServer) deleteVersions(folderName, key string, versions []fileItem) error {
+	var err error
+	for _, v := range versions {
+		if e := t.storage.Delete(itemVersionKey(folderName, key, v.Version)); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// RestoreVersion makes an older version of the item its current content,
+// the current content becomes an older version. The item is reserved
+// while the contents are copied, the current content remains readable.
+func (t *torDropFileServer) RestoreVersion(folderName, key string, version int) error {
+	var item fileItem
+	ret := make(chan error)
+	t.ops <- func() {
+		var err error
+		item, err = t.db.GetItem(folderName, key)
+		if err == nil && version != item.CurrentVersion() {
+			err = t.db.reserve(folderName, key)
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		return err
+	}
+	if version == item.CurrentVersion() {
+		return nil
+	}
+	v, err := item.GetVersion(version)
+	cur := item.asVersion()
+	current := storageKey(folderName, key)
+	if err == nil {
+		err = copyObject(t.storage, current, itemVersionKey(folderName, key, cur.Version))
+		if err == nil {
+			if err = copyObject(t.storage, itemVersionKey(folderName, key, version), current); err != nil {
+				t.storage.Delete(itemVersionKey(folderName, key, cur.Version))
+			}
+		}
+	}
+	if err != nil {
+		t.ops <- func() { t.db.release(folderName, key) }
+		return err
+	}
+
+	v.Versions = nil
+	for _, x := range item.Versions {
+		if x.Version != version {
+			v.Versions = append(v.Versions, x)
+		}
+	}
+	v.Versions = append(v.Versions, cur)
+	t.ops <- func() {
+		defer t.db.release(folderName, key)
+		err := t.db.UpdateItem(folderName, v)
+		if err == nil {
+			if err = t.store.PutItem(folderName, v); err != nil {
+				t.db.UpdateItem(folderName, item)
+			}
+		}
+		ret <- err
+	}
+	if err := <-ret; err != nil {
+		t.unarchiveVersion(folderName, key, cur)
+		return err
+	}
+	if err := t.storage.Delete(itemVersionKey(folderName, key, version)); err != nil {
+		t.logger.Error("failed to delete the version %v of %v/%v: %v", version, folderName, key, err)
+	}
+	t.logger.Info("restored the version %v of %v/%v", version, folderName, key)
+	return nil
+}
+
+// PruneVersions removes the older versions of the items exceeding
+// the retention of their folder. The reserved items are skipped,
+// their versions may be being copied.
+func (t *torDropDB) PruneVersions(pruned func(folderName string, item fileItem, versions []fileItem)) {
+	for folderName, items := range t.Items {
+		fd := t.Folder(folderName)
+		if fd == nil {
+			continue
+		}
+		for i, item := range items {
+			if len(item.Versions) == 0 || t.HasUpload(folderName, item.Key()) {
+				continue
+			}
+			if p := pruneVersions(fd, &item); len(p) > 0 {
+				items[i] = item
+				pruned(folderName, item, p)
+			}
+		}
+	}
+}